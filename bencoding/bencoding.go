@@ -1,9 +1,12 @@
 package bencoding
 
 import (
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
-	"sort"
+	"net"
 	"strconv"
+	"unicode/utf8"
 )
 
 var ErrEmptyInput = errors.New("input cannot be empty")
@@ -11,6 +14,13 @@ var ErrInvalidFormat = errors.New("invalid format")
 var ErrInvalidLength = errors.New("invalid length")
 var ErrUnsupportedType = errors.New("unsupported type")
 var ErrEof = errors.New("end of stream")
+var ErrUnexpectedType = errors.New("unexpected type")
+var ErrMaxDepthExceeded = errors.New("maximum nesting depth exceeded")
+
+// MaxDepth is the maximum number of nested lists and dictionaries accepted by
+// Decode. Data coming from peers and trackers is untrusted, so without this
+// limit an input such as "llllllll..." could exhaust the stack.
+var MaxDepth = 256
 
 const (
 	String = 1
@@ -27,15 +37,45 @@ type Any struct {
 	AsDictionary map[string]*Any
 }
 
+// Binary strings longer than this are abbreviated by Dump.
+const dumpMaxBinaryLength = 32
+
+const (
+	HashLength = 20
+	CompactPeerLength = 6
+	CompactPeer6Length = 18
+)
+
 func dumpIndentSpaces(count int) string {
 	output := ""
 	for i := 0; i < count; i++ { output += "    " }
 	return output
 }
 
+// isBinaryString tells whether s should be displayed as binary data rather
+// than as text, i.e. if it is not valid UTF-8 or contains control characters.
+func isBinaryString(s string) bool {
+	if !utf8.ValidString(s) { return true }
+	for _, r := range s {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' { return true }
+		if r == 0x7f { return true }
+	}
+	return false
+}
+
+func dumpString(s string) string {
+	if !isBinaryString(s) {
+		return "\"" + s + "\""
+	}
+	if len(s) <= dumpMaxBinaryLength {
+		return "<hex " + hex.EncodeToString([]byte(s)) + ">"
+	}
+	return "<binary " + strconv.Itoa(len(s)) + " bytes " + hex.EncodeToString([]byte(s[:dumpMaxBinaryLength])) + "...>"
+}
+
 func (this *Any) dump(indent int) string {
 	if this.Type == String {
-		return "\"" + this.AsString + "\""
+		return dumpString(this.AsString)
 	}
 
 	if this.Type == Int {
@@ -55,7 +95,11 @@ func (this *Any) dump(indent int) string {
 	if this.Type == Dictionary {
 		output := "{\n"
 		for k, e := range this.AsDictionary {
-			output += dumpIndentSpaces(indent + 1) + k + ": "
+			// Text keys are left unquoted, binary ones such as info hashes
+			// are dumped like values.
+			key := k
+			if isBinaryString(k) { key = dumpString(k) }
+			output += dumpIndentSpaces(indent + 1) + key + ": "
 			output += e.dump(indent + 1) + "\n"
 		}
 		output += dumpIndentSpaces(indent) + "}"
@@ -69,6 +113,60 @@ func (this *Any) Dump() string {
 	return this.dump(0)
 }
 
+// AsBytes returns the raw bytes of a string value. Bencoded strings are byte
+// strings and may contain binary data such as SHA-1 hashes or compact peers.
+func (this *Any) AsBytes() []byte {
+	return []byte(this.AsString)
+}
+
+// AsChunks splits a string value into chunks of exactly `width` bytes.
+func (this *Any) AsChunks(width int) ([][]byte, error) {
+	if this.Type != String { return nil, ErrUnexpectedType }
+	if width <= 0 || len(this.AsString) % width != 0 { return nil, ErrInvalidLength }
+	data := this.AsBytes()
+	output := make([][]byte, 0, len(data) / width)
+	for i := 0; i < len(data); i += width {
+		output = append(output, data[i : i + width])
+	}
+	return output, nil
+}
+
+// AsHashes splits a string value, such as the "pieces" key of the info
+// dictionary, into 20-byte SHA-1 hashes.
+func (this *Any) AsHashes() ([][HashLength]byte, error) {
+	chunks, err := this.AsChunks(HashLength)
+	if err != nil { return nil, err }
+	output := make([][HashLength]byte, len(chunks))
+	for i, chunk := range chunks {
+		copy(output[i][:], chunk)
+	}
+	return output, nil
+}
+
+func compactPeers(any *Any, entryLength int) ([]*net.TCPAddr, error) {
+	chunks, err := any.AsChunks(entryLength)
+	if err != nil { return nil, err }
+	ipLength := entryLength - 2
+	output := make([]*net.TCPAddr, len(chunks))
+	for i, chunk := range chunks {
+		ip := make(net.IP, ipLength)
+		copy(ip, chunk[:ipLength])
+		output[i] = &net.TCPAddr{ IP: ip, Port: int(binary.BigEndian.Uint16(chunk[ipLength:])) }
+	}
+	return output, nil
+}
+
+// AsCompactPeers decodes a string value made of 6-byte IPv4 peer entries
+// (4 bytes of address followed by a 2-byte port, in network byte order).
+func (this *Any) AsCompactPeers() ([]*net.TCPAddr, error) {
+	return compactPeers(this, CompactPeerLength)
+}
+
+// AsCompactPeers6 decodes a string value made of 18-byte IPv6 peer entries.
+func (this *Any) AsCompactPeers6() ([]*net.TCPAddr, error) {
+	return compactPeers(this, CompactPeer6Length)
+}
+
 const (
 	stStarting = 0
 )
@@ -115,9 +213,14 @@ func decodeString(input []byte, index int) (string, int, error) {
 	if index >= len(input) { return "", index, ErrEof }
 	colonIndex := byteIndex(input, ':', index)
 	if colonIndex <= 0 { return "", index, ErrInvalidFormat }
+	for _, b := range input[index:colonIndex] {
+		if b < '0' || b > '9' { return "", index, ErrInvalidFormat }
+	}
 	stringLength, err := strconv.Atoi(string(input[index:colonIndex]))
 	if err != nil { return "", colonIndex + 1, err }
-	if colonIndex + stringLength >= len(input) { return "", colonIndex + 1, ErrInvalidLength }
+	// Check the length against the remaining input before doing anything with
+	// it, so that huge lengths cannot overflow or trigger large allocations.
+	if stringLength > len(input) - colonIndex - 1 { return "", colonIndex + 1, ErrInvalidLength }
 	output := input[colonIndex + 1 : colonIndex + 1 + stringLength]
 	return string(output), colonIndex + stringLength + 1, nil
 }
@@ -132,7 +235,7 @@ func decodeInt(input []byte, index int) (int, int, error) {
 	return output, endIndex + 1, nil
 }
 
-func decodeList(input []byte, index int) ([]*Any, int, error) {
+func decodeList(input []byte, index int, depth int) ([]*Any, int, error) {
 	if index >= len(input) { return []*Any{}, index, ErrEof }
 	if input[index] != 'l' { return []*Any{}, index, ErrInvalidFormat }
 
@@ -143,7 +246,7 @@ func decodeList(input []byte, index int) ([]*Any, int, error) {
 			index = i + 1
 			return output, index, nil
 		}
-		item, newIndex, err := decodeNext(input, i)
+		item, newIndex, err := decodeNext(input, i, depth + 1)
 		if err != nil { return output, i, err }
 		i = newIndex - 1 // Decrement since it's going to be incremented in the for statement
 		output = append(output, item)
@@ -151,7 +254,7 @@ func decodeList(input []byte, index int) ([]*Any, int, error) {
 	return []*Any{}, i, ErrInvalidFormat // Didn't find 'e' tag
 }
 
-func decodeDictionary(input []byte, index int) (map[string]*Any, int, error) {
+func decodeDictionary(input []byte, index int, depth int) (map[string]*Any, int, error) {
 	if index >= len(input) { return map[string]*Any{}, index, ErrEof }
 	if input[index] != 'd' { return map[string]*Any{}, index, ErrInvalidFormat }
 
@@ -167,7 +270,7 @@ func decodeDictionary(input []byte, index int) (map[string]*Any, int, error) {
 		if err != nil { return map[string]*Any{}, newIndex, err }
 		i = newIndex
 
-		value, newIndex, err := decodeNext(input, i)		
+		value, newIndex, err := decodeNext(input, i, depth + 1)
 		if err != nil { return map[string]*Any{}, newIndex, err }
 		i = newIndex - 1 // Decrement since it's going to be incremented in the for statement
 		
@@ -176,8 +279,9 @@ func decodeDictionary(input []byte, index int) (map[string]*Any, int, error) {
 	return map[string]*Any{}, i, ErrInvalidFormat // Didn't find 'e' tag
 }
 
-func decodeNext(input []byte, index int) (*Any, int, error) {	
+func decodeNext(input []byte, index int, depth int) (*Any, int, error) {
 	if index >= len(input) { return nil, index, ErrEof }
+	if depth > MaxDepth { return nil, index, ErrMaxDepthExceeded }
 	b := input[index]
 	switch {
 
@@ -195,13 +299,13 @@ func decodeNext(input []byte, index int) (*Any, int, error) {
 			
 		case b == 'l':
 			
-			l, index, err := decodeList(input, index)
+			l, index, err := decodeList(input, index, depth)
 			if err != nil { return nil, index, err }
 			return newAnyList(l), index, nil
 
 		case b == 'd':
 
-			d, index, err := decodeDictionary(input, index)
+			d, index, err := decodeDictionary(input, index, depth)
 			if err != nil { return nil, index, err }
 			return newAnyDictionary(d), index, nil
 	}
@@ -209,60 +313,11 @@ func decodeNext(input []byte, index int) (*Any, int, error) {
 	return nil, index, ErrUnsupportedType
 }
 
-func appendBytes(dest []byte, source []byte) []byte {
-	output := dest
-	for _, b := range source {
-		output = append(output, b)
-	}
-	return output
-}
-
 func Decode(input []byte) (*Any, error) {
-	output, _, err := decodeNext(input, 0)
+	output, _, err := decodeNext(input, 0, 0)
 	return output, err
 }
 
 func Encode(any *Any) ([]byte, error) {
-	if any.Type == String {
-		return []byte(strconv.Itoa(len(any.AsString)) + ":" + any.AsString), nil
-	}
-	
-	if any.Type == Int {
-		return []byte("i" + strconv.Itoa(any.AsInt) + "e"), nil
-	}
-	
-	if any.Type == List {
-		output := []byte{'l'}
-		for _, e := range any.AsList {
-			encoded, err := Encode(e)
-			if err != nil { return []byte{}, nil }
-			output = appendBytes(output, encoded)
-		}
-		output = append(output, 'e')
-		return output, nil
-	}
-	
-	if any.Type == Dictionary {
-		// The keys must be sorted first
-		var keys []string
-		for key, _ := range any.AsDictionary {
-			keys = append(keys, key)
-		}
-		sort.Strings(keys)
-
-		output := []byte{'d'}
-		for _, key := range keys {
-			e := any.AsDictionary[key]
-			encodedKey, err := Encode(newAnyString(key))
-			if err != nil { return []byte{}, nil }
-			output = appendBytes(output, encodedKey)
-			encoded, err := Encode(e)
-			if err != nil { return []byte{}, nil }
-			output = appendBytes(output, encoded)
-		}
-		output = append(output, 'e')
-		return output, nil
-	}
-	
-	panic("unreachable")
-}
\ No newline at end of file
+	return AppendEncode(nil, any)
+}
@@ -5,6 +5,8 @@ import (
 	"path/filepath"
 	"io/ioutil"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"	
 )
@@ -127,7 +129,7 @@ func Test_DecodeList(t *testing.T) {
 	}
 	
 	for _, d := range stringListTests {
-		output, _, err := decodeList([]byte(d.input), 0)
+		output, _, err := decodeList([]byte(d.input), 0, 0)
 		if err != nil && d.err == ErrSomeError { err = ErrSomeError }
 		if err != d.err                         { t.Errorf("Expected error '%s', got error '%s' for input '%s'", d.err, err, d.input) }
 		if !compareStringList(output, d.output) { t.Errorf("Expected \"%s\", got \"%s\"", d.output, output) }
@@ -154,7 +156,7 @@ func Test_DecodeList(t *testing.T) {
 	mixListTests = append(mixListTests, mixListTest)
 	
 	for _, d := range mixListTests {
-		output, _, err := decodeList([]byte(d.input), 0)
+		output, _, err := decodeList([]byte(d.input), 0, 0)
 		if err != nil && d.err == ErrSomeError  { err = ErrSomeError }
 		if err != d.err { t.Errorf("Expected error '%s', got error '%s' for input '%s'", d.err, err, d.input) }
 		if !compareAny(newAnyList(output), d.output) { t.Errorf("Expected \"%s\", got \"%s\"", d.output, output) }
@@ -214,7 +216,7 @@ func Test_DecodeDictionary(t *testing.T) {
 	mixListTests = append(mixListTests, d)
 	
 	for _, d := range mixListTests {
-		output, index, err := decodeDictionary([]byte(d.input), 0)
+		output, index, err := decodeDictionary([]byte(d.input), 0, 0)
 		if err != nil && d.err == ErrSomeError  { err = ErrSomeError }
 		if err != d.err { t.Errorf("Expected error '%s', got error '%s' for input '%s' at index %d", d.err, err, d.input, index) }
 		if !compareAny(newAnyDictionary(output), newAnyDictionary(d.output)) { t.Errorf("Expected \"%s\", got \"%s\" at index %d", d.output, output, index) }
@@ -293,4 +295,367 @@ func Test_DecodingEncodingEquality(t *testing.T) {
 	} 
 	
 	filepath.Walk("../testing", visitPath)	
-}
\ No newline at end of file
+}
+func Test_Dump(t *testing.T) {
+	type DumpTest struct {
+		input *Any
+		output string
+	}
+
+	var tests = []DumpTest{
+		{ newAnyString("abcd"), "\"abcd\"" },
+		{ newAnyString("été"), "\"été\"" },
+		{ newAnyString("\x00\x01\xff"), "<hex 0001ff>" },
+		{ newAnyString(strings.Repeat("\xff", 40)), "<binary 40 bytes " + strings.Repeat("ff", 32) + "...>" },
+		{ newAnyList([]*Any{ newAnyString("\x12\x34") }), "[\n    0: <hex 1234>\n]" },
+		{ newAnyDictionary(map[string]*Any{ "\x00\xab\n": newAnyInt(1) }), "{\n    <hex 00ab0a>: 1\n}" },
+		{ newAnyDictionary(map[string]*Any{ "name": newAnyInt(1) }), "{\n    name: 1\n}" },
+	}
+
+	for _, d := range tests {
+		output := d.input.Dump()
+		if output != d.output { t.Errorf("Expected \"%s\", got \"%s\"", d.output, output) }
+	}
+}
+
+func Test_AsChunks(t *testing.T) {
+	chunks, err := newAnyString("aabbcc").AsChunks(2)
+	if err != nil { t.Fatal("Expected no error, got", err) }
+	if len(chunks) != 3 || string(chunks[2]) != "cc" { t.Errorf("Unexpected chunks: %q", chunks) }
+
+	_, err = newAnyString("aabbc").AsChunks(2)
+	if err != ErrInvalidLength { t.Errorf("Expected error '%s', got error '%s'", ErrInvalidLength, err) }
+
+	_, err = newAnyInt(123).AsChunks(2)
+	if err != ErrUnexpectedType { t.Errorf("Expected error '%s', got error '%s'", ErrUnexpectedType, err) }
+
+	hashes, err := newAnyString(strings.Repeat("a", 20) + strings.Repeat("b", 20)).AsHashes()
+	if err != nil { t.Fatal("Expected no error, got", err) }
+	if len(hashes) != 2 || hashes[1][19] != 'b' { t.Errorf("Unexpected hashes: %v", hashes) }
+}
+
+func Test_AsCompactPeers(t *testing.T) {
+	peers, err := newAnyString("\x0a\x00\x00\x01\x1a\xe1\xc0\xa8\x01\x02\x00\x50").AsCompactPeers()
+	if err != nil { t.Fatal("Expected no error, got", err) }
+	if len(peers) != 2 { t.Fatalf("Expected 2 peers, got %d", len(peers)) }
+	if peers[0].String() != "10.0.0.1:6881" { t.Errorf("Expected \"10.0.0.1:6881\", got \"%s\"", peers[0]) }
+	if peers[1].String() != "192.168.1.2:80" { t.Errorf("Expected \"192.168.1.2:80\", got \"%s\"", peers[1]) }
+
+	peers, err = newAnyString("\x20\x01\x0d\xb8" + strings.Repeat("\x00", 11) + "\x01\x1a\xe1").AsCompactPeers6()
+	if err != nil { t.Fatal("Expected no error, got", err) }
+	if len(peers) != 1 || peers[0].String() != "[2001:db8::1]:6881" { t.Errorf("Unexpected peers: %v", peers) }
+
+	_, err = newAnyString("12345").AsCompactPeers()
+	if err != ErrInvalidLength { t.Errorf("Expected error '%s', got error '%s'", ErrInvalidLength, err) }
+}
+
+func Test_ToJson(t *testing.T) {
+	type JsonTest struct {
+		input string
+		output string
+	}
+
+	var tests = []JsonTest{
+		{ "i-12e", "-12" },
+		{ "4:a&<b", "\"a&<b\"" },
+		{ "3:\x00\x01\x02", "{\"$base64\":\"AAEC\"}" },
+		{ "li1e1:ae", "[1,\"a\"]" },
+		{ "le", "[]" },
+		{ "de", "{}" },
+		{ "d1:bi2e1:ai1ee", "{\"a\":1,\"b\":2}" },
+		{ "d1:\xffi1e1:ai2ee", "{\"$pairs\":[[\"a\",2],[{\"$base64\":\"/w==\"},1]]}" },
+		{ "d7:$base643:abce", "{\"$pairs\":[[\"$base64\",\"abc\"]]}" },
+	}
+
+	for _, d := range tests {
+		decoded, err := Decode([]byte(d.input))
+		if err != nil { t.Fatal("Invalid input string:", d.input) }
+		output, err := ToJson(decoded)
+		if err != nil { t.Errorf("Expected no error, got %s", err) }
+		if string(output) != d.output { t.Errorf("Expected '%s', got '%s'", d.output, output) }
+
+		back, err := FromJson(output)
+		if err != nil { t.Errorf("Expected no error, got %s", err) }
+		if !compareAny(decoded, back) { t.Errorf("JSON round trip failed for '%s'", d.input) }
+	}
+}
+
+func Test_FromJson(t *testing.T) {
+	var invalidTests = []string{ "true", "null", "1.5", "{\"a\":null}", "{\"$base64\":\"!!\"}", "{\"$pairs\":[[1,2]]}", "[1] [2]" }
+
+	for _, s := range invalidTests {
+		_, err := FromJson([]byte(s))
+		if err == nil { t.Errorf("Expected an error for '%s'", s) }
+	}
+
+	output, err := FromJson([]byte("{\"announce\":\"http://a/b?c=1&d=2\",\"info\":{\"length\":10}}"))
+	if err != nil { t.Fatal("Expected no error, got", err) }
+	encoded, _ := Encode(output)
+	if string(encoded) != "d8:announce18:http://a/b?c=1&d=24:infod6:lengthi10eee" { t.Errorf("Unexpected output: %s", encoded) }
+}
+
+func Test_JsonTorrentFiles(t *testing.T) {
+	paths, _ := filepath.Glob("../testing/*.torrent")
+	for _, path := range paths {
+		original, err := ioutil.ReadFile(path)
+		if err != nil { t.Fatalf("Cannot read test file: %s", path) }
+		decoded, err := Decode(original)
+		if err != nil { t.Fatalf("Cannot decode file: %s", path) }
+		json, err := ToJson(decoded)
+		if err != nil { t.Fatalf("Cannot convert to JSON: %s: %s", path, err) }
+		back, err := FromJson(json)
+		if err != nil { t.Fatalf("Cannot convert from JSON: %s: %s", path, err) }
+		encoded, err := Encode(back)
+		if err != nil { t.Fatalf("Cannot re-encode data: %s", path) }
+		if !byteSlicesEqual(original, encoded) { t.Errorf("JSON round trip differs from original data: %s", path) }
+	}
+}
+
+func Test_Query(t *testing.T) {
+	data, _ := Decode([]byte("d4:infod5:filesld6:lengthi10e4:pathl1:aeeee4:name3:abce"))
+
+	length, err := data.GetInt("info", "files", 0, "length")
+	if err != nil || length != 10 { t.Errorf("Expected 10, got %d (%v)", length, err) }
+
+	name, err := data.GetString("name")
+	if err != nil || name != "abc" { t.Errorf("Expected \"abc\", got \"%s\" (%v)", name, err) }
+
+	_, ok := data.Get("info", "files", 1)
+	if ok { t.Error("Expected index 1 not to be found") }
+
+	type QueryErrorTest struct {
+		path []interface{}
+		err error
+		errPath string
+	}
+
+	var tests = []QueryErrorTest{
+		{ []interface{}{ "info", "missing" }, ErrKeyNotFound, "info.missing" },
+		{ []interface{}{ "info", "files", 3 }, ErrIndexOutOfBound, "info.files[3]" },
+		{ []interface{}{ "name", 0 }, ErrUnexpectedType, "name[0]" },
+		{ []interface{}{ "info", 1.5 }, ErrInvalidPath, "info[?]" },
+	}
+
+	for _, d := range tests {
+		_, err := data.Query(d.path...)
+		pathError, ok := err.(*PathError)
+		if !ok { t.Errorf("Expected a PathError, got '%v'", err); continue }
+		if !errors.Is(err, d.err) { t.Errorf("Expected error '%s', got error '%s'", d.err, err) }
+		if pathError.Path != d.errPath { t.Errorf("Expected path \"%s\", got \"%s\"", d.errPath, pathError.Path) }
+	}
+
+	_, err = data.GetString("info", "files")
+	if !errors.Is(err, ErrUnexpectedType) { t.Errorf("Expected error '%s', got error '%v'", ErrUnexpectedType, err) }
+
+	var nilAny *Any
+	_, ok = nilAny.Get("info")
+	if ok { t.Error("Expected nil value to have no key") }
+}
+
+func Test_Set(t *testing.T) {
+	data := NewDictionary(map[string]*Any{})
+
+	err := data.Set(NewInt(10), "info", "length")
+	if err != nil { t.Fatal("Expected no error, got", err) }
+	err = data.Set(NewList(nil), "info", "files")
+	if err != nil { t.Fatal("Expected no error, got", err) }
+	err = data.Set(NewString("a"), "info", "files", 0)
+	if err != nil { t.Fatal("Expected no error, got", err) }
+	err = data.Set(NewString("b"), "info", "files", 0)
+	if err != nil { t.Fatal("Expected no error, got", err) }
+
+	encoded, _ := Encode(data)
+	if string(encoded) != "d4:infod5:filesl1:be6:lengthi10eee" { t.Errorf("Unexpected output: %s", encoded) }
+
+	err = data.Set(NewInt(1), "info", "files", 5)
+	if !errors.Is(err, ErrIndexOutOfBound) { t.Errorf("Expected error '%s', got error '%v'", ErrIndexOutOfBound, err) }
+	err = data.Set(NewInt(1), "info", "length", "x")
+	if !errors.Is(err, ErrUnexpectedType) { t.Errorf("Expected error '%s', got error '%v'", ErrUnexpectedType, err) }
+}
+
+func Test_EncodeErrors(t *testing.T) {
+	var tests = []*Any{
+		nil,
+		&Any{ Type: 99 },
+		newAnyList([]*Any{ newAnyInt(1), nil }),
+		newAnyDictionary(map[string]*Any{ "a": newAnyInt(1), "b": &Any{} }),
+	}
+
+	for _, d := range tests {
+		_, err := Encode(d)
+		if err != ErrUnsupportedType { t.Errorf("Expected error '%s', got error '%v'", ErrUnsupportedType, err) }
+
+		dest := []byte("prefix")
+		output, err := AppendEncode(dest, d)
+		if err != ErrUnsupportedType { t.Errorf("Expected error '%s', got error '%v'", ErrUnsupportedType, err) }
+		if string(output) != "prefix" { t.Errorf("Expected \"prefix\", got \"%s\"", output) }
+	}
+}
+
+func Test_Encoder(t *testing.T) {
+	var buffer strings.Builder
+	encoder := NewEncoder(&buffer)
+
+	var tests = []string{ "d3:key4:AAAAe", "li123e3:abcl1:x2:yyee", "i-1e" }
+
+	expected := ""
+	for _, s := range tests {
+		decoded, err := Decode([]byte(s))
+		if err != nil { t.Fatal("Invalid input string:", s) }
+		err = encoder.Encode(decoded)
+		if err != nil { t.Error("Expected no error, got", err) }
+		expected += s
+	}
+
+	if buffer.String() != expected { t.Errorf("Expected '%s', got '%s'", expected, buffer.String()) }
+}
+
+// encodeLegacy is the encoder as it was before AppendEncode was introduced.
+// It is only kept to compare performances in the benchmarks below.
+func encodeLegacy(any *Any) ([]byte, error) {
+	appendBytes := func(dest []byte, source []byte) []byte {
+		output := dest
+		for _, b := range source {
+			output = append(output, b)
+		}
+		return output
+	}
+
+	if any.Type == String {
+		return []byte(strconv.Itoa(len(any.AsString)) + ":" + any.AsString), nil
+	}
+
+	if any.Type == Int {
+		return []byte("i" + strconv.Itoa(any.AsInt) + "e"), nil
+	}
+
+	if any.Type == List {
+		output := []byte{'l'}
+		for _, e := range any.AsList {
+			encoded, _ := encodeLegacy(e)
+			output = appendBytes(output, encoded)
+		}
+		output = append(output, 'e')
+		return output, nil
+	}
+
+	var keys []string
+	for key, _ := range any.AsDictionary {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	output := []byte{'d'}
+	for _, key := range keys {
+		encodedKey, _ := encodeLegacy(newAnyString(key))
+		output = appendBytes(output, encodedKey)
+		encoded, _ := encodeLegacy(any.AsDictionary[key])
+		output = appendBytes(output, encoded)
+	}
+	output = append(output, 'e')
+	return output, nil
+}
+
+// benchmarkMessage returns a value similar to a DHT get_peers response.
+func benchmarkMessage() *Any {
+	data, err := Decode([]byte("d1:rd2:id20:abcdefghij01234567895:token8:aoeusnth6:valuesl6:axje.u6:idhtnmee1:t2:aa1:y1:re"))
+	if err != nil { panic(err) }
+	return data
+}
+
+func BenchmarkEncodeLegacy(b *testing.B) {
+	data := benchmarkMessage()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		encodeLegacy(data)
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	data := benchmarkMessage()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Encode(data)
+	}
+}
+
+func BenchmarkAppendEncode(b *testing.B) {
+	data := benchmarkMessage()
+	buffer := make([]byte, 0, 1024)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buffer, _ = AppendEncode(buffer[:0], data)
+	}
+}
+
+func BenchmarkEncoder(b *testing.B) {
+	data := benchmarkMessage()
+	encoder := NewEncoder(ioutil.Discard)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		encoder.Encode(data)
+	}
+}
+
+func Test_DecodeLimits(t *testing.T) {
+	type LimitTest struct {
+		input string
+		err error
+	}
+
+	var tests = []LimitTest{
+		{ strings.Repeat("l", MaxDepth + 1) + strings.Repeat("e", MaxDepth + 1), nil },
+		{ strings.Repeat("l", MaxDepth + 2) + strings.Repeat("e", MaxDepth + 2), ErrMaxDepthExceeded },
+		{ strings.Repeat("d1:a", MaxDepth + 2) + "i1e" + strings.Repeat("e", MaxDepth + 2), ErrMaxDepthExceeded },
+		{ strings.Repeat("l", 1000000), ErrMaxDepthExceeded },
+		{ "d-1:ae", ErrInvalidFormat },
+		{ "d+1:ai1ee", ErrInvalidFormat },
+		{ "99999999999999999999:a", ErrSomeError },
+		{ "9223372036854775807:a", ErrInvalidLength },
+	}
+
+	for _, d := range tests {
+		_, err := Decode([]byte(d.input))
+		if err != nil && d.err == ErrSomeError { err = ErrSomeError }
+		if err != d.err { t.Errorf("Expected error '%v', got error '%v' for input '%.20s'", d.err, err, d.input) }
+	}
+}
+
+func addTorrentFilesToCorpus(f *testing.F) {
+	paths, _ := filepath.Glob("../testing/*.torrent")
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil { f.Fatalf("Cannot read test file: %s", path) }
+		f.Add(data)
+	}
+	f.Add([]byte("d3:key4:AAAA4:key2d2:XXi123e3:XXXli123ei456eeee"))
+	f.Add([]byte("li-1e0:le4:\x00\x01\x02\x03e"))
+}
+
+func FuzzDecode(f *testing.F) {
+	addTorrentFilesToCorpus(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoded, err := Decode(data)
+		if err != nil { return }
+		encoded, err := Encode(decoded)
+		if err != nil { t.Fatalf("Cannot encode decoded data: %s", err) }
+		decodedAgain, err := Decode(encoded)
+		if err != nil { t.Fatalf("Cannot decode encoded data: %s", err) }
+		if !compareAny(decoded, decodedAgain) { t.Fatal("Decode/Encode round trip changed the data") }
+		encodedAgain, _ := Encode(decodedAgain)
+		if !byteSlicesEqual(encoded, encodedAgain) { t.Fatal("Encoding is not deterministic") }
+	})
+}
+
+func FuzzJson(f *testing.F) {
+	addTorrentFilesToCorpus(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoded, err := Decode(data)
+		if err != nil { return }
+		json, err := ToJson(decoded)
+		if err != nil { t.Fatalf("Cannot convert to JSON: %s", err) }
+		back, err := FromJson(json)
+		if err != nil { t.Fatalf("Cannot convert from JSON: %s: %s", err, json) }
+		if !compareAny(decoded, back) { t.Fatal("JSON round trip changed the data") }
+	})
+}
@@ -0,0 +1,107 @@
+package bencoding
+
+import (
+	"io"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// Encoder writes bencoded values to an io.Writer. Its internal buffer is
+// reused between calls so that encoding many messages, such as DHT or peer
+// extension traffic, doesn't allocate once the buffer has grown.
+type Encoder struct {
+	writer io.Writer
+	buffer []byte
+}
+
+func NewEncoder(writer io.Writer) *Encoder {
+	output := new(Encoder)
+	output.writer = writer
+	return output
+}
+
+func (this *Encoder) Encode(any *Any) error {
+	var err error
+	this.buffer, err = AppendEncode(this.buffer[:0], any)
+	if err != nil { return err }
+	_, err = this.writer.Write(this.buffer)
+	return err
+}
+
+// Dictionary keys have to be sorted before being encoded. The slices used
+// for this are pooled to avoid allocating one per dictionary.
+var keysPool = sync.Pool{
+	New: func() interface{} {
+		keys := make([]string, 0, 16)
+		return &keys
+	},
+}
+
+func appendString(dest []byte, s string) []byte {
+	dest = strconv.AppendInt(dest, int64(len(s)), 10)
+	dest = append(dest, ':')
+	return append(dest, s...)
+}
+
+// AppendEncode appends the bencoded form of any to dest and returns the
+// extended buffer. If an error occurs, the returned buffer is dest
+// truncated to its original length.
+func AppendEncode(dest []byte, any *Any) ([]byte, error) {
+	output, err := appendEncode(dest, any)
+	if err != nil { return dest, err }
+	return output, nil
+}
+
+func appendEncode(dest []byte, any *Any) ([]byte, error) {
+	if any == nil { return dest, ErrUnsupportedType }
+
+	switch any.Type {
+
+		case String:
+
+			return appendString(dest, any.AsString), nil
+
+		case Int:
+
+			dest = append(dest, 'i')
+			dest = strconv.AppendInt(dest, int64(any.AsInt), 10)
+			return append(dest, 'e'), nil
+
+		case List:
+
+			dest = append(dest, 'l')
+			for _, e := range any.AsList {
+				var err error
+				dest, err = appendEncode(dest, e)
+				if err != nil { return dest, err }
+			}
+			return append(dest, 'e'), nil
+
+		case Dictionary:
+
+			keysPointer := keysPool.Get().(*[]string)
+			keys := (*keysPointer)[:0]
+			for key, _ := range any.AsDictionary {
+				keys = append(keys, key)
+			}
+			slices.Sort(keys)
+
+			var err error
+			dest = append(dest, 'd')
+			for _, key := range keys {
+				dest = appendString(dest, key)
+				dest, err = appendEncode(dest, any.AsDictionary[key])
+				if err != nil { break }
+			}
+
+			clear(keys)
+			*keysPointer = keys[:0]
+			keysPool.Put(keysPointer)
+
+			if err != nil { return dest, err }
+			return append(dest, 'e'), nil
+	}
+
+	return dest, ErrUnsupportedType
+}
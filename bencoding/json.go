@@ -0,0 +1,227 @@
+package bencoding
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strconv"
+)
+
+// JSON conversion follows these conventions:
+//
+// - Integers are converted to JSON numbers.
+// - Text strings (valid UTF-8 without control characters) are converted to
+//   JSON strings. Binary strings are converted to an object with a single
+//   "$base64" key holding the standard base64 encoding of the data, e.g.
+//   {"$base64":"AAEC"}.
+// - Lists are converted to JSON arrays.
+// - Dictionaries are converted to JSON objects with their keys sorted in
+//   the same order as bencoding. If a key is binary, or if the dictionary
+//   would be mistaken for a marker object, it is converted instead to an
+//   object with a single "$pairs" key holding an array of [key, value]
+//   arrays, e.g. {"$pairs":[[{"$base64":"/w=="},1]]}.
+//
+// This makes the conversion lossless so that FromJson(ToJson(x)) always
+// returns a value equal to x.
+
+const (
+	JsonBinaryKey = "$base64"
+	JsonPairsKey = "$pairs"
+)
+
+func writeJsonString(buffer *bytes.Buffer, s string) error {
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(s)
+	if err != nil { return err }
+	buffer.Truncate(buffer.Len() - 1) // Encode adds a trailing newline
+	return nil
+}
+
+func writeJsonBencodedString(buffer *bytes.Buffer, s string) error {
+	if !isBinaryString(s) { return writeJsonString(buffer, s) }
+	buffer.WriteString("{\"" + JsonBinaryKey + "\":\"")
+	buffer.WriteString(base64.StdEncoding.EncodeToString([]byte(s)))
+	buffer.WriteString("\"}")
+	return nil
+}
+
+func sortedKeys(dictionary map[string]*Any) []string {
+	keys := make([]string, 0, len(dictionary))
+	for key, _ := range dictionary {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func dictionaryNeedsPairs(keys []string) bool {
+	if len(keys) == 1 && (keys[0] == JsonBinaryKey || keys[0] == JsonPairsKey) { return true }
+	for _, key := range keys {
+		if isBinaryString(key) { return true }
+	}
+	return false
+}
+
+func writeJson(buffer *bytes.Buffer, any *Any) error {
+	if any == nil { return ErrUnsupportedType }
+
+	switch any.Type {
+
+		case String:
+
+			return writeJsonBencodedString(buffer, any.AsString)
+
+		case Int:
+
+			buffer.WriteString(strconv.Itoa(any.AsInt))
+			return nil
+
+		case List:
+
+			buffer.WriteByte('[')
+			for i, e := range any.AsList {
+				if i > 0 { buffer.WriteByte(',') }
+				err := writeJson(buffer, e)
+				if err != nil { return err }
+			}
+			buffer.WriteByte(']')
+			return nil
+
+		case Dictionary:
+
+			keys := sortedKeys(any.AsDictionary)
+			if dictionaryNeedsPairs(keys) {
+				buffer.WriteString("{\"" + JsonPairsKey + "\":[")
+				for i, key := range keys {
+					if i > 0 { buffer.WriteByte(',') }
+					buffer.WriteByte('[')
+					err := writeJsonBencodedString(buffer, key)
+					if err != nil { return err }
+					buffer.WriteByte(',')
+					err = writeJson(buffer, any.AsDictionary[key])
+					if err != nil { return err }
+					buffer.WriteByte(']')
+				}
+				buffer.WriteString("]}")
+				return nil
+			}
+
+			buffer.WriteByte('{')
+			for i, key := range keys {
+				if i > 0 { buffer.WriteByte(',') }
+				err := writeJsonString(buffer, key)
+				if err != nil { return err }
+				buffer.WriteByte(':')
+				err = writeJson(buffer, any.AsDictionary[key])
+				if err != nil { return err }
+			}
+			buffer.WriteByte('}')
+			return nil
+	}
+
+	return ErrUnsupportedType
+}
+
+// ToJson converts a bencoded value to JSON. The output is deterministic,
+// dictionary keys being sorted.
+func ToJson(any *Any) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := writeJson(&buffer, any)
+	if err != nil { return nil, err }
+	return buffer.Bytes(), nil
+}
+
+func fromJsonString(value interface{}) (string, error) {
+	switch v := value.(type) {
+
+		case string:
+
+			return v, nil
+
+		case map[string]interface{}:
+
+			encoded, ok := v[JsonBinaryKey].(string)
+			if !ok || len(v) != 1 { return "", ErrInvalidFormat }
+			decoded, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil { return "", err }
+			return string(decoded), nil
+	}
+
+	return "", ErrInvalidFormat
+}
+
+func fromJsonValue(value interface{}) (*Any, error) {
+	switch v := value.(type) {
+
+		case string:
+
+			return newAnyString(v), nil
+
+		case json.Number:
+
+			i, err := strconv.Atoi(string(v))
+			if err != nil { return nil, ErrUnsupportedType }
+			return newAnyInt(i), nil
+
+		case []interface{}:
+
+			output := make([]*Any, 0, len(v))
+			for _, e := range v {
+				item, err := fromJsonValue(e)
+				if err != nil { return nil, err }
+				output = append(output, item)
+			}
+			return newAnyList(output), nil
+
+		case map[string]interface{}:
+
+			if len(v) == 1 {
+				if _, ok := v[JsonBinaryKey]; ok {
+					s, err := fromJsonString(v)
+					if err != nil { return nil, err }
+					return newAnyString(s), nil
+				}
+
+				if pairs, ok := v[JsonPairsKey]; ok {
+					list, ok := pairs.([]interface{})
+					if !ok { return nil, ErrInvalidFormat }
+					output := make(map[string]*Any)
+					for _, e := range list {
+						pair, ok := e.([]interface{})
+						if !ok || len(pair) != 2 { return nil, ErrInvalidFormat }
+						key, err := fromJsonString(pair[0])
+						if err != nil { return nil, err }
+						item, err := fromJsonValue(pair[1])
+						if err != nil { return nil, err }
+						output[key] = item
+					}
+					return newAnyDictionary(output), nil
+				}
+			}
+
+			output := make(map[string]*Any)
+			for key, e := range v {
+				item, err := fromJsonValue(e)
+				if err != nil { return nil, err }
+				output[key] = item
+			}
+			return newAnyDictionary(output), nil
+	}
+
+	// Booleans, null and floating point numbers have no bencoded equivalent.
+	return nil, ErrUnsupportedType
+}
+
+// FromJson converts JSON produced by ToJson, or any JSON document made of
+// strings, integers, arrays and objects, back to a bencoded value.
+func FromJson(data []byte) (*Any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err != nil { return nil, err }
+	if decoder.More() { return nil, ErrInvalidFormat }
+	return fromJsonValue(value)
+}
@@ -0,0 +1,176 @@
+package bencoding
+
+import (
+	"errors"
+	"strconv"
+)
+
+var ErrKeyNotFound = errors.New("key not found")
+var ErrIndexOutOfBound = errors.New("index out of bound")
+var ErrInvalidPath = errors.New("invalid path")
+
+// PathError records the path at which a query failed.
+type PathError struct {
+	Path string
+	Err error
+}
+
+func (this *PathError) Error() string {
+	if this.Path == "" { return this.Err.Error() }
+	return this.Path + ": " + this.Err.Error()
+}
+
+func (this *PathError) Unwrap() error {
+	return this.Err
+}
+
+func NewString(s string) *Any {
+	return newAnyString(s)
+}
+
+func NewInt(i int) *Any {
+	return newAnyInt(i)
+}
+
+func NewList(l []*Any) *Any {
+	return newAnyList(l)
+}
+
+func NewDictionary(d map[string]*Any) *Any {
+	return newAnyDictionary(d)
+}
+
+// formatPath converts a path such as ("info", "files", 0) to a
+// human-readable string such as "info.files[0]".
+func formatPath(path []interface{}) string {
+	output := ""
+	for _, e := range path {
+		switch v := e.(type) {
+			case string:
+				if output != "" { output += "." }
+				output += v
+			case int:
+				output += "[" + strconv.Itoa(v) + "]"
+			default:
+				output += "[?]"
+		}
+	}
+	return output
+}
+
+func (this *Any) child(key interface{}) (*Any, error) {
+	switch k := key.(type) {
+
+		case string:
+
+			if this.Type != Dictionary { return nil, ErrUnexpectedType }
+			output, ok := this.AsDictionary[k]
+			if !ok || output == nil { return nil, ErrKeyNotFound }
+			return output, nil
+
+		case int:
+
+			if this.Type != List { return nil, ErrUnexpectedType }
+			if k < 0 || k >= len(this.AsList) { return nil, ErrIndexOutOfBound }
+			output := this.AsList[k]
+			if output == nil { return nil, ErrKeyNotFound }
+			return output, nil
+	}
+
+	return nil, ErrInvalidPath
+}
+
+// Query follows the given path, made of dictionary keys (strings) and list
+// indexes (ints), and returns the value found at the end of it. If the path
+// cannot be followed, the returned *PathError tells where and why.
+func (this *Any) Query(path ...interface{}) (*Any, error) {
+	if this == nil { return nil, &PathError{ "", ErrKeyNotFound } }
+	output := this
+	for i, key := range path {
+		var err error
+		output, err = output.child(key)
+		if err != nil { return nil, &PathError{ formatPath(path[:i + 1]), err } }
+	}
+	return output, nil
+}
+
+// Get is like Query but only reports whether the value exists. For example
+// metaInfo.Get("info", "files", 0, "length").
+func (this *Any) Get(path ...interface{}) (*Any, bool) {
+	output, err := this.Query(path...)
+	return output, err == nil
+}
+
+func (this *Any) queryType(expectedType int, path []interface{}) (*Any, error) {
+	output, err := this.Query(path...)
+	if err != nil { return nil, err }
+	if output.Type != expectedType { return nil, &PathError{ formatPath(path), ErrUnexpectedType } }
+	return output, nil
+}
+
+func (this *Any) GetString(path ...interface{}) (string, error) {
+	output, err := this.queryType(String, path)
+	if err != nil { return "", err }
+	return output.AsString, nil
+}
+
+func (this *Any) GetInt(path ...interface{}) (int, error) {
+	output, err := this.queryType(Int, path)
+	if err != nil { return 0, err }
+	return output.AsInt, nil
+}
+
+func (this *Any) GetList(path ...interface{}) ([]*Any, error) {
+	output, err := this.queryType(List, path)
+	if err != nil { return nil, err }
+	return output.AsList, nil
+}
+
+func (this *Any) GetDictionary(path ...interface{}) (map[string]*Any, error) {
+	output, err := this.queryType(Dictionary, path)
+	if err != nil { return nil, err }
+	return output.AsDictionary, nil
+}
+
+// Set stores value at the given path. Missing dictionaries along the path are
+// created. The last element of the path may be a list index equal to the
+// length of the list, in which case the value is appended.
+func (this *Any) Set(value *Any, path ...interface{}) error {
+	if this == nil || len(path) == 0 || value == nil { return &PathError{ "", ErrInvalidPath } }
+
+	parent := this
+	for i, key := range path[:len(path) - 1] {
+		next, err := parent.child(key)
+		if err == ErrKeyNotFound && parent.Type == Dictionary {
+			if parent.AsDictionary == nil { parent.AsDictionary = make(map[string]*Any) }
+			next = newAnyDictionary(make(map[string]*Any))
+			parent.AsDictionary[key.(string)] = next
+		} else if err != nil {
+			return &PathError{ formatPath(path[:i + 1]), err }
+		}
+		parent = next
+	}
+
+	switch k := path[len(path) - 1].(type) {
+
+		case string:
+
+			if parent.Type != Dictionary { return &PathError{ formatPath(path), ErrUnexpectedType } }
+			if parent.AsDictionary == nil { parent.AsDictionary = make(map[string]*Any) }
+			parent.AsDictionary[k] = value
+			return nil
+
+		case int:
+
+			if parent.Type != List { return &PathError{ formatPath(path), ErrUnexpectedType } }
+			if k < 0 || k > len(parent.AsList) { return &PathError{ formatPath(path), ErrIndexOutOfBound } }
+			if k == len(parent.AsList) {
+				parent.AsList = append(parent.AsList, value)
+			} else {
+				parent.AsList[k] = value
+			}
+			return nil
+	}
+
+	return &PathError{ formatPath(path), ErrInvalidPath }
+}
@@ -1,54 +1,183 @@
 package torrent
 
 import (
+	"context"
+	cryptorand "crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"math/rand"
+	"net"
 	"strconv"
+	"sync"
+	"time"
 	"torrent/bencoding"	
+	"torrent/utp"
 )
 
+// Client is a session: it holds the identity of the local peer and manages
+// the torrents added with AddTorrent.
 type Client struct {
+	config ClientConfig
+	random io.Reader
+	identityMutex sync.Mutex
 	peerId string
 	port int
+	key string
+	externalIPv4 net.IP
+	externalIPv6 net.IP
+	externalAddressesSet bool
+	stats clientStats
+
+	mutex sync.Mutex
+	limits *SessionLimits
+	torrents map[string]*managedTorrent // By info hash, in hex
+	torrentOrder []string
+	connectionCount int
+	downloadLimiter rateLimiter
+	uploadLimiter rateLimiter
+	listener net.Listener
+	utpSocket *utp.Socket
+	encryptionPolicy EncryptionPolicy
+	background sync.WaitGroup
+	closed bool
+	ctx context.Context // Cancelled by Close
+	cancel context.CancelFunc
+
+	seedingPolicy *SeedingPolicy
+	policyInterval time.Duration
+	policyLoopStarted bool
 }
 
+// NewClient creates a client with the default configuration.
 func NewClient() *Client {
-	output := new(Client)
+	output, _ := NewClientWithConfig(NewClientConfig())
 	return output
 }
 
+// NewClientWithConfig creates a client with the given configuration, which
+// is copied. It fails if the configuration is invalid.
+func NewClientWithConfig(config *ClientConfig) (*Client, error) {
+	err := config.Validate()
+	if err != nil { return nil, err }
+	output := new(Client)
+	output.config = *config
+	output.random = cryptorand.Reader
+	if config.RandomSource != nil { output.random = &lockedRand{ random: rand.New(config.RandomSource) } }
+	limits := config.Limits
+	output.limits = &limits
+	output.downloadLimiter.setRate(limits.DownloadRateLimit)
+	output.uploadLimiter.setRate(limits.UploadRateLimit)
+	output.torrents = make(map[string]*managedTorrent)
+	output.ctx, output.cancel = context.WithCancel(context.Background())
+	output.policyInterval = defaultPolicyInterval
+	output.encryptionPolicy = config.EncryptionPolicy
+	return output, nil
+}
+
 func (this *Client) PeerId() string {
+	this.identityMutex.Lock()
+	defer this.identityMutex.Unlock()
 	if this.peerId != "" {
 		return this.peerId
 	}
-	this.peerId = GeneratePeerId()
+	this.peerId = generatePeerId(this.random, this.config.PeerIdPrefix)
 	return this.peerId
 }
 
+// trackerKey returns the "key" announced to trackers, which identifies the
+// client if its IP address changes.
+func (this *Client) trackerKey() string {
+	this.identityMutex.Lock()
+	defer this.identityMutex.Unlock()
+	if this.key == "" { this.key = randomString(this.random, trackerKeyLength) }
+	return this.key
+}
+
 func (this *Client) Port() int {
+	this.identityMutex.Lock()
+	defer this.identityMutex.Unlock()
 	if this.port == 0 {
-		this.port = RandomPort()
+		this.port = this.config.randomPort(this.random)
 	}
 	return this.port
 }
 
+// SetExternalAddresses sets the addresses announced to trackers in the
+// "ipv4" and "ipv6" parameters (BEP 7), so that peers of both address
+// families can reach us whichever one the announce goes over. Either may be
+// nil. By default, they are the public addresses of the network interfaces.
+func (this *Client) SetExternalAddresses(ipv4 net.IP, ipv6 net.IP) {
+	this.identityMutex.Lock()
+	defer this.identityMutex.Unlock()
+	this.externalIPv4 = ipv4.To4()
+	this.externalIPv6 = ipv6
+	this.externalAddressesSet = true
+}
+
+func (this *Client) ExternalAddresses() (net.IP, net.IP) {
+	this.identityMutex.Lock()
+	defer this.identityMutex.Unlock()
+	if !this.externalAddressesSet {
+		this.externalIPv4, this.externalIPv6 = interfaceAddresses()
+		this.externalAddressesSet = true
+	}
+	return this.externalIPv4, this.externalIPv6
+}
+
+// interfaceAddresses returns the first public IPv4 and IPv6 addresses of the
+// network interfaces.
+func interfaceAddresses() (net.IP, net.IP) {
+	var ipv4 net.IP
+	var ipv6 net.IP
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() || ipNet.IP.IsPrivate() { continue }
+		if ipNet.IP.To4() != nil {
+			if ipv4 == nil { ipv4 = ipNet.IP.To4() }
+		} else if ipv6 == nil {
+			ipv6 = ipNet.IP
+		}
+	}
+	return ipv4, ipv6
+}
+
 func infoHash(metaInfo *bencoding.Any) []byte {
-	hasher := sha1.New()
-	encodedMetaInfo, _ := bencoding.Encode(metaInfo.AsDictionary["info"])
-	hasher.Write(encodedMetaInfo)
+	return hashInfo(metaInfo, sha1.New())
+}
+
+func infoHashV2(metaInfo *bencoding.Any) []byte {
+	return hashInfo(metaInfo, sha256.New())
+}
+
+func hashInfo(metaInfo *bencoding.Any, hasher hash.Hash) []byte {
+	info, ok := metaInfo.Get("info")
+	if !ok { return nil }
+	err := bencoding.NewEncoder(hasher).Encode(info)
+	if err != nil { return nil }
 	return hasher.Sum(nil)
 }
 
 func (this *Client) NewTrackerQuery(torr *Torrent, event string) TrackerQuery {	
 	output := make(TrackerQuery)
 	
-	output["info_hash"] = string(infoHash(torr.MetaInfo()))
+	output["info_hash"] = string(torr.InfoHash())
 	output["peer_id"] = this.PeerId()
 	output["port"] = strconv.Itoa(this.Port())
 	output["downloaded"] = strconv.Itoa(torr.DownloadedSize())
 	output["uploaded"] = strconv.Itoa(torr.UploadedSize())
 	output["left"] = strconv.Itoa(torr.LeftSize())
 	output["compact"] = "1"
-	output["numwant"] = "50"
+	output["numwant"] = strconv.Itoa(this.config.NumWant)
+	output["key"] = this.trackerKey()
+	if this.config.AnnounceIp != "" { output["ip"] = this.config.AnnounceIp }
+	if this.config.NoPeerId { output["no_peer_id"] = "1" }
+	if this.EncryptionPolicy() != EncryptionDisabled { output["supportcrypto"] = "1" }
+	ipv4, ipv6 := this.ExternalAddresses()
+	if ipv4 != nil { output["ipv4"] = ipv4.String() }
+	if ipv6 != nil { output["ipv6"] = ipv6.String() }
 	if event != "" {
 		output["event"] = event
 	}
@@ -0,0 +1,373 @@
+// Command gotorrent is a command-line BitTorrent client.
+//
+// Usage:
+//
+//	gotorrent download [-dir DIR] [-files 0,2,...] [-seed] [-strict-paths] [-encryption POLICY] <torrent|url>
+//	gotorrent info [-json] <torrent|url>
+//	gotorrent create [-o FILE] [-announce URL,...] [-piece-length N] [-private] [-comment TEXT] [-webseed URL,...] [-httpseed URL,...] [-version v1|v2|hybrid] <path>
+//	gotorrent verify [-dir DIR] <torrent|url>
+//	gotorrent seed [-dir DIR] [-port N] [-encryption POLICY] <torrent|url>
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+	"torrent"
+	"torrent/bencoding"
+)
+
+var errUsage = errors.New("invalid usage")
+
+type command struct {
+	name string
+	usage string
+	run func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{ "download", "download [-dir DIR] [-files 0,2,...] [-seed] [-strict-paths] [-encryption POLICY] <torrent|url>", runDownload },
+		{ "info", "info [-json] <torrent|url>", runInfo },
+		{ "create", "create [-o FILE] [-announce URL,...] [-piece-length N] [-private] [-comment TEXT] [-webseed URL,...] [-httpseed URL,...] [-version v1|v2|hybrid] <path>", runCreate },
+		{ "verify", "verify [-dir DIR] <torrent|url>", runVerify },
+		{ "seed", "seed [-dir DIR] [-port N] [-encryption POLICY] <torrent|url>", runSeed },
+	}
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	for _, c := range commands {
+		fmt.Fprintln(os.Stderr, "  gotorrent " + c.usage)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(2)
+	}
+
+	for _, c := range commands {
+		if c.name != os.Args[1] { continue }
+		err := c.run(os.Args[2:])
+		if err == errUsage {
+			fmt.Fprintln(os.Stderr, "Usage: gotorrent " + c.usage)
+			os.Exit(2)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command: %s\n", os.Args[1])
+	printUsage()
+	os.Exit(2)
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	output := flag.NewFlagSet(name, flag.ContinueOnError)
+	output.SetOutput(ioutil.Discard)
+	return output
+}
+
+// parseFlags parses the flags of a command, which must be followed by
+// exactly one positional argument.
+func parseFlags(flags *flag.FlagSet, args []string) (string, error) {
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() != 1 { return "", errUsage }
+	return flags.Arg(0), nil
+}
+
+// loadTorrent loads a torrent from a local .torrent file or from an HTTP URL.
+func loadTorrent(client *torrent.Client, source string) (*torrent.Torrent, error) {
+	if strings.HasPrefix(source, "magnet:") {
+		return nil, errors.New("magnet links are not supported yet, please use a .torrent file or URL")
+	}
+
+	torr := client.NewTorrent(source)
+
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		err := torr.FetchMetaInfo()
+		if err != nil { return nil, fmt.Errorf("cannot fetch torrent %s: %s", source, err) }
+		return torr, nil
+	}
+
+	data, err := ioutil.ReadFile(source)
+	if err != nil { return nil, err }
+	err = torr.LoadMetaInfo(data)
+	if err != nil { return nil, fmt.Errorf("cannot parse torrent file %s: %s", source, err) }
+	return torr, nil
+}
+
+func progressBar(done int, total int, width int) string {
+	filled := width
+	if total > 0 { filled = done * width / total }
+	return "[" + strings.Repeat("#", filled) + strings.Repeat(".", width - filled) + "]"
+}
+
+func runInfo(args []string) error {
+	flags := newFlagSet("info")
+	asJson := flags.Bool("json", false, "")
+	source, err := parseFlags(flags, args)
+	if err != nil { return err }
+
+	torr, err := loadTorrent(torrent.NewClient(), source)
+	if err != nil { return err }
+
+	report := torr.Report()
+	if !*asJson {
+		fmt.Print(report.String())
+		return nil
+	}
+
+	output, err := json.MarshalIndent(report, "", "  ")
+	if err != nil { return err }
+	fmt.Println(string(output))
+	return nil
+}
+
+// newClient returns a client with the encryption policy named by the
+// -encryption flag. If port is not zero, it is the port of the client, which
+// is announced to trackers.
+func newClient(encryption string, port int) (*torrent.Client, error) {
+	config := torrent.NewClientConfig()
+	if port != 0 {
+		config.PortMin = port
+		config.PortMax = port
+	}
+	for _, policy := range []torrent.EncryptionPolicy{ torrent.EncryptionDisabled, torrent.EncryptionPrefer, torrent.EncryptionRequire } {
+		if policy.String() == encryption {
+			config.EncryptionPolicy = policy
+			return torrent.NewClientWithConfig(config)
+		}
+	}
+	return nil, errors.New("unknown encryption policy: " + encryption)
+}
+
+func parseTorrentVersion(version string) (torrent.TorrentVersion, error) {
+	for _, v := range []torrent.TorrentVersion{ torrent.TorrentV1, torrent.TorrentV2, torrent.TorrentHybrid } {
+		if v.String() == version { return v, nil }
+	}
+	return torrent.TorrentV1, errors.New("unknown torrent version: " + version)
+}
+
+func parseFileSelection(selection string, fileCount int) ([]int, error) {
+	var output []int
+	for _, s := range strings.Split(selection, ",") {
+		index, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || index < 0 || index >= fileCount { return nil, fmt.Errorf("invalid file index: %s", s) }
+		output = append(output, index)
+	}
+	return output, nil
+}
+
+func verifyStorage(torr *torrent.Torrent, storage *torrent.FileStorage) (torrent.Bitfield, error) {
+	count := torr.PieceCount()
+	return torr.Verify(storage, func(index int, valid bool) {
+		if index % 64 == 0 || index == count - 1 {
+			fmt.Fprintf(os.Stderr, "\rChecking %s %d/%d", progressBar(index + 1, count, 30), index + 1, count)
+		}
+	})
+}
+
+func runDownload(args []string) error {
+	flags := newFlagSet("download")
+	dir := flags.String("dir", ".", "")
+	files := flags.String("files", "", "")
+	seed := flags.Bool("seed", false, "")
+	strictPaths := flags.Bool("strict-paths", false, "")
+	encryption := flags.String("encryption", "prefer", "")
+	source, err := parseFlags(flags, args)
+	if err != nil { return err }
+
+	client, err := newClient(*encryption, 0)
+	if err != nil { return err }
+	torr, err := loadTorrent(client, source)
+	if err != nil { return err }
+
+	if *files != "" {
+		selection, err := parseFileSelection(*files, torr.FileCount())
+		if err != nil { return err }
+		err = torr.SetSelectedFileIndexes(selection)
+		if err != nil { return err }
+	}
+
+	sanitizer := torrent.NewPathSanitizer()
+	if *strictPaths { sanitizer.Policy = torrent.PathPolicyReject }
+	storage, err := torrent.NewFileStorageWithSanitizer(torr, *dir, sanitizer)
+	if err != nil { return err }
+	defer storage.Close()
+	for _, change := range storage.PathChanges() {
+		fmt.Fprintln(os.Stderr, "warning: unsafe path rewritten, " + change.String())
+	}
+
+	have, err := verifyStorage(torr, storage)
+	if err != nil { return err }
+	fmt.Fprintln(os.Stderr)
+
+	downloader := client.NewDownloader(torr, storage, have)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		downloader.Stop()
+	}()
+
+	events, unsubscribe := torr.SubscribeChannel(16)
+	defer unsubscribe()
+
+	done := make(chan error, 1)
+	go func() { done <- downloader.Run() }()
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+			case err = <-done:
+			case event := <-events:
+				if event.Type == torrent.EventTrackerFailed || event.Type == torrent.EventStorageError {
+					fmt.Fprintf(os.Stderr, "\rwarning: %s: %s\n", event.Type, event.Err)
+				}
+				continue
+			case <-ticker.C:
+				p := downloader.Progress()
+				stats := torr.Stats()
+				eta := "--"
+				if stats.ETA >= 0 { eta = stats.ETA.Round(time.Second).String() }
+				fmt.Fprintf(os.Stderr, "\r%s %5.1f%%  %s / %s  %s/s  ETA %s  %d peers   ", progressBar(p.CompletedBytes, p.WantedBytes, 30), 100 * float64(p.CompletedBytes) / float64(max(p.WantedBytes, 1)), torrent.FormatSize(p.CompletedBytes), torrent.FormatSize(p.WantedBytes), torrent.FormatSize(int(stats.DownloadRate)), eta, p.Peers)
+				continue
+		}
+		break
+	}
+	fmt.Fprintln(os.Stderr)
+
+	if err == torrent.ErrDownloaderStopped { return errors.New("download interrupted") }
+	if err == torrent.ErrNoPeers { return errors.New("no peers available to download from") }
+	if err != nil { return fmt.Errorf("download failed: %s", err) }
+
+	err = storage.CreateFiles()
+	if err != nil { return err }
+	fmt.Fprintln(os.Stderr, "Download complete:", torr.Name())
+
+	if !*seed { return nil }
+	return seedTorrent(client, torr, storage, downloader.Have())
+}
+
+func runCreate(args []string) error {
+	flags := newFlagSet("create")
+	outputPath := flags.String("o", "", "")
+	announce := flags.String("announce", "", "")
+	pieceLength := flags.Int("piece-length", 0, "")
+	private := flags.Bool("private", false, "")
+	comment := flags.String("comment", "", "")
+	webSeeds := flags.String("webseed", "", "")
+	httpSeeds := flags.String("httpseed", "", "")
+	version := flags.String("version", "v1", "")
+	path, err := parseFlags(flags, args)
+	if err != nil { return err }
+
+	options := &torrent.CreateOptions{ PieceLength: *pieceLength, Private: *private, Comment: *comment }
+	options.Version, err = parseTorrentVersion(*version)
+	if err != nil { return err }
+	if *announce != "" {
+		// Each tracker gets its own tier.
+		for _, url := range strings.Split(*announce, ",") {
+			options.Announce = append(options.Announce, []string{ url })
+		}
+	}
+	if *webSeeds != "" { options.WebSeeds = strings.Split(*webSeeds, ",") }
+	if *httpSeeds != "" { options.HttpSeeds = strings.Split(*httpSeeds, ",") }
+
+	metaInfo, err := torrent.CreateMetaInfo(path, options)
+	if err != nil { return err }
+	data, err := bencoding.Encode(metaInfo)
+	if err != nil { return err }
+
+	if *outputPath == "" {
+		name, _ := metaInfo.GetString("info", "name")
+		*outputPath = name + ".torrent"
+	}
+	err = ioutil.WriteFile(*outputPath, data, 0644)
+	if err != nil { return err }
+	fmt.Fprintln(os.Stderr, "Created", *outputPath)
+	return nil
+}
+
+func runVerify(args []string) error {
+	flags := newFlagSet("verify")
+	dir := flags.String("dir", ".", "")
+	source, err := parseFlags(flags, args)
+	if err != nil { return err }
+
+	torr, err := loadTorrent(torrent.NewClient(), source)
+	if err != nil { return err }
+	storage := torrent.NewFileStorage(torr, *dir)
+	defer storage.Close()
+
+	have, err := verifyStorage(torr, storage)
+	if err != nil { return err }
+	fmt.Fprintln(os.Stderr)
+
+	fmt.Printf("%d of %d pieces valid\n", have.Count(), torr.PieceCount())
+	if have.Count() != torr.PieceCount() { return errors.New("some pieces are missing or invalid") }
+	return nil
+}
+
+func runSeed(args []string) error {
+	flags := newFlagSet("seed")
+	dir := flags.String("dir", ".", "")
+	port := flags.Int("port", 0, "")
+	encryption := flags.String("encryption", "prefer", "")
+	source, err := parseFlags(flags, args)
+	if err != nil { return err }
+
+	client, err := newClient(*encryption, *port)
+	if err != nil { return err }
+	torr, err := loadTorrent(client, source)
+	if err != nil { return err }
+	storage := torrent.NewFileStorage(torr, *dir)
+	defer storage.Close()
+
+	have, err := verifyStorage(torr, storage)
+	if err != nil { return err }
+	fmt.Fprintln(os.Stderr)
+	if have.Count() == 0 { return errors.New("no valid data to seed in " + *dir) }
+
+	return seedTorrent(client, torr, storage, have)
+}
+
+// seedTorrent listens on the port of the client, which is the one the seeder
+// announces.
+func seedTorrent(client *torrent.Client, torr *torrent.Torrent, storage *torrent.FileStorage, have torrent.Bitfield) error {
+	port := client.Port()
+	listener, err := net.Listen("tcp", ":" + strconv.Itoa(port))
+	if err != nil { return err }
+
+	seeder := client.NewSeeder(torr, storage, have)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		seeder.Close()
+	}()
+
+	fmt.Fprintf(os.Stderr, "Seeding %s (%d of %d pieces) on port %d, press Ctrl+C to stop\n", torr.Name(), have.Count(), torr.PieceCount(), port)
+	err = seeder.Serve(listener)
+	if err != nil { return fmt.Errorf("seeding failed: %s", err) }
+	return nil
+}
@@ -0,0 +1,108 @@
+package torrent
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+)
+
+var ErrInvalidConfig = errors.New("invalid client configuration")
+
+// ConfigError is returned by ClientConfig.Validate. Err is ErrInvalidConfig.
+type ConfigError struct {
+	Field string
+	Err error
+}
+
+func (this *ConfigError) Error() string {
+	return this.Err.Error() + ": " + this.Field
+}
+
+func (this *ConfigError) Unwrap() error {
+	return this.Err
+}
+
+// ClientConfig holds the settings of a Client. NewClientConfig returns the
+// defaults, which callers adjust before passing it to NewClientWithConfig.
+type ClientConfig struct {
+	ListenHost string // Empty to listen on all interfaces, IPv4 and IPv6
+	PortMin int // The port is picked at random in [PortMin, PortMax]
+	PortMax int
+	PeerIdPrefix string // Completed with random characters up to 20 bytes
+	NumWant int // Number of peers asked to trackers
+	AnnounceIp string // Sent to trackers as "ip", if not empty
+	NoPeerId bool // Tell trackers to omit peer ids in non-compact responses
+	HttpConnectionTimeout time.Duration // Trackers and web seeds
+	HttpReadWriteTimeout time.Duration
+	PeerConnectTimeout time.Duration
+	UserAgent string // Sent to trackers and web seeds, if not empty
+	TLSConfig *tls.Config // For HTTPS trackers and web seeds, Go's default if nil
+	MaxRedirects int // Of HTTP requests
+	Limits SessionLimits
+	StorageRoot string // Download directory of AddTorrent when none is given
+	EncryptionPolicy EncryptionPolicy
+	EnableUtp bool
+	Proxy ProxySettings
+	// Source of the peer id and port, which are then deterministic, for
+	// tests and simulations. If nil, they come from a cryptographic source.
+	RandomSource rand.Source
+}
+
+func NewClientConfig() *ClientConfig {
+	output := new(ClientConfig)
+	output.PortMin = 10000
+	output.PortMax = 64999
+	output.PeerIdPrefix = peerIdPrefix()
+	output.NumWant = 50
+	output.HttpConnectionTimeout = 10 * time.Second
+	output.HttpReadWriteTimeout = 10 * time.Second
+	output.PeerConnectTimeout = 10 * time.Second
+	output.UserAgent = defaultUserAgent()
+	output.MaxRedirects = defaultMaxRedirects
+	output.Limits = *NewSessionLimits()
+	output.StorageRoot = "."
+	output.EncryptionPolicy = EncryptionPrefer
+	output.EnableUtp = true
+	return output
+}
+
+// Validate returns a *ConfigError naming the first invalid field.
+func (this *ClientConfig) Validate() error {
+	invalid := func(field string) error { return &ConfigError{ Field: field, Err: ErrInvalidConfig } }
+	if this.PortMin < 1 || this.PortMin > 65535 { return invalid("PortMin") }
+	if this.PortMax < this.PortMin || this.PortMax > 65535 { return invalid("PortMax") }
+	if len(this.PeerIdPrefix) > peerIdLength { return invalid("PeerIdPrefix") }
+	if this.NumWant < 0 { return invalid("NumWant") }
+	if this.HttpConnectionTimeout <= 0 { return invalid("HttpConnectionTimeout") }
+	if this.HttpReadWriteTimeout <= 0 { return invalid("HttpReadWriteTimeout") }
+	if this.MaxRedirects < 0 { return invalid("MaxRedirects") }
+	if this.PeerConnectTimeout <= 0 { return invalid("PeerConnectTimeout") }
+	if this.Limits.MaxActiveDownloads < 0 { return invalid("Limits.MaxActiveDownloads") }
+	if this.Limits.MaxActiveSeeds < 0 { return invalid("Limits.MaxActiveSeeds") }
+	if this.Limits.MaxConnections < 0 { return invalid("Limits.MaxConnections") }
+	if this.Limits.DownloadRateLimit < 0 { return invalid("Limits.DownloadRateLimit") }
+	if this.Limits.UploadRateLimit < 0 { return invalid("Limits.UploadRateLimit") }
+	if this.StorageRoot == "" { return invalid("StorageRoot") }
+	if this.EncryptionPolicy < EncryptionDisabled || this.EncryptionPolicy > EncryptionRequire { return invalid("EncryptionPolicy") }
+	if (this.Proxy.Trackers || this.Proxy.WebSeeds) && !this.Proxy.validHttpUrl() { return invalid("Proxy.HttpUrl") }
+	if this.Proxy.Peers {
+		_, _, err := net.SplitHostPort(this.Proxy.Socks5Address)
+		if err != nil { return invalid("Proxy.Socks5Address") }
+		if len(this.Proxy.Socks5Username) > 255 { return invalid("Proxy.Socks5Username") }
+		if len(this.Proxy.Socks5Password) > 255 { return invalid("Proxy.Socks5Password") }
+	}
+	return nil
+}
+
+func (this *ClientConfig) randomPort(random io.Reader) int {
+	return this.PortMin + randomInt(random, this.PortMax - this.PortMin + 1)
+}
+
+// Config returns the configuration the client was created with. The session
+// limits and encryption policy may have been changed since.
+func (this *Client) Config() ClientConfig {
+	return this.config
+}
@@ -0,0 +1,573 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	maxPeerConnections = 30
+	maxOutstandingRequests = 8
+	// Peers that don't answer over uTP within this delay are tried over
+	// TCP.
+	utpConnectTimeout = 3 * time.Second
+	trackerRetryInterval = time.Minute
+)
+
+var ErrNoPeers = errors.New("no peers available")
+var ErrDownloaderStopped = errors.New("downloader stopped")
+
+// piecePicker keeps track of which pieces are needed and which ones are
+// being downloaded, and chooses the rarest piece a peer can provide.
+type piecePicker struct {
+	mutex sync.Mutex
+	wanted []bool
+	done Bitfield
+	inProgress []bool
+	availability []int
+	remaining int
+}
+
+func newPiecePicker(wanted []bool, done Bitfield) *piecePicker {
+	output := new(piecePicker)
+	output.wanted = wanted
+	output.done = done
+	output.inProgress = make([]bool, len(wanted))
+	output.availability = make([]int, len(wanted))
+	for i, w := range wanted {
+		if w && !done.Has(i) { output.remaining++ }
+	}
+	return output
+}
+
+func (this *piecePicker) pick(has func(index int) bool) (int, bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	output := -1
+	for i, w := range this.wanted {
+		if !w || this.done.Has(i) || this.inProgress[i] || !has(i) { continue }
+		if output < 0 || this.availability[i] < this.availability[output] { output = i }
+	}
+	if output < 0 { return 0, false }
+	this.inProgress[output] = true
+	return output, true
+}
+
+func (this *piecePicker) release(index int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.inProgress[index] = false
+}
+
+func (this *piecePicker) complete(index int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.inProgress[index] = false
+	if this.done.Has(index) { return }
+	this.done.Set(index)
+	if this.wanted[index] { this.remaining-- }
+}
+
+func (this *piecePicker) isComplete() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.remaining == 0
+}
+
+func (this *piecePicker) updateAvailability(index int, delta int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if index >= 0 && index < len(this.availability) { this.availability[index] += delta }
+}
+
+type DownloadProgress struct {
+	CompletedPieces int
+	WantedPieces int
+	CompletedBytes int
+	WantedBytes int
+	Peers int
+}
+
+// Downloader fetches the selected files of a torrent from the peers
+// returned by its trackers, or added with AddPeers.
+type Downloader struct {
+	client *Client
+	torrent *Torrent
+	storage *FileStorage
+	picker *piecePicker
+
+	mutex sync.Mutex
+	peerQueue []*net.TCPAddr
+	knownPeers map[string]bool
+	connections map[*PeerConn]bool
+	activeWorkers int
+	activeWebSeeds int
+	completedBytes int
+	failure error
+
+	workerDone chan bool
+	completed chan bool // Wakes Run up when the last piece is stored
+	stop chan bool
+	stopOnce sync.Once
+	ctx context.Context // Cancelled by Stop, and when Run returns
+	cancel context.CancelFunc
+	finished chan bool // Closed when Run returns
+	webSeeds sync.WaitGroup
+	webSeedBackoff time.Duration
+}
+
+// NewDownloader creates a downloader for the given torrent. The pieces in
+// `have`, typically the result of Torrent.Verify, are not downloaded again.
+// `have` may be nil.
+func (this *Client) NewDownloader(torr *Torrent, storage *FileStorage, have Bitfield) *Downloader {
+	if have == nil { have = NewBitfield(torr.PieceCount()) }
+	output := new(Downloader)
+	output.client = this
+	output.torrent = torr
+	output.storage = storage
+	output.picker = newPiecePicker(torr.WantedPieces(), have)
+	output.knownPeers = make(map[string]bool)
+	output.connections = make(map[*PeerConn]bool)
+	output.workerDone = make(chan bool, maxPeerConnections)
+	output.stop = make(chan bool)
+	output.ctx, output.cancel = context.WithCancel(context.Background())
+	output.finished = make(chan bool)
+	output.completed = make(chan bool, 1)
+	output.webSeedBackoff = webSeedInitialBackoff
+	torr.setHave(have)
+	for i, w := range output.picker.wanted {
+		if w && have.Has(i) { output.completedBytes += torr.PieceSize(i) }
+	}
+	return output
+}
+
+func (this *Downloader) AddPeers(peers []*net.TCPAddr) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, peer := range peers {
+		address := peerAddress(peer)
+		if this.knownPeers[address] { continue }
+		this.knownPeers[address] = true
+		this.peerQueue = append(this.peerQueue, peer)
+	}
+	this.torrent.setKnownPeers(len(this.knownPeers))
+}
+
+func (this *Downloader) Progress() DownloadProgress {
+	var output DownloadProgress
+	this.picker.mutex.Lock()
+	for i, w := range this.picker.wanted {
+		if !w { continue }
+		output.WantedPieces++
+		output.WantedBytes += this.torrent.PieceSize(i)
+		if this.picker.done.Has(i) { output.CompletedPieces++ }
+	}
+	this.picker.mutex.Unlock()
+
+	this.mutex.Lock()
+	output.CompletedBytes = this.completedBytes
+	output.Peers = len(this.connections)
+	this.mutex.Unlock()
+	return output
+}
+
+// Have returns the pieces that have been downloaded and verified so far.
+func (this *Downloader) Have() Bitfield {
+	this.picker.mutex.Lock()
+	defer this.picker.mutex.Unlock()
+	output := make(Bitfield, len(this.picker.done))
+	copy(output, this.picker.done)
+	return output
+}
+
+// Stop makes Run return ErrDownloaderStopped. The pending network operations
+// are aborted.
+func (this *Downloader) Stop() {
+	this.stopOnce.Do(func() {
+		close(this.stop)
+		this.cancel()
+	})
+}
+
+func (this *Downloader) announce(ctx context.Context, event string) (time.Duration, error) {
+	query := this.client.NewTrackerQuery(this.torrent, event)
+	response, err := this.torrent.CallTrackerContext(ctx, query)
+	if err != nil { return trackerRetryInterval, err }
+	peers, err := TrackerPeers(response)
+	if err == nil { this.AddPeers(peers) }
+	return TrackerInterval(response), nil
+}
+
+func (this *Downloader) startWorkers() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for this.activeWorkers < maxPeerConnections && len(this.peerQueue) > 0 {
+		peer := this.peerQueue[0]
+		this.peerQueue = this.peerQueue[1:]
+		this.activeWorkers++
+		go func() {
+			this.runPeer(peer)
+			this.workerDone <- true
+		}()
+	}
+}
+
+func (this *Downloader) closeConnections() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for conn, _ := range this.connections {
+		conn.Close()
+	}
+}
+
+// Run downloads the wanted pieces, from peers and web seeds, and returns once
+// they have all been verified and written to storage. It returns an error if
+// there are no more peers to try, in which case the tracker error, if any, is
+// returned.
+func (this *Downloader) Run() error {
+	defer this.closeConnections()
+	defer func() {
+		this.cancel()
+		close(this.finished)
+		this.webSeeds.Wait()
+	}()
+	this.startWebSeeds()
+
+	hasTrackers := len(this.torrent.Trackers()) > 0
+	nextAnnounce := time.Now()
+	event := "started"
+	announced := false
+	var trackerErr error
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for !this.picker.isComplete() {
+		if hasTrackers && !time.Now().Before(nextAnnounce) {
+			interval, err := this.announce(this.ctx, event)
+			nextAnnounce = time.Now().Add(interval)
+			trackerErr = err
+			if err == nil {
+				announced = true
+				event = ""
+			}
+			// An announce aborted by Stop may have reached the tracker, which
+			// is then told that we stopped.
+			if err != nil && this.ctx.Err() != nil { announced = true }
+		}
+
+		this.startWorkers()
+
+		this.mutex.Lock()
+		idle := this.activeWorkers == 0 && len(this.peerQueue) == 0 && this.activeWebSeeds == 0
+		this.mutex.Unlock()
+		if idle {
+			if !hasTrackers { return ErrNoPeers }
+			if !announced && trackerErr != nil { return trackerErr }
+		}
+
+		select {
+			case <-this.workerDone:
+				this.mutex.Lock()
+				this.activeWorkers--
+				this.mutex.Unlock()
+			case <-ticker.C:
+			case <-this.completed:
+			case <-this.stop:
+				// The context is cancelled by then.
+				if announced { this.announce(context.Background(), "stopped") }
+				this.mutex.Lock()
+				failure := this.failure
+				this.mutex.Unlock()
+				if failure != nil { return failure }
+				return ErrDownloaderStopped
+		}
+	}
+
+	if announced { this.announce(context.Background(), "completed") }
+	return nil
+}
+
+// RunContext is Run, stopped when the context is cancelled, in which case
+// the error of the context is returned.
+func (this *Downloader) RunContext(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, this.Stop)
+	defer stop()
+	err := this.Run()
+	if err == ErrDownloaderStopped && ctx.Err() != nil { return ctx.Err() }
+	return err
+}
+
+type pieceDownload struct {
+	index int
+	data []byte
+	requested int
+	received int
+	outstanding int
+	rejected bool // The piece is given up once the pending requests are answered
+}
+
+func (this *Downloader) runPeer(peer *net.TCPAddr) {
+	if !this.client.acquireConnection() {
+		// The connection limit of the client is reached, the peer is tried
+		// again later.
+		this.mutex.Lock()
+		this.peerQueue = append(this.peerQueue, peer)
+		this.mutex.Unlock()
+		time.Sleep(time.Second)
+		return
+	}
+	defer this.client.releaseConnection()
+
+	this.torrent.addHalfOpenPeers(1)
+	conn, err := dialPeer(this.ctx, this.client.dial, peerAddress(peer), this.torrent.InfoHash(), this.client.PeerId(), this.client.EncryptionPolicy(), this.client.config.PeerConnectTimeout)
+	this.torrent.addHalfOpenPeers(-1)
+	if err != nil { return }
+
+	this.mutex.Lock()
+	this.connections[conn] = true
+	this.mutex.Unlock()
+	this.torrent.addPeer(conn)
+
+	peerHas := NewBitfield(this.torrent.PieceCount())
+	var current *pieceDownload
+	// Pieces given by the Fast extension (BEP 6).
+	allowedFast := make(map[int]bool)
+	suggested := make(map[int]bool)
+	refused := make(map[int]bool)
+
+	defer func() {
+		if current != nil { this.picker.release(current.index) }
+		for i := 0; i < this.torrent.PieceCount(); i++ {
+			if peerHas.Has(i) { this.picker.updateAvailability(i, -1) }
+		}
+		this.mutex.Lock()
+		delete(this.connections, conn)
+		this.mutex.Unlock()
+		conn.Close()
+		this.torrent.removePeer(conn)
+	}()
+
+	// The downloader doesn't upload, so it has nothing to offer.
+	if conn.SupportsFast() {
+		err = conn.WriteHaveNone()
+		if err != nil { return }
+	}
+	err = conn.WriteMessage(MsgInterested, nil)
+	if err != nil { return }
+
+	choked := true
+	for !this.picker.isComplete() {
+		message, err := conn.ReadMessage()
+		if err != nil { return }
+		if message == nil { continue } // Keep-alive
+
+		switch message.Id {
+
+			case MsgChoke:
+
+				// Pending requests are discarded by the peer when it chokes us,
+				// unless the Fast extension is enabled, in which case it
+				// rejects them.
+				choked = true
+				if current != nil && !conn.SupportsFast() {
+					this.picker.release(current.index)
+					current = nil
+				}
+
+			case MsgUnchoke:
+
+				choked = false
+
+			case MsgHave:
+
+				index, err := message.ParseHave()
+				if err != nil { return }
+				if !peerHas.Has(index) && index < this.torrent.PieceCount() {
+					peerHas.Set(index)
+					this.picker.updateAvailability(index, 1)
+					this.torrent.setPeerPieces(conn, index)
+				}
+
+			case MsgBitfield:
+
+				if len(message.Payload) != len(peerHas) { return }
+				for i := 0; i < this.torrent.PieceCount(); i++ {
+					if Bitfield(message.Payload).Has(i) && !peerHas.Has(i) {
+						peerHas.Set(i)
+						this.picker.updateAvailability(i, 1)
+						this.torrent.setPeerPieces(conn, i)
+					}
+				}
+
+			case MsgHaveAll, MsgHaveNone:
+
+				if !conn.SupportsFast() { return }
+				if message.Id == MsgHaveAll {
+					for i := 0; i < this.torrent.PieceCount(); i++ {
+						if peerHas.Has(i) { continue }
+						peerHas.Set(i)
+						this.picker.updateAvailability(i, 1)
+						this.torrent.setPeerPieces(conn, i)
+					}
+				}
+
+			case MsgSuggestPiece, MsgAllowedFast:
+
+				if !conn.SupportsFast() { return }
+				index, err := message.ParseHave()
+				if err != nil { return }
+				if message.Id == MsgSuggestPiece {
+					suggested[index] = true
+				} else {
+					allowedFast[index] = true
+				}
+
+			case MsgRejectRequest:
+
+				if !conn.SupportsFast() { return }
+				index, _, _, err := message.ParseRequest()
+				if err != nil { return }
+				if current != nil && index == current.index {
+					// If we were allowed to request the piece, the peer
+					// won't serve it at all.
+					if !choked || allowedFast[index] { refused[index] = true }
+					current.rejected = true
+					current.outstanding--
+				}
+
+			case MsgRequest:
+
+				// The downloader doesn't upload, but with the Fast extension
+				// every request gets an answer.
+				if conn.SupportsFast() {
+					index, begin, length, err := message.ParseRequest()
+					if err != nil { return }
+					err = conn.WriteRejectRequest(index, begin, length)
+					if err != nil { return }
+				}
+
+			case MsgPiece:
+
+				index, begin, block, err := message.ParsePiece()
+				if err != nil { return }
+				if current == nil || index != current.index || begin + len(block) > len(current.data) {
+					this.torrent.addWasted(len(block))
+					continue
+				}
+				this.torrent.addDownloaded(len(block))
+				this.client.downloadLimiter.wait(len(block))
+				copy(current.data[begin:], block)
+				current.received += len(block)
+				current.outstanding--
+				if current.received >= len(current.data) {
+					ok := this.completePiece(current, conn.RemoteAddr())
+					current = nil
+					if !ok { return }
+				}
+		}
+
+		if current != nil && current.rejected && current.outstanding <= 0 {
+			this.picker.release(current.index)
+			current = nil
+		}
+
+		if current == nil {
+			// While choked, only the allowed fast pieces may be requested.
+			// Suggested pieces come first.
+			available := func(i int) bool { return peerHas.Has(i) && !refused[i] && (!choked || allowedFast[i]) }
+			index, ok := this.picker.pick(func(i int) bool { return suggested[i] && available(i) })
+			if !ok { index, ok = this.picker.pick(available) }
+			if !ok { continue }
+			current = &pieceDownload{ index: index, data: make([]byte, this.torrent.PieceSize(index)) }
+		}
+		if choked && !allowedFast[current.index] { continue }
+
+		for !current.rejected && current.outstanding < maxOutstandingRequests && current.requested < len(current.data) {
+			length := BlockSize
+			if current.requested + length > len(current.data) { length = len(current.data) - current.requested }
+			err := conn.WriteRequest(current.index, current.requested, length)
+			if err != nil { return }
+			current.requested += length
+			current.outstanding++
+		}
+	}
+}
+
+// completedFiles returns the indexes of the files that the given piece has
+// just completed.
+func (this *Downloader) completedFiles(index int) []int {
+	var output []int
+	have := this.Have()
+	for i, file := range this.torrent.Files() {
+		first, last := this.torrent.piecesForFile(file)
+		if index < first || index > last { continue }
+		complete := true
+		for j := first; j <= last && complete; j++ {
+			complete = have.Has(j)
+		}
+		if complete { output = append(output, i) }
+	}
+	return output
+}
+
+// completePiece verifies and stores a downloaded piece. It returns false if
+// the piece is invalid, in which case the peer should be dropped.
+func (this *Downloader) completePiece(piece *pieceDownload, peer net.Addr) bool {
+	event := newEvent(EventPieceVerified, this.torrent)
+	event.PieceIndex = piece.index
+	event.Peer = peer
+
+	if !this.torrent.CheckPiece(piece.index, piece.data) {
+		this.picker.release(piece.index)
+		this.torrent.addWasted(len(piece.data))
+		event.Type = EventPieceFailed
+		this.torrent.emit(event)
+		return false
+	}
+
+	offset := int64(piece.index) * int64(this.torrent.PieceLength())
+	_, err := this.storage.WriteAt(piece.data, offset)
+	if err != nil {
+		// Storage errors are not the fault of the peer and would happen
+		// again with any other piece, so the download is aborted.
+		this.picker.release(piece.index)
+		this.mutex.Lock()
+		if this.failure == nil { this.failure = err }
+		this.mutex.Unlock()
+		event.Type = EventStorageError
+		event.Err = err
+		this.torrent.emit(event)
+		this.Stop()
+		return false
+	}
+
+	// Completion is checked under the lock so that concurrent pieces don't
+	// report the same file twice.
+	this.mutex.Lock()
+	wasComplete := this.picker.isComplete()
+	this.picker.complete(piece.index)
+	this.torrent.setPieceHave(piece.index)
+	files := this.completedFiles(piece.index)
+	if this.picker.wanted[piece.index] { this.completedBytes += len(piece.data) }
+	complete := !wasComplete && this.picker.isComplete()
+	this.mutex.Unlock()
+
+	this.torrent.emit(event)
+	for _, fileIndex := range files {
+		fileEvent := newEvent(EventFileCompleted, this.torrent)
+		fileEvent.FileIndex = fileIndex
+		this.torrent.emit(fileEvent)
+	}
+
+	if complete {
+		this.torrent.emit(newEvent(EventTorrentCompleted, this.torrent))
+		this.closeConnections()
+		this.completed <- true
+	}
+	return true
+}
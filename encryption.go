@@ -0,0 +1,310 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// Message Stream Encryption, also known as Protocol Encryption: a
+// Diffie-Hellman key exchange followed by RC4 obfuscation of the peer wire
+// protocol. The info hash is the shared key that authenticates the peers.
+
+type EncryptionPolicy int
+
+const (
+	// Connections are plaintext. Encrypted handshakes are rejected.
+	EncryptionDisabled EncryptionPolicy = iota
+	// Outgoing connections are encrypted, and fall back to plaintext if the
+	// peer doesn't support encryption. Incoming connections may be either.
+	EncryptionPrefer
+	// Plaintext connections are rejected.
+	EncryptionRequire
+)
+
+var encryptionPolicyNames = []string{ "disabled", "prefer", "require" }
+
+func (this EncryptionPolicy) String() string {
+	if this < 0 || int(this) >= len(encryptionPolicyNames) { return "unknown policy" }
+	return encryptionPolicyNames[this]
+}
+
+const (
+	cryptoPlaintext = 0x01
+	cryptoRC4 = 0x02
+
+	mseKeyLength = 96
+	mseMaxPadLength = 512
+	// Bytes of RC4 keystream discarded, as the beginning leaks the key.
+	mseDiscardLength = 1024
+)
+
+var msePrime, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+var mseGenerator = big.NewInt(2)
+
+// Verification constant, sent encrypted so that the other side can check
+// the keys and find the end of the padding.
+var mseVC = make([]byte, 8)
+
+var ErrInvalidEncryptionHandshake = errors.New("invalid encryption handshake")
+var ErrEncryptionRequired = errors.New("encryption required")
+var ErrNoCryptoMethod = errors.New("no common crypto method")
+
+// SetEncryptionPolicy sets the policy of the connections made and accepted
+// from now on.
+func (this *Client) SetEncryptionPolicy(policy EncryptionPolicy) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.encryptionPolicy = policy
+}
+
+func (this *Client) EncryptionPolicy() EncryptionPolicy {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.encryptionPolicy
+}
+
+func mseHash(parts ...[]byte) []byte {
+	hasher := sha1.New()
+	for _, part := range parts {
+		hasher.Write(part)
+	}
+	return hasher.Sum(nil)
+}
+
+func mseCipher(key []byte) *rc4.Cipher {
+	output, _ := rc4.NewCipher(key)
+	discard := make([]byte, mseDiscardLength)
+	output.XORKeyStream(discard, discard)
+	return output
+}
+
+// mseKeyPair returns a 160-bit private key and the matching public key.
+func mseKeyPair() (*big.Int, []byte, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil { return nil, nil, err }
+	private := new(big.Int).SetBytes(secret)
+	public := new(big.Int).Exp(mseGenerator, private, msePrime)
+	return private, public.FillBytes(make([]byte, mseKeyLength)), nil
+}
+
+// mseSharedSecret returns the secret S computed from the public key of the
+// remote peer.
+func mseSharedSecret(private *big.Int, remotePublic []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(remotePublic)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(new(big.Int).Sub(msePrime, big.NewInt(1))) >= 0 { return nil, ErrInvalidEncryptionHandshake }
+	secret := new(big.Int).Exp(y, private, msePrime)
+	return secret.FillBytes(make([]byte, mseKeyLength)), nil
+}
+
+func msePad() ([]byte, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(mseMaxPadLength + 1))
+	if err != nil { return nil, err }
+	output := make([]byte, n.Int64())
+	_, err = rand.Read(output)
+	return output, err
+}
+
+func xorBytes(a []byte, b []byte) []byte {
+	output := make([]byte, len(a))
+	for i := range a {
+		output[i] = a[i] ^ b[i]
+	}
+	return output
+}
+
+// mseSynchronize reads until the given pattern, which follows at most
+// mseMaxPadLength bytes of padding.
+func mseSynchronize(reader *bufio.Reader, pattern []byte) error {
+	window := make([]byte, 0, mseMaxPadLength + len(pattern))
+	for len(window) < cap(window) {
+		b, err := reader.ReadByte()
+		if err != nil { return err }
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) { return nil }
+	}
+	return ErrInvalidEncryptionHandshake
+}
+
+func mseRead(reader io.Reader, cipher *rc4.Cipher, length int) ([]byte, error) {
+	output := make([]byte, length)
+	_, err := io.ReadFull(reader, output)
+	if err != nil { return nil, err }
+	cipher.XORKeyStream(output, output)
+	return output, nil
+}
+
+// encryptedConn is a connection after the encryption handshake. Its ciphers
+// are nil if the peers have selected plaintext.
+type encryptedConn struct {
+	net.Conn
+	reader io.Reader
+	pending []byte // Initial payload, already decrypted
+	readMutex sync.Mutex
+	writeMutex sync.Mutex
+	decrypt *rc4.Cipher
+	encrypt *rc4.Cipher
+}
+
+func (this *encryptedConn) Read(b []byte) (int, error) {
+	this.readMutex.Lock()
+	defer this.readMutex.Unlock()
+	if len(this.pending) > 0 {
+		n := copy(b, this.pending)
+		this.pending = this.pending[n:]
+		return n, nil
+	}
+	n, err := this.reader.Read(b)
+	if this.decrypt != nil { this.decrypt.XORKeyStream(b[:n], b[:n]) }
+	return n, err
+}
+
+func (this *encryptedConn) Write(b []byte) (int, error) {
+	this.writeMutex.Lock()
+	defer this.writeMutex.Unlock()
+	if this.encrypt == nil { return this.Conn.Write(b) }
+	buffer := make([]byte, len(b))
+	this.encrypt.XORKeyStream(buffer, b)
+	return this.Conn.Write(buffer)
+}
+
+func (this *encryptedConn) isEncrypted() bool {
+	return this.encrypt != nil
+}
+
+// mseInitiate performs the encryption handshake of an outgoing connection,
+// offering the given crypto methods.
+func mseInitiate(conn net.Conn, infoHash []byte, provide uint32) (*encryptedConn, error) {
+	private, public, err := mseKeyPair()
+	if err != nil { return nil, err }
+	pad, err := msePad()
+	if err != nil { return nil, err }
+	_, err = conn.Write(append(public, pad...))
+	if err != nil { return nil, err }
+
+	reader := bufio.NewReader(conn)
+	remotePublic := make([]byte, mseKeyLength)
+	_, err = io.ReadFull(reader, remotePublic)
+	if err != nil { return nil, err }
+	secret, err := mseSharedSecret(private, remotePublic)
+	if err != nil { return nil, err }
+	encrypt := mseCipher(mseHash([]byte("keyA"), secret, infoHash))
+	decrypt := mseCipher(mseHash([]byte("keyB"), secret, infoHash))
+
+	pad, err = msePad()
+	if err != nil { return nil, err }
+	message := make([]byte, 0, 8 + 4 + 2 + len(pad) + 2)
+	message = append(message, mseVC...)
+	message = binary.BigEndian.AppendUint32(message, provide)
+	message = binary.BigEndian.AppendUint16(message, uint16(len(pad)))
+	message = append(message, pad...)
+	message = binary.BigEndian.AppendUint16(message, 0) // No initial payload
+	encrypt.XORKeyStream(message, message)
+	header := append(mseHash([]byte("req1"), secret), xorBytes(mseHash([]byte("req2"), infoHash), mseHash([]byte("req3"), secret))...)
+	_, err = conn.Write(append(header, message...))
+	if err != nil { return nil, err }
+
+	vc := make([]byte, len(mseVC))
+	decrypt.XORKeyStream(vc, mseVC)
+	err = mseSynchronize(reader, vc)
+	if err != nil { return nil, err }
+	buffer, err := mseRead(reader, decrypt, 4 + 2)
+	if err != nil { return nil, err }
+	selected := binary.BigEndian.Uint32(buffer)
+	padLength := int(binary.BigEndian.Uint16(buffer[4:]))
+	if (selected != cryptoRC4 && selected != cryptoPlaintext) || selected & provide == 0 || padLength > mseMaxPadLength { return nil, ErrInvalidEncryptionHandshake }
+	_, err = mseRead(reader, decrypt, padLength)
+	if err != nil { return nil, err }
+
+	output := &encryptedConn{ Conn: conn, reader: reader }
+	if selected == cryptoRC4 {
+		output.encrypt = encrypt
+		output.decrypt = decrypt
+	}
+	return output, nil
+}
+
+// mseRespond performs the encryption handshake of an incoming connection,
+// for one of the given torrents. It returns the info hash of the torrent.
+func mseRespond(conn net.Conn, reader *bufio.Reader, infoHashes [][]byte, policy EncryptionPolicy) (*encryptedConn, []byte, error) {
+	remotePublic := make([]byte, mseKeyLength)
+	_, err := io.ReadFull(reader, remotePublic)
+	if err != nil { return nil, nil, err }
+	private, public, err := mseKeyPair()
+	if err != nil { return nil, nil, err }
+	secret, err := mseSharedSecret(private, remotePublic)
+	if err != nil { return nil, nil, err }
+	pad, err := msePad()
+	if err != nil { return nil, nil, err }
+	_, err = conn.Write(append(public, pad...))
+	if err != nil { return nil, nil, err }
+
+	err = mseSynchronize(reader, mseHash([]byte("req1"), secret))
+	if err != nil { return nil, nil, err }
+	buffer := make([]byte, sha1.Size)
+	_, err = io.ReadFull(reader, buffer)
+	if err != nil { return nil, nil, err }
+	torrentHash := xorBytes(buffer, mseHash([]byte("req3"), secret))
+	var infoHash []byte
+	for _, h := range infoHashes {
+		if bytes.Equal(mseHash([]byte("req2"), h), torrentHash) { infoHash = h; break }
+	}
+	if infoHash == nil { return nil, nil, ErrInfoHashMismatch }
+	decrypt := mseCipher(mseHash([]byte("keyA"), secret, infoHash))
+	encrypt := mseCipher(mseHash([]byte("keyB"), secret, infoHash))
+
+	buffer, err = mseRead(reader, decrypt, 8 + 4 + 2)
+	if err != nil { return nil, nil, err }
+	if !bytes.Equal(buffer[:8], mseVC) { return nil, nil, ErrInvalidEncryptionHandshake }
+	provide := binary.BigEndian.Uint32(buffer[8:])
+	padLength := int(binary.BigEndian.Uint16(buffer[12:]))
+	if padLength > mseMaxPadLength { return nil, nil, ErrInvalidEncryptionHandshake }
+	buffer, err = mseRead(reader, decrypt, padLength + 2)
+	if err != nil { return nil, nil, err }
+	initialPayload, err := mseRead(reader, decrypt, int(binary.BigEndian.Uint16(buffer[padLength:])))
+	if err != nil { return nil, nil, err }
+
+	var selected uint32
+	if provide & cryptoRC4 != 0 {
+		selected = cryptoRC4
+	} else if provide & cryptoPlaintext != 0 && policy != EncryptionRequire {
+		selected = cryptoPlaintext
+	} else {
+		return nil, nil, ErrNoCryptoMethod
+	}
+
+	pad, err = msePad()
+	if err != nil { return nil, nil, err }
+	message := make([]byte, 0, 8 + 4 + 2 + len(pad))
+	message = append(message, mseVC...)
+	message = binary.BigEndian.AppendUint32(message, selected)
+	message = binary.BigEndian.AppendUint16(message, uint16(len(pad)))
+	message = append(message, pad...)
+	encrypt.XORKeyStream(message, message)
+	_, err = conn.Write(message)
+	if err != nil { return nil, nil, err }
+
+	output := &encryptedConn{ Conn: conn, reader: reader, pending: initialPayload }
+	if selected == cryptoRC4 {
+		output.encrypt = encrypt
+		output.decrypt = decrypt
+	}
+	return output, infoHash, nil
+}
+
+// isPlaintextHandshake tells whether an incoming connection starts with the
+// handshake of the peer wire protocol rather than an encryption handshake.
+func isPlaintextHandshake(reader *bufio.Reader) (bool, error) {
+	buffer, err := reader.Peek(1 + len(protocolName))
+	if err != nil { return false, err }
+	return int(buffer[0]) == len(protocolName) && string(buffer[1:]) == protocolName, nil
+}
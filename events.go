@@ -0,0 +1,138 @@
+package torrent
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+type EventType int
+
+const (
+	EventMetaInfoReceived EventType = iota
+	EventTrackerAnnounced
+	EventTrackerFailed
+	EventPeerConnected
+	EventPeerDisconnected
+	EventPieceVerified
+	EventPieceFailed
+	EventFileCompleted
+	EventTorrentCompleted
+	EventStorageError
+	EventSeedingGoalReached
+)
+
+var eventTypeNames = []string{
+	"metainfo received",
+	"tracker announced",
+	"tracker failed",
+	"peer connected",
+	"peer disconnected",
+	"piece verified",
+	"piece failed",
+	"file completed",
+	"torrent completed",
+	"storage error",
+	"seeding goal reached",
+}
+
+func (this EventType) String() string {
+	if this < 0 || int(this) >= len(eventTypeNames) { return "unknown event" }
+	return eventTypeNames[this]
+}
+
+// Event is something that happened to a torrent. Only the fields relevant to
+// the event type are set.
+type Event struct {
+	Type EventType
+	Time time.Time
+	Torrent *Torrent
+	TrackerUrl string // Tracker events
+	Peer net.Addr // Peer events, and piece events of downloaded pieces
+	PieceIndex int // Piece events, -1 otherwise
+	FileIndex int // EventFileCompleted, -1 otherwise
+	Err error // EventTrackerFailed and EventStorageError
+	Goal SeedingGoal // EventSeedingGoalReached
+}
+
+func newEvent(eventType EventType, torr *Torrent) *Event {
+	return &Event{ Type: eventType, Time: time.Now(), Torrent: torr, PieceIndex: -1, FileIndex: -1 }
+}
+
+// eventDispatcher delivers events to the subscribers of a torrent. The zero
+// value is ready to use.
+type eventDispatcher struct {
+	mutex sync.Mutex
+	handlers map[int]func(*Event)
+	nextId int
+}
+
+func (this *eventDispatcher) subscribe(handler func(*Event)) func() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.handlers == nil { this.handlers = make(map[int]func(*Event)) }
+	id := this.nextId
+	this.nextId++
+	this.handlers[id] = handler
+	return func() {
+		this.mutex.Lock()
+		defer this.mutex.Unlock()
+		delete(this.handlers, id)
+	}
+}
+
+func (this *eventDispatcher) emit(event *Event) {
+	this.mutex.Lock()
+	handlers := make([]func(*Event), 0, len(this.handlers))
+	for _, handler := range this.handlers {
+		handlers = append(handlers, handler)
+	}
+	this.mutex.Unlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
+
+// Subscribe registers a function called for every event of the torrent, and
+// returns a function that unregisters it. The handler is called from the
+// goroutine where the event happens, possibly concurrently, so it must be
+// safe for concurrent use and must not block.
+func (this *Torrent) Subscribe(handler func(*Event)) func() {
+	return this.events.subscribe(handler)
+}
+
+// SubscribeChannel sends the events of the torrent to the returned channel.
+// Events are dropped if the channel is full. Calling the returned function
+// unsubscribes, after which the channel receives no more events.
+func (this *Torrent) SubscribeChannel(size int) (<-chan *Event, func()) {
+	output := make(chan *Event, size)
+	// Deliveries already under way when unsubscribing are waited for.
+	var mutex sync.Mutex
+	stopped := false
+	unsubscribe := this.Subscribe(func(event *Event) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if stopped { return }
+		select {
+			case output <- event:
+			default:
+		}
+	})
+	return output, func() {
+		unsubscribe()
+		mutex.Lock()
+		defer mutex.Unlock()
+		stopped = true
+	}
+}
+
+func (this *Torrent) emit(event *Event) {
+	this.events.emit(event)
+}
+
+func (this *Torrent) emitPeerEvent(eventType EventType, peer net.Addr) {
+	event := newEvent(eventType, this)
+	event.Peer = peer
+	this.emit(event)
+}
@@ -1,17 +1,66 @@
 package torrent
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"sort"
+	"strconv"
 	"time"
 )
 
+var ErrRangeNotSupported = errors.New("server does not support range requests")
+var ErrTooManyRedirects = errors.New("too many redirects")
+var ErrBodyTooLarge = errors.New("response body too large")
+
+const maxErrorBodyLength = 1024
+const defaultMaxRedirects = 10
+// Large enough for the .torrent files of big torrents, and bounds the memory
+// a compressed response can expand to.
+const defaultMaxBodyLength = 10 << 20
+
 type HttpCallOptions struct {
 	ConnectionTimeout time.Duration
-	ReadWriteTimeout time.Duration
+	ReadWriteTimeout time.Duration // Without any data read or written
+	UserAgent string // Go's default if empty
+	Proxy *url.URL // Direct connection if nil
+	TLSConfig *tls.Config // Go's default if nil
+	MaxRedirects int // If zero, redirects are not followed and fail with an HttpError
+	MaxBodyLength int64 // Longer bodies fail with ErrBodyTooLarge, no limit if zero
+	// If RangeLength is not zero, only the bytes [RangeStart, RangeStart +
+	// RangeLength) are requested, and exactly that many must be returned.
+	RangeStart int64
+	RangeLength int64
+}
+
+// HttpError is returned when the server responds with a status other than
+// 2xx.
+type HttpError struct {
+	StatusCode int
+	Status string
+	RetryAfter time.Duration // Zero if the server didn't say
+	Body []byte // Beginning of the response body
+}
+
+func (this *HttpError) Error() string {
+	return "HTTP error: " + this.Status
+}
+
+// retryAfter parses the Retry-After header, which is either a number of
+// seconds or a date.
+func retryAfter(header string) time.Duration {
+	if header == "" { return 0 }
+	seconds, err := strconv.Atoi(header)
+	if err == nil && seconds > 0 { return time.Duration(seconds) * time.Second }
+	date, err := http.ParseTime(header)
+	if err != nil { return 0 }
+	return max(time.Until(date), 0)
 }
 
 func httpGetUrl(baseUrl string, parameters map[string]string) string {
@@ -31,37 +80,132 @@ func httpGetUrl(baseUrl string, parameters map[string]string) string {
 	return baseUrl + output
 }
 
+// CustomDialer returns a dialer whose connections fail once a read or write
+// makes no progress for readWriteTimeout. Slow transfers that progress are
+// not interrupted.
 func CustomDialer(connectionTimeout time.Duration, readWriteTimeout time.Duration) func(net, addr string) (c net.Conn, err error) {
+	dial := CustomDialerContext(connectionTimeout, readWriteTimeout)
 	return func(netw, addr string) (net.Conn, error) {
-		conn, err := net.DialTimeout(netw, addr, connectionTimeout)
-		if err != nil {
-			return nil, err
-		}
-		conn.SetDeadline(time.Now().Add(readWriteTimeout))
-		return conn, nil
+		return dial(context.Background(), netw, addr)
 	}
 }
 
+// CustomDialerContext is CustomDialer for http.Transport.DialContext.
+func CustomDialerContext(connectionTimeout time.Duration, readWriteTimeout time.Duration) func(ctx context.Context, net, addr string) (net.Conn, error) {
+	return func(ctx context.Context, netw, addr string) (net.Conn, error) {
+		dialer := net.Dialer{ Timeout: connectionTimeout }
+		conn, err := dialer.DialContext(ctx, netw, addr)
+		if err != nil { return nil, err }
+		return &idleTimeoutConn{ Conn: conn, timeout: readWriteTimeout }, nil
+	}
+}
+
+// idleTimeoutConn moves the deadline of each read or write forward, so that
+// the timeout only applies to a call that is waiting for the other side.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (this *idleTimeoutConn) Read(b []byte) (int, error) {
+	this.Conn.SetReadDeadline(time.Now().Add(this.timeout))
+	return this.Conn.Read(b)
+}
+
+func (this *idleTimeoutConn) Write(b []byte) (int, error) {
+	this.Conn.SetWriteDeadline(time.Now().Add(this.timeout))
+	return this.Conn.Write(b)
+}
+
 func NewHttpCallOptions() *HttpCallOptions {
 	o := new(HttpCallOptions)
 	o.ConnectionTimeout = 10 * time.Second
 	o.ReadWriteTimeout = 10 * time.Second
+	o.UserAgent = defaultUserAgent()
+	o.MaxRedirects = defaultMaxRedirects
+	o.MaxBodyLength = defaultMaxBodyLength
 	return o
 }
 
+// httpCallOptions returns the options of the HTTP calls made to the
+// trackers of the torrent, from the configuration of its client.
+func (this *Torrent) httpCallOptions() *HttpCallOptions {
+	if this.client == nil { return NewHttpCallOptions() }
+	return this.client.httpCallOptions(this.client.config.Proxy.Trackers)
+}
+
+func (this *Torrent) webSeedCallOptions() *HttpCallOptions {
+	if this.client == nil { return NewHttpCallOptions() }
+	return this.client.httpCallOptions(this.client.config.Proxy.WebSeeds)
+}
+
+func (this *Client) httpCallOptions(proxied bool) *HttpCallOptions {
+	output := NewHttpCallOptions()
+	output.ConnectionTimeout = this.config.HttpConnectionTimeout
+	output.ReadWriteTimeout = this.config.HttpReadWriteTimeout
+	output.UserAgent = this.config.UserAgent
+	output.Proxy = this.config.Proxy.httpProxy(proxied)
+	output.TLSConfig = this.config.TLSConfig
+	output.MaxRedirects = this.config.MaxRedirects
+	return output
+}
+
+// httpClient returns a client for the options. Compression is handled by
+// httpGet, so that it is also done for responses the transport didn't ask to
+// be compressed.
 func httpClient(options *HttpCallOptions) *http.Client {
 	return &http.Client {
 		Transport: &http.Transport {
-			Dial: CustomDialer(options.ConnectionTimeout, options.ReadWriteTimeout),
-	}}
+			DialContext: CustomDialerContext(options.ConnectionTimeout, options.ReadWriteTimeout),
+			Proxy: http.ProxyURL(options.Proxy),
+			TLSClientConfig: options.TLSConfig,
+			DisableCompression: true,
+		},
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			if options.MaxRedirects == 0 { return http.ErrUseLastResponse }
+			if len(via) > options.MaxRedirects { return ErrTooManyRedirects }
+			return nil
+		},
+	}
 }
 
-func httpGet(url string, options *HttpCallOptions) ([]byte, error) {
+// httpGet returns the body of the response. Cancelling the context aborts
+// the request, including the reading of the body.
+func httpGet(ctx context.Context, url string, options *HttpCallOptions) ([]byte, error) {
 	client := httpClient(options)
-	response, err := client.Get(url)
+	defer client.CloseIdleConnections()
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil { return nil, err }
+	if options.UserAgent != "" { request.Header.Set("User-Agent", options.UserAgent) }
+	// Range requests are not compressed, since the range would then apply to
+	// the compressed body.
+	if options.RangeLength <= 0 { request.Header.Set("Accept-Encoding", "gzip") }
+	if options.RangeLength > 0 {
+		request.Header.Set("Range", "bytes=" + strconv.FormatInt(options.RangeStart, 10) + "-" + strconv.FormatInt(options.RangeStart + options.RangeLength - 1, 10))
+	}
+	response, err := client.Do(request)
 	if err != nil { return nil, err }
 	defer response.Body.Close()
-	body, err := ioutil.ReadAll(response.Body)
+	var reader io.Reader = response.Body
+	var gzipErr error
+	if response.Header.Get("Content-Encoding") == "gzip" { reader, gzipErr = gzip.NewReader(response.Body) }
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		var body []byte
+		if gzipErr == nil { body, _ = ioutil.ReadAll(io.LimitReader(reader, maxErrorBodyLength)) }
+		return nil, &HttpError{ response.StatusCode, response.Status, retryAfter(response.Header.Get("Retry-After")), body }
+	}
+	if gzipErr != nil { return nil, gzipErr }
+	if options.RangeLength <= 0 {
+		if options.MaxBodyLength > 0 { reader = io.LimitReader(reader, options.MaxBodyLength + 1) }
+		body, err := ioutil.ReadAll(reader)
+		if err != nil { return nil, err }
+		if options.MaxBodyLength > 0 && int64(len(body)) > options.MaxBodyLength { return nil, ErrBodyTooLarge }
+		return body, nil
+	}
+
+	if response.StatusCode != http.StatusPartialContent { return nil, ErrRangeNotSupported }
+	body := make([]byte, options.RangeLength)
+	_, err = io.ReadFull(response.Body, body)
 	if err != nil { return nil, err }
 	return body, nil
 }
\ No newline at end of file
@@ -1,11 +1,13 @@
 package torrent
 
-// TODO: seed random num generator
-
 import (
+	cryptorand "crypto/rand"
 	"errors"
+	"io"
+	"math/big"
 	"math/rand"
 	"strings"
+	"sync"
 )
 
 const (
@@ -16,6 +18,9 @@ const (
 var ErrInvalidBencodedData = errors.New("invalid bencoded data")
 var ErrIndexOutOfBound = errors.New("index out bound")
 var ErrFileSelectionDuplicateIndex = errors.New("duplicate index in selection")
+var ErrInvalidMetaInfo = errors.New("invalid meta info")
+var ErrUnsupportedMetaVersion = errors.New("unsupported meta version")
+var ErrNoFiles = errors.New("no files found")
 
 type TrackerQuery map[string]string
 
@@ -23,20 +28,57 @@ func peerIdPrefix() string {
 	return "-" + ClientId + strings.Replace(Version, ".", "", -1) + "-"	
 }
 
-func peerIdSuffix() string {
+func defaultUserAgent() string {
+	return ClientId + "/" + Version
+}
+
+const peerIdLength = 20
+const trackerKeyLength = 8
+
+// randomInt returns a uniform integer in [0, n) made of the bytes of the
+// given source.
+func randomInt(random io.Reader, n int) int {
+	output, err := cryptorand.Int(random, big.NewInt(int64(n)))
+	if err != nil { return 0 }
+	return int(output.Int64())
+}
+
+// randomString returns length characters picked at random among letters and
+// digits.
+func randomString(random io.Reader, length int) string {
 	allowedChars := "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-	output := ""
-	for i := 0; i < 12; i++ {
-		n := rand.Intn(len(allowedChars))
-		output += string(allowedChars[n])
+	output := make([]byte, length)
+	for i, _ := range output {
+		output[i] = allowedChars[randomInt(random, len(allowedChars))]
 	}
-	return output
+	return string(output)
 }
 
+// generatePeerId completes the prefix with random characters.
+func generatePeerId(random io.Reader, prefix string) string {
+	return prefix + randomString(random, max(peerIdLength - len(prefix), 0))
+}
+
+// GeneratePeerId returns a peer id made of the client prefix and random
+// characters from a cryptographic source, so that peer ids can't be
+// predicted.
 func GeneratePeerId() string {
-	return peerIdPrefix() + peerIdSuffix()
+	return generatePeerId(cryptorand.Reader, peerIdPrefix())
 }
 
 func RandomPort() int {
-	return 10000 + rand.Intn(55000)
+	return 10000 + randomInt(cryptorand.Reader, 55000)
+}
+
+// lockedRand makes a math/rand generator safe for concurrent use, as a
+// source of random bytes.
+type lockedRand struct {
+	mutex sync.Mutex
+	random *rand.Rand
+}
+
+func (this *lockedRand) Read(p []byte) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.random.Read(p)
 }
\ No newline at end of file
@@ -0,0 +1,131 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/bits"
+)
+
+// Merkle trees of BitTorrent v2 (BEP 52). The leaves are the SHA-256 hashes
+// of the 16 KiB blocks of a file. Leaves beyond the end of the file are
+// zero, so that each layer has a power of two hashes.
+
+const merkleBlockSize = 16 * 1024
+
+var zeroHash = make([]byte, sha256.Size)
+
+func hashPair(left []byte, right []byte) []byte {
+	hasher := sha256.New()
+	hasher.Write(left)
+	hasher.Write(right)
+	return hasher.Sum(nil)
+}
+
+// padHash returns the root of a subtree of the given height whose leaves
+// are all zero.
+func padHash(height int) []byte {
+	output := zeroHash
+	for i := 0; i < height; i++ {
+		output = hashPair(output, output)
+	}
+	return output
+}
+
+func nextPowerOfTwo(n int) int {
+	if n <= 1 { return 1 }
+	return 1 << bits.Len(uint(n - 1))
+}
+
+func log2(n int) int {
+	return bits.Len(uint(n)) - 1
+}
+
+// merkleRoot returns the root of the tree whose leaves are the given
+// hashes, padded with the given hash up to count leaves, a power of two.
+func merkleRoot(hashes [][]byte, count int, pad []byte) []byte {
+	layer := hashes
+	for ; count > 1; count /= 2 {
+		next := make([][]byte, 0, (len(layer) + 1) / 2)
+		for i := 0; i < len(layer); i += 2 {
+			right := pad
+			if i + 1 < len(layer) { right = layer[i + 1] }
+			next = append(next, hashPair(layer[i], right))
+		}
+		layer = next
+		pad = hashPair(pad, pad)
+	}
+	if len(layer) == 0 { return pad }
+	return layer[0]
+}
+
+// blockHashes returns the leaves of the data: the hashes of its 16 KiB
+// blocks, the last of which may be shorter.
+func blockHashes(data []byte) [][]byte {
+	output := make([][]byte, 0, (len(data) + merkleBlockSize - 1) / merkleBlockSize)
+	for start := 0; start < len(data); start += merkleBlockSize {
+		hash := sha256.Sum256(data[start : min(start + merkleBlockSize, len(data))])
+		output = append(output, hash[:])
+	}
+	return output
+}
+
+// pieceLayerHash returns the hash of a piece in the piece layer, i.e. the
+// root of the subtree of its blocks.
+func pieceLayerHash(data []byte, pieceLength int) []byte {
+	return merkleRoot(blockHashes(data), pieceLength / merkleBlockSize, zeroHash)
+}
+
+// piecesRoot returns the root of the tree of a file. Files that are larger
+// than a piece are given by their piece layer, smaller ones by their block
+// hashes.
+func piecesRoot(pieceLayer [][]byte, blocks [][]byte, pieceLength int) []byte {
+	if pieceLayer == nil { return merkleRoot(blocks, nextPowerOfTwo(len(blocks)), zeroHash) }
+	return merkleRoot(pieceLayer, nextPowerOfTwo(len(pieceLayer)), padHash(log2(pieceLength / merkleBlockSize)))
+}
+
+func splitHashes(layer string) [][]byte {
+	output := make([][]byte, 0, len(layer) / sha256.Size)
+	for start := 0; start + sha256.Size <= len(layer); start += sha256.Size {
+		output = append(output, []byte(layer[start : start + sha256.Size]))
+	}
+	return output
+}
+
+// merkleLayers returns all the layers of the tree built on top of the given
+// piece layer, from the piece layer up to the root.
+func merkleLayers(pieceLayer [][]byte, pieceLength int) [][][]byte {
+	pad := padHash(log2(pieceLength / merkleBlockSize))
+	layer := make([][]byte, nextPowerOfTwo(len(pieceLayer)))
+	for i := range layer {
+		layer[i] = pad
+		if i < len(pieceLayer) { layer[i] = pieceLayer[i] }
+	}
+	output := [][][]byte{ layer }
+	for len(layer) > 1 {
+		next := make([][]byte, len(layer) / 2)
+		for i := range next {
+			next[i] = hashPair(layer[2 * i], layer[2 * i + 1])
+		}
+		output = append(output, next)
+		layer = next
+	}
+	return output
+}
+
+// verifyMerkleProof tells whether the given hashes, which are the leaves of
+// the subtree at the given index in their layer, and their uncle hashes from
+// the bottom up lead to the root.
+func verifyMerkleProof(root []byte, index int, hashes [][]byte, proof [][]byte) bool {
+	if len(hashes) == 0 || nextPowerOfTwo(len(hashes)) != len(hashes) || index % len(hashes) != 0 { return false }
+	node := merkleRoot(hashes, len(hashes), zeroHash)
+	position := index / len(hashes)
+	for _, uncle := range proof {
+		if position % 2 == 0 {
+			node = hashPair(node, uncle)
+		} else {
+			node = hashPair(uncle, node)
+		}
+		position /= 2
+	}
+	return position == 0 && bytes.Equal(node, root)
+}
@@ -0,0 +1,507 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"torrent/bencoding"
+)
+
+// FileInfo describes one of the files of a torrent. Path is relative to the
+// download directory and, for multi-file torrents, starts with the name of
+// the torrent. Offset is the position of the file within the torrent data,
+// i.e. the concatenation of all the files. PiecesRoot is the root of the
+// merkle tree of the file for v2 torrents.
+type FileInfo struct {
+	Path []string
+	Length int
+	Offset int
+	PiecesRoot []byte
+}
+
+// TorrentVersion tells which of the BitTorrent v1 and v2 (BEP 52) layouts
+// the meta info carries. Hybrid torrents carry both.
+type TorrentVersion int
+
+const (
+	TorrentV1 TorrentVersion = iota
+	TorrentV2
+	TorrentHybrid
+)
+
+func (this TorrentVersion) String() string {
+	switch this {
+		case TorrentV1: return "v1"
+		case TorrentV2: return "v2"
+		case TorrentHybrid: return "hybrid"
+	}
+	return "unknown"
+}
+
+func (this *Torrent) Version() TorrentVersion {
+	if metaInfoVersion(this.MetaInfo()) != 2 { return TorrentV1 }
+	if _, ok := this.MetaInfo().Get("info", "pieces"); ok { return TorrentHybrid }
+	return TorrentV2
+}
+
+func (this *Torrent) Name() string {
+	output, _ := this.MetaInfo().GetString("info", "name")
+	return output
+}
+
+func (this *Torrent) PieceLength() int {
+	output, _ := this.MetaInfo().GetInt("info", "piece length")
+	return output
+}
+
+func (this *Torrent) PieceCount() int {
+	if this.Version() == TorrentV2 {
+		pieceLength := this.PieceLength()
+		if pieceLength <= 0 { return 0 }
+		return (dataSize(this.files) + pieceLength - 1) / pieceLength
+	}
+	pieces, _ := this.MetaInfo().GetString("info", "pieces")
+	return len(pieces) / bencoding.HashLength
+}
+
+// PieceSize returns the size of the piece at the given index. All the pieces
+// have the same size except the last one, which may be shorter. In v2
+// torrents, the pieces don't span files, so the last piece of every file may
+// be shorter.
+func (this *Torrent) PieceSize(index int) int {
+	if index < 0 || index >= this.PieceCount() { return 0 }
+	start := index * this.PieceLength()
+	if this.Version() == TorrentV2 {
+		file, ok := this.fileAt(start)
+		if !ok { return 0 }
+		return min(this.PieceLength(), file.Offset + file.Length - start)
+	}
+	if index < this.PieceCount() - 1 { return this.PieceLength() }
+	return dataSize(this.files) - start
+}
+
+// fileAt returns the file containing the given offset of the torrent data.
+func (this *Torrent) fileAt(offset int) (FileInfo, bool) {
+	for _, file := range this.files {
+		if offset >= file.Offset && offset < file.Offset + file.Length { return file, true }
+	}
+	return FileInfo{}, false
+}
+
+// dataSize returns the size of the torrent data, which includes the padding
+// between the files of v2 and hybrid torrents.
+func dataSize(files []FileInfo) int {
+	output := 0
+	for _, file := range files {
+		output = max(output, file.Offset + file.Length)
+	}
+	return output
+}
+
+func (this *Torrent) PieceHash(index int) []byte {
+	pieces, _ := this.MetaInfo().GetString("info", "pieces")
+	start := index * bencoding.HashLength
+	if index < 0 || start + bencoding.HashLength > len(pieces) { return nil }
+	return []byte(pieces[start : start + bencoding.HashLength])
+}
+
+// InfoHash returns the hash that identifies the torrent on the wire and to
+// trackers: the SHA-1 of the info dictionary, or for v2 torrents its SHA-256
+// truncated to 20 bytes.
+func (this *Torrent) InfoHash() []byte {
+	if this.Version() == TorrentV2 { return this.InfoHashV2()[:20] }
+	return infoHash(this.MetaInfo())
+}
+
+// InfoHashV2 returns the SHA-256 of the info dictionary, or nil for v1
+// torrents.
+func (this *Torrent) InfoHashV2() []byte {
+	if this.Version() == TorrentV1 { return nil }
+	return infoHashV2(this.MetaInfo())
+}
+
+func (this *Torrent) InfoHashHex() string {
+	return hex.EncodeToString(this.InfoHash())
+}
+
+func (this *Torrent) Files() []FileInfo {
+	output := make([]FileInfo, len(this.files))
+	for i, file := range this.files {
+		output[i] = file
+		output[i].Path = slices.Clone(file.Path)
+	}
+	return output
+}
+
+// filesV1 lists the files of the "files" list, or the single file. BEP 47
+// pad files are left out, but still take their place in the torrent data.
+func filesV1(metaInfo *bencoding.Any) ([]FileInfo, bool) {
+	name, _ := metaInfo.GetString("info", "name")
+	files, err := metaInfo.GetList("info", "files")
+	if err != nil {
+		length, _ := metaInfo.GetInt("info", "length")
+		return []FileInfo{ FileInfo{ Path: []string{ name }, Length: length } }, true
+	}
+
+	output := make([]FileInfo, 0, len(files))
+	offset := 0
+	for _, file := range files {
+		length, _ := file.GetInt("length")
+		attributes, _ := file.GetString("attr")
+		if !strings.Contains(attributes, "p") {
+			path := []string{ name }
+			components, _ := file.GetList("path")
+			for _, component := range components {
+				path = append(path, component.AsString)
+			}
+			output = append(output, FileInfo{ Path: path, Length: length, Offset: offset })
+		}
+		offset += length
+	}
+	return output, false
+}
+
+// filesV2 lists the files of the "file tree", in key order. Every file
+// starts on a piece boundary. The torrent is a single file if the tree only
+// has the file named after the torrent.
+func filesV2(metaInfo *bencoding.Any) ([]FileInfo, bool, error) {
+	name, _ := metaInfo.GetString("info", "name")
+	pieceLength, _ := metaInfo.GetInt("info", "piece length")
+	tree, err := metaInfo.Query("info", "file tree")
+	if err != nil { return nil, false, err }
+
+	var output []FileInfo
+	offset := 0
+	var walk func(node *bencoding.Any, path []string) error
+	walk = func(node *bencoding.Any, path []string) error {
+		if node.Type != bencoding.Dictionary || len(node.AsDictionary) == 0 { return ErrInvalidMetaInfo }
+		keys := make([]string, 0, len(node.AsDictionary))
+		for key, _ := range node.AsDictionary {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if key == "" { return ErrInvalidMetaInfo }
+			child := node.AsDictionary[key]
+			childPath := append(slices.Clone(path), key)
+			file, isFile := child.Get("")
+			if !isFile {
+				err := walk(child, childPath)
+				if err != nil { return err }
+				continue
+			}
+			if len(child.AsDictionary) != 1 { return ErrInvalidMetaInfo }
+			length, err := file.GetInt("length")
+			if err != nil { return err }
+			if length < 0 { return ErrInvalidMetaInfo }
+			root, _ := file.GetString("pieces root")
+			if length > 0 && len(root) != sha256.Size { return ErrInvalidMetaInfo }
+			output = append(output, FileInfo{ Path: childPath, Length: length, Offset: offset, PiecesRoot: []byte(root) })
+			offset += (length + pieceLength - 1) / pieceLength * pieceLength
+		}
+		return nil
+	}
+	err = walk(tree, nil)
+	if err != nil { return nil, false, err }
+	if len(output) == 0 { return nil, false, ErrInvalidMetaInfo }
+
+	if len(output) == 1 && slices.Equal(output[0].Path, []string{ name }) { return output, true, nil }
+	for i, _ := range output {
+		output[i].Path = append([]string{ name }, output[i].Path...)
+	}
+	return output, false, nil
+}
+
+// Trackers returns the announce URLs grouped by tier, as defined by BEP 12.
+// If the torrent has no "announce-list", the "announce" URL is the only tier.
+func (this *Torrent) Trackers() [][]string {
+	var output [][]string
+	tiers, _ := this.MetaInfo().GetList("announce-list")
+	for _, tier := range tiers {
+		var urls []string
+		for _, e := range tier.AsList {
+			if e.Type == bencoding.String && e.AsString != "" { urls = append(urls, e.AsString) }
+		}
+		if len(urls) > 0 { output = append(output, urls) }
+	}
+	if len(output) > 0 { return output }
+
+	announce, err := this.MetaInfo().GetString("announce")
+	if err == nil && announce != "" { output = append(output, []string{ announce }) }
+	return output
+}
+
+// piecesForFile returns the range of pieces [first, last] that contain data of
+// the given file. Empty files have no pieces, in which case last < first.
+func (this *Torrent) piecesForFile(file FileInfo) (int, int) {
+	pieceLength := this.PieceLength()
+	if file.Length == 0 { return 0, -1 }
+	return file.Offset / pieceLength, (file.Offset + file.Length - 1) / pieceLength
+}
+
+// WantedPieces tells, for each piece, whether it contains data from one of
+// the selected files.
+func (this *Torrent) WantedPieces() []bool {
+	output := make([]bool, this.PieceCount())
+	files := this.Files()
+	for _, index := range this.selectedFileIndexes {
+		first, last := this.piecesForFile(files[index])
+		for i := first; i <= last && i < len(output); i++ {
+			output[i] = true
+		}
+	}
+	return output
+}
+
+type CreateOptions struct {
+	Announce [][]string // Tracker URLs grouped by tier
+	PieceLength int // If zero, a piece length is chosen depending on the total size
+	Private bool
+	Comment string
+	WebSeeds []string
+	HttpSeeds []string
+	Version TorrentVersion
+}
+
+// defaultPieceLength aims at about 1500 pieces, between 16 KiB and 16 MiB.
+func defaultPieceLength(totalSize int) int {
+	output := 16 * 1024
+	for output < 16 * 1024 * 1024 && totalSize / output > 1500 {
+		output *= 2
+	}
+	return output
+}
+
+type createFile struct {
+	path string
+	components []string
+	length int
+}
+
+func listCreateFiles(root string) ([]createFile, error) {
+	var output []createFile
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil { return err }
+		if !info.Mode().IsRegular() { return nil }
+		relativePath, err := filepath.Rel(root, path)
+		if err != nil { return err }
+		output = append(output, createFile{ path, splitPath(relativePath), int(info.Size()) })
+		return nil
+	})
+	if err != nil { return nil, err }
+	sort.Slice(output, func(i, j int) bool { return output[i].path < output[j].path })
+	return output, nil
+}
+
+// sortCreateFilesV2 sorts the files in the order of the v2 file tree, which
+// compares paths component by component.
+func sortCreateFilesV2(files []createFile) {
+	slices.SortFunc(files, func(a createFile, b createFile) int { return slices.Compare(a.components, b.components) })
+}
+
+func splitPath(path string) []string {
+	var output []string
+	for path != "" {
+		dir, file := filepath.Split(path)
+		output = append([]string{ file }, output...)
+		path = filepath.Clean(dir)
+		if path == "." || path == string(filepath.Separator) { break }
+	}
+	return output
+}
+
+// hashPieces reads the given files as one continuous stream and returns the
+// concatenated SHA-1 hashes of its pieces. If aligned, every file but the
+// last is padded with zeros up to a piece boundary, as by a pad file.
+func hashPieces(files []createFile, pieceLength int, aligned bool) (string, error) {
+	output := make([]byte, 0)
+	piece := make([]byte, 0, pieceLength)
+	for i, file := range files {
+		f, err := os.Open(file.path)
+		if err != nil { return "", err }
+		for {
+			n, err := io.ReadFull(f, piece[len(piece):pieceLength])
+			piece = piece[:len(piece) + n]
+			if len(piece) == pieceLength {
+				hash := sha1.Sum(piece)
+				output = append(output, hash[:]...)
+				piece = piece[:0]
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF { break }
+			if err != nil { f.Close(); return "", err }
+		}
+		f.Close()
+		if aligned && len(piece) > 0 && i < len(files) - 1 {
+			padded := piece[:pieceLength]
+			clear(padded[len(piece):])
+			hash := sha1.Sum(padded)
+			output = append(output, hash[:]...)
+			piece = piece[:0]
+		}
+	}
+	if len(piece) > 0 {
+		hash := sha1.Sum(piece)
+		output = append(output, hash[:]...)
+	}
+	return string(output), nil
+}
+
+// hashFileV2 returns the pieces root of a file and, if it is larger than a
+// piece, its piece layer. Both are nil for an empty file.
+func hashFileV2(path string, pieceLength int) ([]byte, []byte, error) {
+	f, err := os.Open(path)
+	if err != nil { return nil, nil, err }
+	defer f.Close()
+
+	var blocks [][]byte
+	var layer [][]byte
+	piece := make([]byte, pieceLength)
+	for {
+		n, err := io.ReadFull(f, piece)
+		if n > 0 {
+			blocks = blockHashes(piece[:n])
+			layer = append(layer, pieceLayerHash(piece[:n], pieceLength))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF { break }
+		if err != nil { return nil, nil, err }
+	}
+	if len(layer) == 0 { return nil, nil, nil }
+	if len(layer) == 1 { return piecesRoot(nil, blocks, pieceLength), nil, nil }
+	return piecesRoot(layer, nil, pieceLength), bytes.Join(layer, nil), nil
+}
+
+// CreateMetaInfo builds the meta info of a new torrent made of the file or
+// directory at the given path.
+func CreateMetaInfo(path string, options *CreateOptions) (*bencoding.Any, error) {
+	path = filepath.Clean(path)
+	stat, err := os.Stat(path)
+	if err != nil { return nil, err }
+
+	var files []createFile
+	if stat.IsDir() {
+		files, err = listCreateFiles(path)
+		if err != nil { return nil, err }
+		if len(files) == 0 { return nil, ErrNoFiles }
+	} else {
+		files = []createFile{ createFile{ path, nil, int(stat.Size()) } }
+	}
+
+	totalSize := 0
+	for _, file := range files {
+		totalSize += file.length
+	}
+
+	pieceLength := options.PieceLength
+	if pieceLength <= 0 { pieceLength = defaultPieceLength(totalSize) }
+	if options.Version != TorrentV1 {
+		if pieceLength < merkleBlockSize || nextPowerOfTwo(pieceLength) != pieceLength { return nil, ErrInvalidPieceLength }
+		sortCreateFilesV2(files)
+	}
+
+	info := bencoding.NewDictionary(map[string]*bencoding.Any{})
+	info.Set(bencoding.NewString(filepath.Base(path)), "name")
+	info.Set(bencoding.NewInt(pieceLength), "piece length")
+	if options.Private { info.Set(bencoding.NewInt(1), "private") }
+
+	var pieceLayers *bencoding.Any
+	if options.Version != TorrentV1 {
+		tree := bencoding.NewDictionary(map[string]*bencoding.Any{})
+		pieceLayers = bencoding.NewDictionary(map[string]*bencoding.Any{})
+		for _, file := range files {
+			root, layer, err := hashFileV2(file.path, pieceLength)
+			if err != nil { return nil, err }
+			entry := bencoding.NewDictionary(map[string]*bencoding.Any{ "length": bencoding.NewInt(file.length) })
+			if root != nil { entry.Set(bencoding.NewString(string(root)), "pieces root") }
+			if layer != nil { pieceLayers.Set(bencoding.NewString(string(layer)), string(root)) }
+			components := file.components
+			if !stat.IsDir() { components = []string{ filepath.Base(path) } }
+			keys := make([]interface{}, 0, len(components) + 1)
+			for _, component := range components {
+				keys = append(keys, component)
+			}
+			tree.Set(bencoding.NewDictionary(map[string]*bencoding.Any{ "": entry }), keys...)
+		}
+		info.Set(bencoding.NewInt(2), "meta version")
+		info.Set(tree, "file tree")
+	}
+
+	if options.Version != TorrentV2 {
+		pieces, err := hashPieces(files, pieceLength, options.Version == TorrentHybrid)
+		if err != nil { return nil, err }
+		info.Set(bencoding.NewString(pieces), "pieces")
+	}
+
+	if options.Version != TorrentV2 && stat.IsDir() {
+		list := make([]*bencoding.Any, 0, len(files))
+		for i, file := range files {
+			components := make([]*bencoding.Any, 0, len(file.components))
+			for _, component := range file.components {
+				components = append(components, bencoding.NewString(component))
+			}
+			list = append(list, bencoding.NewDictionary(map[string]*bencoding.Any{
+				"length": bencoding.NewInt(file.length),
+				"path": bencoding.NewList(components),
+			}))
+			padding := (pieceLength - file.length % pieceLength) % pieceLength
+			if options.Version == TorrentHybrid && padding > 0 && i < len(files) - 1 {
+				list = append(list, bencoding.NewDictionary(map[string]*bencoding.Any{
+					"attr": bencoding.NewString("p"),
+					"length": bencoding.NewInt(padding),
+					"path": bencoding.NewList([]*bencoding.Any{ bencoding.NewString(".pad"), bencoding.NewString(strconv.Itoa(padding)) }),
+				}))
+			}
+		}
+		info.Set(bencoding.NewList(list), "files")
+	} else if options.Version != TorrentV2 {
+		info.Set(bencoding.NewInt(totalSize), "length")
+	}
+
+	output := bencoding.NewDictionary(map[string]*bencoding.Any{})
+	output.Set(info, "info")
+	if pieceLayers != nil { output.Set(pieceLayers, "piece layers") }
+	output.Set(bencoding.NewInt(int(time.Now().Unix())), "creation date")
+	output.Set(bencoding.NewString(ClientId + " " + Version), "created by")
+	if options.Comment != "" { output.Set(bencoding.NewString(options.Comment), "comment") }
+
+	if len(options.Announce) > 0 && len(options.Announce[0]) > 0 {
+		output.Set(bencoding.NewString(options.Announce[0][0]), "announce")
+		if len(options.Announce) > 1 || len(options.Announce[0]) > 1 {
+			tiers := make([]*bencoding.Any, 0, len(options.Announce))
+			for _, tier := range options.Announce {
+				urls := make([]*bencoding.Any, 0, len(tier))
+				for _, url := range tier {
+					urls = append(urls, bencoding.NewString(url))
+				}
+				tiers = append(tiers, bencoding.NewList(urls))
+			}
+			output.Set(bencoding.NewList(tiers), "announce-list")
+		}
+	}
+
+	if len(options.WebSeeds) > 0 {
+		urls := make([]*bencoding.Any, 0, len(options.WebSeeds))
+		for _, url := range options.WebSeeds {
+			urls = append(urls, bencoding.NewString(url))
+		}
+		output.Set(bencoding.NewList(urls), "url-list")
+	}
+
+	if len(options.HttpSeeds) > 0 {
+		urls := make([]*bencoding.Any, 0, len(options.HttpSeeds))
+		for _, url := range options.HttpSeeds {
+			urls = append(urls, bencoding.NewString(url))
+		}
+		output.Set(bencoding.NewList(urls), "httpseeds")
+	}
+
+	return output, nil
+}
@@ -1,20 +1,56 @@
 package torrent
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
 	"torrent/bencoding"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 var sampleTorrentTrackerUrl = "http://localhost:8080/LibreOffice.torrent"
 var sampleTorrentAnnounceUrl = "http://tracker.documentfoundation.org:6969/announce"
 
+var testServerOnce sync.Once
+
+// startTestServer serves the "testing" directory on port 8080. The listener
+// is opened before returning so that tests don't race against it.
 func startTestServer() {
-	http.ListenAndServe(":8080", http.FileServer(http.Dir("testing")))
+	testServerOnce.Do(func() {
+		listener, err := net.Listen("tcp", ":8080")
+		if err != nil { panic(err) }
+		go http.Serve(listener, http.FileServer(http.Dir("testing")))
+	})
 }
 
 func Test_FetchMetaInfo(t *testing.T) {
-	go startTestServer()
+	startTestServer()
 	
 	client := NewClient()
 	torr := client.NewTorrent(sampleTorrentTrackerUrl)	
@@ -45,7 +81,7 @@ func Test_FetchMetaInfo(t *testing.T) {
 }
 
 func Test_NewTrackerQuery(t *testing.T) {
-	go startTestServer()
+	startTestServer()
 	
 	client := NewClient()
 	torr := client.NewTorrent(sampleTorrentTrackerUrl)	
@@ -95,6 +131,94 @@ func Test_ClientPort(t *testing.T) {
 	}
 }
 
+func Test_ClientConfig(t *testing.T) {
+	err := NewClientConfig().Validate()
+	if err != nil { t.Fatal("Expected the defaults to be valid, got", err) }
+
+	tests := []struct {
+		change func(config *ClientConfig)
+		field string
+	}{
+		{ func(config *ClientConfig) { config.PortMin = 0 }, "PortMin" },
+		{ func(config *ClientConfig) { config.PortMax = config.PortMin - 1 }, "PortMax" },
+		{ func(config *ClientConfig) { config.PeerIdPrefix = strings.Repeat("x", 21) }, "PeerIdPrefix" },
+		{ func(config *ClientConfig) { config.NumWant = -1 }, "NumWant" },
+		{ func(config *ClientConfig) { config.HttpReadWriteTimeout = 0 }, "HttpReadWriteTimeout" },
+		{ func(config *ClientConfig) { config.Limits.MaxConnections = -1 }, "Limits.MaxConnections" },
+		{ func(config *ClientConfig) { config.StorageRoot = "" }, "StorageRoot" },
+		{ func(config *ClientConfig) { config.EncryptionPolicy = 3 }, "EncryptionPolicy" },
+		{ func(config *ClientConfig) { config.Proxy.WebSeeds = true; config.Proxy.HttpUrl = "socks5://localhost:1080" }, "Proxy.HttpUrl" },
+		{ func(config *ClientConfig) { config.Proxy.Peers = true }, "Proxy.Socks5Address" },
+	}
+	for _, test := range tests {
+		config := NewClientConfig()
+		test.change(config)
+		_, err := NewClientWithConfig(config)
+		var configErr *ConfigError
+		if !errors.As(err, &configErr) || configErr.Field != test.field || !errors.Is(err, ErrInvalidConfig) { t.Errorf("Expected an invalid %s, got %v", test.field, err) }
+	}
+
+	userAgents := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+			case userAgents <- r.UserAgent():
+			default:
+		}
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer server.Close()
+
+	config := NewClientConfig()
+	config.PortMin = 7000
+	config.PortMax = 7000
+	config.PeerIdPrefix = "-XX0100-"
+	config.NumWant = 12
+	config.UserAgent = "test/1.0"
+	config.StorageRoot = t.TempDir()
+	config.EnableUtp = false
+	client, err := NewClientWithConfig(config)
+	if err != nil { t.Fatal(err) }
+	defer client.Close()
+	if client.Port() != 7000 || !strings.HasPrefix(client.PeerId(), "-XX0100-") || len(client.PeerId()) != 20 { t.Errorf("Unexpected identity %d %q", client.Port(), client.PeerId()) }
+
+	root := createTestFiles(t, []int{ 1000 })
+	torr := createTestTorrent(t, client, root, &CreateOptions{ Announce: [][]string{ { server.URL + "/announce" } } })
+	query := client.NewTrackerQuery(torr, "")
+	if query["numwant"] != "12" { t.Errorf("Expected numwant 12, got %s", query["numwant"]) }
+	_, err = torr.CallTracker(query)
+	if err != nil { t.Fatal(err) }
+	if userAgent := <-userAgents; userAgent != "test/1.0" { t.Errorf("Expected the configured user agent, got %q", userAgent) }
+
+	// The torrent is stored in the storage root, where its data is missing.
+	err = client.AddTorrent(torr, "")
+	if err != nil { t.Fatal(err) }
+	m, _ := client.managedTorrent(torr.InfoHash())
+	if m.storage.root != config.StorageRoot { t.Errorf("Expected the storage root, got %s", m.storage.root) }
+
+	err = client.Listen("127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	if client.utpSocket != nil { t.Error("Expected no uTP socket") }
+}
+
+func Test_RandomSource(t *testing.T) {
+	newClient := func(source rand.Source) *Client {
+		config := NewClientConfig()
+		config.RandomSource = source
+		client, err := NewClientWithConfig(config)
+		if err != nil { t.Fatal(err) }
+		return client
+	}
+	first := newClient(rand.NewSource(1))
+	second := newClient(rand.NewSource(1))
+	if first.PeerId() != second.PeerId() || first.Port() != second.Port() { t.Error("Expected the same identity from the same source") }
+	if !strings.HasPrefix(first.PeerId(), peerIdPrefix()) || len(first.PeerId()) != 20 { t.Errorf("Unexpected peer id %q", first.PeerId()) }
+
+	if newClient(nil).PeerId() == newClient(nil).PeerId() { t.Error("Expected different peer ids without a source") }
+	for i := 0; i < 1000; i++ {
+		if n := randomInt(first.random, 3); n < 0 || n >= 3 { t.Fatalf("Unexpected random integer %d", n) }
+	}
+}
+
 func Test_HttpGetUrl(t *testing.T) {
 	type GetUrlTest struct {
 		baseUrl string
@@ -115,8 +239,195 @@ func Test_HttpGetUrl(t *testing.T) {
 	}
 }
 
+func Test_HttpGet(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+			case "/gzip":
+				if r.Header.Get("Accept-Encoding") != "gzip" || r.UserAgent() != ClientId + "/" + Version { w.WriteHeader(http.StatusBadRequest); return }
+				w.Header().Set("Content-Encoding", "gzip")
+				writer := gzip.NewWriter(w)
+				writer.Write([]byte("compressed"))
+				writer.Close()
+			case "/gzip-bomb":
+				w.Header().Set("Content-Encoding", "gzip")
+				writer := gzip.NewWriter(w)
+				writer.Write(make([]byte, defaultMaxBodyLength + 1))
+				writer.Close()
+			case "/gzip-error":
+				w.Header().Set("Content-Encoding", "gzip")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				writer := gzip.NewWriter(w)
+				writer.Write([]byte("30"))
+				writer.Close()
+			case "/redirect/2": http.Redirect(w, r, "/redirect/1", http.StatusFound)
+			case "/redirect/1": http.Redirect(w, r, "/redirect/0", http.StatusFound)
+			default: w.Write([]byte("done"))
+		}
+	}))
+	defer server.Close()
+
+	body, err := httpGet(context.Background(), server.URL + "/gzip", NewHttpCallOptions())
+	if err != nil || string(body) != "compressed" { t.Errorf("Unexpected body %q: %v", body, err) }
+	_, err = httpGet(context.Background(), server.URL + "/gzip-bomb", NewHttpCallOptions())
+	if err != ErrBodyTooLarge { t.Errorf("Expected error '%s', got error '%v'", ErrBodyTooLarge, err) }
+	_, err = httpGet(context.Background(), server.URL + "/gzip-error", NewHttpCallOptions())
+	var httpErr *HttpError
+	if !errors.As(err, &httpErr) || string(httpErr.Body) != "30" { t.Errorf("Expected a decompressed error body, got %v", err) }
+
+	options := NewHttpCallOptions()
+	options.MaxRedirects = 2
+	body, err = httpGet(context.Background(), server.URL + "/redirect/2", options)
+	if err != nil || string(body) != "done" { t.Errorf("Unexpected body %q: %v", body, err) }
+	options.MaxRedirects = 1
+	_, err = httpGet(context.Background(), server.URL + "/redirect/2", options)
+	if !errors.Is(err, ErrTooManyRedirects) { t.Errorf("Expected too many redirects, got %v", err) }
+	options.MaxRedirects = 0
+	_, err = httpGet(context.Background(), server.URL + "/redirect/2", options)
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusFound { t.Errorf("Expected the redirect not to be followed, got %v", err) }
+}
+
+func Test_HttpIdleTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+			if r.URL.Path == "/stalled" {
+				time.Sleep(400 * time.Millisecond)
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	// The whole transfer takes longer than the timeout, but progresses.
+	options := NewHttpCallOptions()
+	options.ReadWriteTimeout = 200 * time.Millisecond
+	body, err := httpGet(context.Background(), server.URL + "/slow", options)
+	if err != nil || len(body) != 25 { t.Errorf("Unexpected body %q: %v", body, err) }
+	_, err = httpGet(context.Background(), server.URL + "/stalled", options)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() { t.Errorf("Expected a timeout, got %v", err) }
+}
+
+func Test_Cancellation(t *testing.T) {
+	var calls atomic.Int32
+	var stopped atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("event") == "stopped" {
+			stopped.Add(1)
+			w.Write([]byte("d8:intervali60e5:peers0:e"))
+			return
+		}
+		calls.Add(1)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	cancelled := func(f func(ctx context.Context) error) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		err := f(ctx)
+		if time.Since(start) > 5 * time.Second { t.Error("Expected the call to be aborted") }
+		return err
+	}
+
+	client := NewClient()
+	torr := client.NewTorrent(server.URL + "/file.torrent")
+	err := cancelled(torr.FetchMetaInfoContext)
+	if !errors.Is(err, context.DeadlineExceeded) { t.Errorf("Expected the deadline to be exceeded, got %v", err) }
+
+	announce := [][]string{ { server.URL + "/announce", server.URL + "/other/announce" } }
+	torr = createTestTorrent(t, client, createTestFiles(t, []int{ 10 }), &CreateOptions{ Announce: announce })
+	calls.Store(0)
+	err = cancelled(func(ctx context.Context) error {
+		_, err := torr.CallTrackerContext(ctx, client.NewTrackerQuery(torr, ""))
+		return err
+	})
+	var trackerErr *TrackerError
+	if !errors.As(err, &trackerErr) || !errors.Is(err, context.DeadlineExceeded) { t.Errorf("Expected the deadline to be exceeded, got %v", err) }
+	if calls.Load() != 1 { t.Errorf("Expected the other tracker not to be called, got %d calls", calls.Load()) }
+
+	err = cancelled(func(ctx context.Context) error {
+		return client.NewDownloader(torr, NewFileStorage(torr, t.TempDir()), nil).RunContext(ctx)
+	})
+	if !errors.Is(err, context.DeadlineExceeded) { t.Errorf("Expected the deadline to be exceeded, got %v", err) }
+	// The aborted "started" announce may have been recorded by the tracker.
+	if stopped.Load() != 1 { t.Errorf("Expected a stopped announce, got %d", stopped.Load()) }
+
+	seeder := client.NewSeeder(torr, NewFileStorage(torr, t.TempDir()), NewBitfield(torr.PieceCount()))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	calls.Store(0)
+	go seeder.Serve(listener)
+	for i := 0; i < 100 && calls.Load() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	seeder.Close()
+	if stopped.Load() != 2 { t.Errorf("Expected the seeder to announce stopped, got %d stopped announces", stopped.Load()) }
+
+	// A peer that doesn't answer over uTP is not tried over TCP once the
+	// context is cancelled.
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	defer silent.Close()
+	utpClient := NewClient()
+	utpClient.Listen("127.0.0.1:0")
+	defer utpClient.Close()
+	err = cancelled(func(ctx context.Context) error {
+		_, err := utpClient.dial(ctx, silent.LocalAddr().String(), 10 * time.Second)
+		return err
+	})
+	if !errors.Is(err, context.DeadlineExceeded) { t.Errorf("Expected the deadline to be exceeded, got %v", err) }
+
+	// A peer that accepts the connection but never answers the handshake.
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	defer listener.Close()
+	err = cancelled(func(ctx context.Context) error {
+		_, err := DialPeerContext(ctx, listener.Addr().String(), torr.InfoHash(), GeneratePeerId(), EncryptionPrefer, 10 * time.Second)
+		return err
+	})
+	if !errors.Is(err, context.DeadlineExceeded) { t.Errorf("Expected the deadline to be exceeded, got %v", err) }
+}
+
+func Test_HttpsTracker(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	server.TLS = &tls.Config{ ClientAuth: tls.RequireAnyClientCert }
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	template := &x509.Certificate{ SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour) }
+	certificate, err := x509.CreateCertificate(cryptorand.Reader, template, template, &key.PublicKey, key)
+	if err != nil { t.Fatal(err) }
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	announce := &CreateOptions{ Announce: [][]string{ { server.URL + "/announce" } } }
+	client := NewClient()
+	torr := createTestTorrent(t, client, createTestFiles(t, []int{ 10 }), announce)
+	_, err = torr.CallTracker(client.NewTrackerQuery(torr, ""))
+	if err == nil { t.Error("Expected an unknown authority error") }
+
+	config := NewClientConfig()
+	config.TLSConfig = &tls.Config{
+		RootCAs: roots,
+		Certificates: []tls.Certificate{ { Certificate: [][]byte{ certificate }, PrivateKey: key } },
+		ServerName: "example.com",
+	}
+	client, _ = NewClientWithConfig(config)
+	torr = createTestTorrent(t, client, createTestFiles(t, []int{ 10 }), announce)
+	_, err = torr.CallTracker(client.NewTrackerQuery(torr, ""))
+	if err != nil { t.Error(err) }
+}
+
 func Test_TotalFileSize(t *testing.T) {
-	go startTestServer()
+	startTestServer()
 	
 	type TotalFileSizeTest struct {
 		url string
@@ -141,7 +452,7 @@ func Test_TotalFileSize(t *testing.T) {
 }
 
 func Test_IsSingleFile(t *testing.T) {
-	go startTestServer()
+	startTestServer()
 	
 	type IsSingleFileTest struct {
 		url string
@@ -164,7 +475,7 @@ func Test_IsSingleFile(t *testing.T) {
 }
 
 func Test_SelectedFileIndexes(t *testing.T) {
-	go startTestServer()
+	startTestServer()
 	
 	type SelectedFileIndexesTest struct {
 		url string
@@ -199,4 +510,1410 @@ func Test_SelectedFileIndexes(t *testing.T) {
 		err = torr.SetSelectedFileIndexes([]int{0,0,0})
 		if err != ErrFileSelectionDuplicateIndex { t.Errorf("Expected \"%s\", got \"%s\"", ErrFileSelectionDuplicateIndex, err) }
 	}
-}
\ No newline at end of file
+}
+
+func Test_ValidateMetaInfo(t *testing.T) {
+	type ValidateMetaInfoTest struct {
+		input string
+		err error
+	}
+
+	var tests = []ValidateMetaInfoTest{
+		{ "d4:infod6:lengthi10e4:name1:a12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaaee", nil },
+		{ "d4:infod5:filesld6:lengthi10e4:pathl1:aeee4:name1:a12:piece lengthi16384e6:pieces0:ee", nil },
+		{ "de", bencoding.ErrKeyNotFound },
+		{ "d4:infoi1ee", bencoding.ErrUnexpectedType },
+		{ "d4:infod4:name1:a12:piece lengthi16384e6:pieces0:ee", bencoding.ErrKeyNotFound },
+		{ "d4:infod6:lengthi10e4:name1:a12:piece lengthi0e6:pieces0:ee", ErrInvalidMetaInfo },
+		{ "d4:infod6:lengthi10e4:name1:a12:piece lengthi16384e6:pieces3:abcee", bencoding.ErrInvalidLength },
+		{ "d4:infod5:filesld4:pathl1:aeee4:name1:a12:piece lengthi16384e6:pieces0:ee", bencoding.ErrKeyNotFound },
+		{ "d4:infod5:filesle4:name1:a12:piece lengthi16384e6:pieces0:ee", ErrInvalidMetaInfo },
+	}
+
+	for _, d := range tests {
+		metaInfo, err := bencoding.Decode([]byte(d.input))
+		if err != nil { t.Fatal("Invalid input string:", d.input) }
+		err = validateMetaInfo(metaInfo)
+		if !errors.Is(err, d.err) { t.Errorf("Expected error '%v', got error '%v' for input '%s'", d.err, err, d.input) }
+	}
+}
+
+func Test_TorrentWithoutMetaInfo(t *testing.T) {
+	client := NewClient()
+	torr := client.NewTorrent("http://localhost:8080/does-not-exist.torrent")
+	if torr.TotalFileSize() != 0 { t.Errorf("Expected 0, got %d", torr.TotalFileSize()) }
+	if !torr.IsSingleFile() { t.Error("Expected single file when there is no meta info") }
+	_, err := torr.CallTracker(client.NewTrackerQuery(torr, ""))
+	if err != ErrNoTracker { t.Errorf("Expected error '%s', got error '%v'", ErrNoTracker, err) }
+}
+
+// createTestFiles creates a directory with a few files of random content and
+// returns the path of that directory.
+func createTestFiles(t *testing.T, sizes []int) string {
+	root := filepath.Join(t.TempDir(), "data")
+	random := rand.New(rand.NewSource(1))
+	for i, size := range sizes {
+		path := filepath.Join(root, "dir" + string(rune('a' + i % 2)), "file" + string(rune('0' + i)))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		data := make([]byte, size)
+		random.Read(data)
+		err := ioutil.WriteFile(path, data, 0644)
+		if err != nil { t.Fatal(err) }
+	}
+	return root
+}
+
+// createTestTorrent creates a torrent from the given path and loads it.
+func createTestTorrent(t *testing.T, client *Client, path string, options *CreateOptions) *Torrent {
+	metaInfo, err := CreateMetaInfo(path, options)
+	if err != nil { t.Fatal("Cannot create meta info:", err) }
+	data, err := bencoding.Encode(metaInfo)
+	if err != nil { t.Fatal("Cannot encode meta info:", err) }
+	torr := client.NewTorrent(path)
+	err = torr.LoadMetaInfo(data)
+	if err != nil { t.Fatal("Cannot load meta info:", err) }
+	return torr
+}
+
+func Test_CreateMetaInfo(t *testing.T) {
+	sizes := []int{ 40000, 0, 16384, 100 }
+	root := createTestFiles(t, sizes)
+	client := NewClient()
+	torr := createTestTorrent(t, client, root, &CreateOptions{ PieceLength: 16384, Announce: [][]string{ { "http://a/announce", "http://b/announce" }, { "http://c/announce" } } })
+
+	if torr.Name() != "data" { t.Errorf("Expected \"data\", got \"%s\"", torr.Name()) }
+	if torr.FileCount() != 4 { t.Errorf("Expected 4 files, got %d", torr.FileCount()) }
+	if torr.TotalFileSize() != 56484 { t.Errorf("Expected 56484, got %d", torr.TotalFileSize()) }
+	if torr.PieceCount() != 4 { t.Errorf("Expected 4 pieces, got %d", torr.PieceCount()) }
+	if torr.PieceSize(3) != 56484 - 3 * 16384 { t.Errorf("Unexpected last piece size: %d", torr.PieceSize(3)) }
+
+	files := torr.Files()
+	// Files are sorted by path: dira/file0, dira/file2, dirb/file1, dirb/file3
+	if filepath.Join(files[1].Path...) != filepath.Join("data", "dira", "file2") { t.Errorf("Unexpected path: %v", files[1].Path) }
+	if files[1].Offset != 40000 { t.Errorf("Expected offset 40000, got %d", files[1].Offset) }
+	if files[3].Offset != 56384 { t.Errorf("Expected offset 56384, got %d", files[3].Offset) }
+
+	trackers := torr.Trackers()
+	if len(trackers) != 2 || len(trackers[0]) != 2 || trackers[1][0] != "http://c/announce" { t.Errorf("Unexpected trackers: %v", trackers) }
+
+	storage := NewFileStorage(torr, filepath.Dir(root))
+	defer storage.Close()
+	have, err := torr.Verify(storage, nil)
+	if err != nil { t.Fatal("Expected no error, got", err) }
+	if have.Count() != 4 { t.Errorf("Expected 4 valid pieces, got %d", have.Count()) }
+
+	single := createTestTorrent(t, client, filepath.Join(root, "dira", "file0"), &CreateOptions{})
+	if !single.IsSingleFile() || single.TotalFileSize() != 40000 || single.Name() != "file0" { t.Error("Unexpected single file torrent") }
+}
+
+func Test_VerifyMissingData(t *testing.T) {
+	root := createTestFiles(t, []int{ 40000, 30000 })
+	client := NewClient()
+	torr := createTestTorrent(t, client, root, &CreateOptions{ PieceLength: 16384 })
+
+	os.Remove(filepath.Join(root, "dirb", "file1"))
+	data, _ := ioutil.ReadFile(filepath.Join(root, "dira", "file0"))
+	data[0]++
+	ioutil.WriteFile(filepath.Join(root, "dira", "file0"), data, 0644)
+
+	storage := NewFileStorage(torr, filepath.Dir(root))
+	defer storage.Close()
+	have, err := torr.Verify(storage, nil)
+	if err != nil { t.Fatal("Expected no error, got", err) }
+	expected := []bool{ false, true, false, false, false }
+	for i, e := range expected {
+		if have.Has(i) != e { t.Errorf("Piece %d: expected %v, got %v", i, e, have.Has(i)) }
+	}
+}
+
+func Test_DownloadFromSeeder(t *testing.T) {
+	root := createTestFiles(t, []int{ 100000, 0, 70000, 5 })
+	for _, version := range []TorrentVersion{ TorrentV1, TorrentV2, TorrentHybrid } {
+		t.Run(version.String(), func(t *testing.T) {
+			options := &CreateOptions{ PieceLength: 32768, Version: version }
+			seederClient := NewClient()
+			seederTorrent := createTestTorrent(t, seederClient, root, options)
+			seederStorage := NewFileStorage(seederTorrent, filepath.Dir(root))
+			defer seederStorage.Close()
+			have, _ := seederTorrent.Verify(seederStorage, nil)
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil { t.Fatal(err) }
+			seeder := seederClient.NewSeeder(seederTorrent, seederStorage, have)
+			go seeder.Serve(listener)
+			defer seeder.Close()
+
+			leecherClient := NewClient()
+			leecherTorrent := createTestTorrent(t, leecherClient, root, options)
+			downloadDir := t.TempDir()
+			leecherStorage := NewFileStorage(leecherTorrent, downloadDir)
+			defer leecherStorage.Close()
+
+			downloader := leecherClient.NewDownloader(leecherTorrent, leecherStorage, nil)
+			downloader.AddPeers([]*net.TCPAddr{ listener.Addr().(*net.TCPAddr) })
+			err = downloader.Run()
+			if err != nil { t.Fatal("Expected no error, got", err) }
+			leecherStorage.CreateFiles()
+
+			// Hybrid pieces include the padding between files.
+			expectedBytes := 170005
+			if version == TorrentHybrid { expectedBytes = 229381 }
+			progress := downloader.Progress()
+			if progress.CompletedBytes != expectedBytes || progress.CompletedPieces != progress.WantedPieces { t.Errorf("Unexpected progress: %+v", progress) }
+
+			for _, file := range []string{ "dira/file0", "dirb/file1", "dira/file2", "dirb/file3" } {
+				expected, _ := ioutil.ReadFile(filepath.Join(root, file))
+				output, err := ioutil.ReadFile(filepath.Join(downloadDir, "data", file))
+				if err != nil { t.Errorf("Cannot read downloaded file %s: %s", file, err); continue }
+				if !bytes.Equal(expected, output) { t.Errorf("Downloaded file %s differs from original", file) }
+			}
+		})
+	}
+}
+
+func Test_MerkleTree(t *testing.T) {
+	leaves := [][]byte{ zeroHash, zeroHash, zeroHash }
+	for i, _ := range leaves {
+		hash := sha256.Sum256([]byte{ byte(i) })
+		leaves[i] = hash[:]
+	}
+	expected := hashPair(hashPair(leaves[0], leaves[1]), hashPair(leaves[2], zeroHash))
+	if !bytes.Equal(merkleRoot(leaves, 4, zeroHash), expected) { t.Error("Unexpected merkle root") }
+	if !bytes.Equal(padHash(2), merkleRoot(nil, 4, zeroHash)) { t.Error("Unexpected pad hash") }
+
+	// The root from the piece layer matches the root from the blocks.
+	data := make([]byte, 5 * merkleBlockSize + 100)
+	rand.New(rand.NewSource(1)).Read(data)
+	pieceLength := 2 * merkleBlockSize
+	var layer [][]byte
+	for start := 0; start < len(data); start += pieceLength {
+		layer = append(layer, pieceLayerHash(data[start : min(start + pieceLength, len(data))], pieceLength))
+	}
+	root := piecesRoot(layer, nil, pieceLength)
+	if !bytes.Equal(root, piecesRoot(nil, blockHashes(data), pieceLength)) { t.Error("Expected the same root from the piece layer and from the blocks") }
+
+	layers := merkleLayers(layer, pieceLength)
+	if !bytes.Equal(layers[len(layers) - 1][0], root) { t.Error("Expected the last layer to be the root") }
+	proof := [][]byte{ layers[0][3], layers[1][0] }
+	if !verifyMerkleProof(root, 2, layer[2:3], proof) { t.Error("Expected a valid proof") }
+	if verifyMerkleProof(root, 1, layer[2:3], proof) { t.Error("Expected an invalid proof at the wrong index") }
+}
+
+func Test_TorrentVersions(t *testing.T) {
+	root := createTestFiles(t, []int{ 100000, 0, 70000, 5 })
+	client := NewClient()
+	for _, version := range []TorrentVersion{ TorrentV2, TorrentHybrid } {
+		torr := createTestTorrent(t, client, root, &CreateOptions{ PieceLength: 32768, Version: version })
+		if torr.Version() != version { t.Errorf("Expected version %s, got %s", version, torr.Version()) }
+		if len(torr.InfoHash()) != 20 || len(torr.InfoHashV2()) != 32 { t.Errorf("Unexpected info hash lengths for %s", version) }
+		if version == TorrentV2 && !bytes.Equal(torr.InfoHash(), torr.InfoHashV2()[:20]) { t.Error("Expected the truncated v2 info hash on the wire") }
+		if torr.FileCount() != 4 || torr.TotalFileSize() != 170005 { t.Errorf("Unexpected files for %s: %+v", version, torr.Files()) }
+		files := torr.Files()
+		if filepath.Join(files[1].Path...) != filepath.Join("data", "dira", "file2") || files[1].Offset != 131072 { t.Errorf("Expected the second file aligned on a piece, got %+v", files[1]) }
+		if torr.PieceCount() != 8 { t.Errorf("Expected 8 pieces, got %d", torr.PieceCount()) }
+
+		storage := NewFileStorage(torr, filepath.Dir(root))
+		have, err := torr.Verify(storage, nil)
+		storage.Close()
+		if err != nil || have.Count() != torr.PieceCount() { t.Errorf("Expected all pieces valid for %s, got %d (%v)", version, have.Count(), err) }
+	}
+
+	single := createTestTorrent(t, client, filepath.Join(root, "dira", "file0"), &CreateOptions{ Version: TorrentV2 })
+	if !single.IsSingleFile() || single.Name() != "file0" || single.TotalFileSize() != 100000 { t.Error("Unexpected single file v2 torrent") }
+
+	_, err := CreateMetaInfo(root, &CreateOptions{ PieceLength: 40000, Version: TorrentV2 })
+	if err != ErrInvalidPieceLength { t.Errorf("Expected error '%s', got error '%v'", ErrInvalidPieceLength, err) }
+
+	// A hybrid whose layouts disagree is rejected.
+	metaInfo, _ := CreateMetaInfo(root, &CreateOptions{ PieceLength: 32768, Version: TorrentHybrid })
+	metaInfo.Set(bencoding.NewInt(99999), "info", "files", 0, "length")
+	data, _ := bencoding.Encode(metaInfo)
+	err = client.NewTorrent("").LoadMetaInfo(data)
+	if err != ErrInvalidMetaInfo { t.Errorf("Expected error '%s', got error '%v'", ErrInvalidMetaInfo, err) }
+}
+
+func Test_HashRequest(t *testing.T) {
+	root := createTestFiles(t, []int{ 200000 })
+	client := NewClient()
+	torr := createTestTorrent(t, client, root, &CreateOptions{ PieceLength: 32768, Version: TorrentV2 })
+	storage := NewFileStorage(torr, filepath.Dir(root))
+	defer storage.Close()
+	have, _ := torr.Verify(storage, nil)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	seeder := client.NewSeeder(torr, storage, have)
+	go seeder.Serve(listener)
+	defer seeder.Close()
+
+	conn, err := DialPeer(listener.Addr().String(), torr.InfoHash(), GeneratePeerId(), time.Second)
+	if err != nil { t.Fatal(err) }
+	defer conn.Close()
+
+	piecesRoot := torr.Files()[0].PiecesRoot
+	readReply := func(request *HashRequest) *PeerMessage {
+		err := conn.WriteHashRequest(request)
+		if err != nil { t.Fatal(err) }
+		for {
+			message, err := conn.ReadMessage()
+			if err != nil { t.Fatal(err) }
+			if message != nil && (message.Id == MsgHashes || message.Id == MsgHashReject) { return message }
+		}
+	}
+
+	// 7 pieces, so a piece layer of 8 hashes and 3 layers above it.
+	message := readReply(&HashRequest{ PiecesRoot: piecesRoot, BaseLayer: 1, Index: 4, Length: 2, ProofLayers: 2 })
+	if message.Id != MsgHashes { t.Fatalf("Expected hashes, got message %d", message.Id) }
+	request, hashes, err := message.ParseHashes()
+	if err != nil || request.Index != 4 || len(hashes) != 4 { t.Fatalf("Unexpected hashes: %+v %d %v", request, len(hashes), err) }
+	if !verifyMerkleProof(piecesRoot, 4, hashes[:2], hashes[2:]) { t.Error("Expected the hashes to lead to the pieces root") }
+
+	message = readReply(&HashRequest{ PiecesRoot: zeroHash, BaseLayer: 1, Index: 0, Length: 2 })
+	if message.Id != MsgHashReject { t.Errorf("Expected a hash reject, got message %d", message.Id) }
+	request, err = message.ParseHashRequest()
+	if err != nil || !bytes.Equal(request.PiecesRoot, zeroHash) { t.Errorf("Unexpected rejected request: %+v %v", request, err) }
+}
+
+func Test_AllowedFastSet(t *testing.T) {
+	// Example of BEP 6.
+	infoHash := bytes.Repeat([]byte{ 0xaa }, 20)
+	output := allowedFastSet(net.ParseIP("80.4.4.200"), infoHash, 1313, 9)
+	expected := []int{ 1059, 431, 808, 1217, 287, 376, 1188, 353, 508 }
+	if !slices.Equal(output, expected) { t.Errorf("Expected %v, got %v", expected, output) }
+	if len(allowedFastSet(net.ParseIP("::1"), infoHash, 1313, 9)) != 0 { t.Error("Expected no set for IPv6 addresses") }
+	if len(allowedFastSet(net.ParseIP("80.4.4.200"), infoHash, 3, 9)) != 3 { t.Error("Expected the set limited to the piece count") }
+}
+
+func Test_FastExtension(t *testing.T) {
+	root := createTestFiles(t, []int{ 100000, 30000 })
+	client := NewClient()
+	torr := createTestTorrent(t, client, root, &CreateOptions{ PieceLength: 32768 })
+	storage := NewFileStorage(torr, filepath.Dir(root))
+	defer storage.Close()
+
+	// A seeder rejects the requests for pieces it doesn't have.
+	have := NewBitfield(torr.PieceCount())
+	for _, index := range allowedFastSet(net.ParseIP("127.0.0.1"), torr.InfoHash(), torr.PieceCount(), allowedFastCount)[1:] {
+		have.Set(index)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	seeder := client.NewSeeder(torr, storage, have)
+	go seeder.Serve(listener)
+	defer seeder.Close()
+	conn, err := DialPeer(listener.Addr().String(), torr.InfoHash(), GeneratePeerId(), time.Second)
+	if err != nil { t.Fatal(err) }
+	defer conn.Close()
+	if !conn.SupportsFast() { t.Fatal("Expected the Fast extension to be enabled") }
+	message, err := conn.ReadMessage()
+	if err != nil || message.Id != MsgBitfield { t.Fatalf("Expected a bitfield, got %v, %v", message, err) }
+	for i := 0; i < have.Count(); i++ {
+		message, err = conn.ReadMessage()
+		if err != nil || message.Id != MsgAllowedFast { t.Fatalf("Expected allowed fast, got %v, %v", message, err) }
+		index, _ := message.ParseHave()
+		if !have.Has(index) { t.Errorf("Unexpected allowed fast piece %d", index) }
+	}
+	missing := 0
+	for have.Has(missing) { missing++ }
+	conn.WriteRequest(missing, 0, BlockSize)
+	message, err = conn.ReadMessage()
+	if err != nil || message.Id != MsgRejectRequest { t.Fatalf("Expected a reject, got %v, %v", message, err) }
+	index, begin, length, _ := message.ParseRequest()
+	if index != missing || begin != 0 || length != BlockSize { t.Errorf("Unexpected reject %d %d %d", index, begin, length) }
+
+	// A downloader requests the suggested piece first and the allowed fast
+	// pieces while choked. The requests rejected when it gets choked are
+	// made again after it gets unchoked.
+	peerListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	defer peerListener.Close()
+	last := torr.PieceCount() - 1
+	errors := make(chan error, 1)
+	go func() {
+		netConn, err := peerListener.Accept()
+		if err != nil { errors <- err; return }
+		peer, _, err := AcceptPeer(netConn, GeneratePeerId(), func([]byte) bool { return true }, time.Second)
+		if err != nil { errors <- err; return }
+		defer peer.Close()
+		peer.WriteHaveAll()
+		peer.WriteSuggestPiece(last)
+		for i := last; i > 0; i-- {
+			peer.WriteAllowedFast(i)
+		}
+
+		served := 0
+		var unchoked atomic.Bool
+		choked := false
+		for {
+			message, err := peer.ReadMessage()
+			if err != nil { errors <- nil; return }
+			if message == nil || message.Id != MsgRequest { continue }
+			index, begin, length, _ := message.ParseRequest()
+			if served == 0 && index != last { errors <- fmt.Errorf("Expected the suggested piece first, got %d", index); return }
+			if index == 0 && !unchoked.Load() {
+				if !choked {
+					choked = true
+					peer.WriteMessage(MsgChoke, nil)
+					time.AfterFunc(100 * time.Millisecond, func() {
+						unchoked.Store(true)
+						peer.WriteMessage(MsgUnchoke, nil)
+					})
+				}
+				peer.WriteRejectRequest(index, begin, length)
+				continue
+			}
+			block := make([]byte, length)
+			storage.ReadAt(block, int64(index * torr.PieceLength() + begin))
+			peer.WritePiece(index, begin, block)
+			served++
+			if served == 2 * last { peer.WriteMessage(MsgUnchoke, nil) }
+		}
+	}()
+
+	leecherClient := NewClient()
+	leecherClient.SetEncryptionPolicy(EncryptionDisabled)
+	leecherTorrent := createTestTorrent(t, leecherClient, root, &CreateOptions{ PieceLength: 32768 })
+	leecherStorage := NewFileStorage(leecherTorrent, t.TempDir())
+	defer leecherStorage.Close()
+	downloader := leecherClient.NewDownloader(leecherTorrent, leecherStorage, nil)
+	downloader.AddPeers([]*net.TCPAddr{ peerListener.Addr().(*net.TCPAddr) })
+	err = downloader.Run()
+	if err != nil { t.Fatal("Expected no error, got", err) }
+	err = <-errors
+	if err != nil { t.Error(err) }
+	if progress := downloader.Progress(); progress.CompletedPieces != torr.PieceCount() { t.Errorf("Unexpected progress: %+v", progress) }
+}
+
+func Test_DownloadSelectedFiles(t *testing.T) {
+	root := createTestFiles(t, []int{ 98304, 70000, 32768 })
+	seederClient := NewClient()
+	seederTorrent := createTestTorrent(t, seederClient, root, &CreateOptions{ PieceLength: 32768 })
+	seederStorage := NewFileStorage(seederTorrent, filepath.Dir(root))
+	defer seederStorage.Close()
+	have, _ := seederTorrent.Verify(seederStorage, nil)
+
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	seeder := seederClient.NewSeeder(seederTorrent, seederStorage, have)
+	go seeder.Serve(listener)
+	defer seeder.Close()
+
+	leecherClient := NewClient()
+	leecherTorrent := createTestTorrent(t, leecherClient, root, &CreateOptions{ PieceLength: 32768 })
+	// Files are sorted by path: dira/file0, dira/file2, dirb/file1
+	leecherTorrent.SetSelectedFileIndexes([]int{ 1 })
+	downloadDir := t.TempDir()
+	leecherStorage := NewFileStorage(leecherTorrent, downloadDir)
+	defer leecherStorage.Close()
+
+	downloader := leecherClient.NewDownloader(leecherTorrent, leecherStorage, nil)
+	downloader.AddPeers([]*net.TCPAddr{ listener.Addr().(*net.TCPAddr) })
+	err := downloader.Run()
+	if err != nil { t.Fatal("Expected no error, got", err) }
+
+	// dira/file2 is exactly piece 3.
+	progress := downloader.Progress()
+	if progress.WantedPieces != 1 || progress.CompletedPieces != 1 { t.Errorf("Unexpected progress: %+v", progress) }
+
+	expected, _ := ioutil.ReadFile(filepath.Join(root, "dira", "file2"))
+	output, _ := ioutil.ReadFile(filepath.Join(downloadDir, "data", "dira", "file2"))
+	if !bytes.Equal(expected, output) { t.Error("Downloaded file differs from original") }
+	for _, file := range []string{ "dira/file0", "dirb/file1" } {
+		_, err = os.Stat(filepath.Join(downloadDir, "data", file))
+		if err == nil { t.Errorf("Unselected file %s should not have been created", file) }
+	}
+}
+
+func Test_DownloadWithoutPeers(t *testing.T) {
+	root := createTestFiles(t, []int{ 1000 })
+	client := NewClient()
+	torr := createTestTorrent(t, client, root, &CreateOptions{})
+	storage := NewFileStorage(torr, t.TempDir())
+	defer storage.Close()
+	err := client.NewDownloader(torr, storage, nil).Run()
+	if err != ErrNoPeers { t.Errorf("Expected error '%s', got error '%v'", ErrNoPeers, err) }
+}
+
+func Test_Events(t *testing.T) {
+	root := createTestFiles(t, []int{ 100000, 0, 70000, 5 })
+	seederClient := NewClient()
+	seederTorrent := createTestTorrent(t, seederClient, root, &CreateOptions{ PieceLength: 32768 })
+	seederStorage := NewFileStorage(seederTorrent, filepath.Dir(root))
+	defer seederStorage.Close()
+	have, _ := seederTorrent.Verify(seederStorage, nil)
+
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	seeder := seederClient.NewSeeder(seederTorrent, seederStorage, have)
+	go seeder.Serve(listener)
+	defer seeder.Close()
+
+	leecherClient := NewClient()
+	leecherTorrent := createTestTorrent(t, leecherClient, root, &CreateOptions{ PieceLength: 32768 })
+	var mutex sync.Mutex
+	counts := make(map[EventType]int)
+	completedFiles := make(map[int]bool)
+	unsubscribe := leecherTorrent.Subscribe(func(event *Event) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		counts[event.Type]++
+		if event.Type == EventFileCompleted { completedFiles[event.FileIndex] = true }
+		if event.Torrent != leecherTorrent { t.Error("Unexpected torrent in event") }
+	})
+
+	data, _ := bencoding.Encode(leecherTorrent.MetaInfo())
+	leecherTorrent.LoadMetaInfo(data)
+
+	leecherStorage := NewFileStorage(leecherTorrent, t.TempDir())
+	defer leecherStorage.Close()
+	downloader := leecherClient.NewDownloader(leecherTorrent, leecherStorage, nil)
+	downloader.AddPeers([]*net.TCPAddr{ listener.Addr().(*net.TCPAddr) })
+	err := downloader.Run()
+	if err != nil { t.Fatal("Expected no error, got", err) }
+	unsubscribe()
+	leecherTorrent.LoadMetaInfo(data)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if counts[EventMetaInfoReceived] != 1 { t.Errorf("Expected 1 meta info event, got %d", counts[EventMetaInfoReceived]) }
+	if counts[EventPeerConnected] != 1 { t.Errorf("Expected 1 peer connected event, got %d", counts[EventPeerConnected]) }
+	if counts[EventPieceVerified] != leecherTorrent.PieceCount() { t.Errorf("Expected %d piece verified events, got %d", leecherTorrent.PieceCount(), counts[EventPieceVerified]) }
+	if counts[EventTorrentCompleted] != 1 { t.Errorf("Expected 1 torrent completed event, got %d", counts[EventTorrentCompleted]) }
+	// The empty file dirb/file1 (index 2) has no piece to complete.
+	if len(completedFiles) != 3 || completedFiles[2] { t.Errorf("Unexpected completed files: %v", completedFiles) }
+
+	// Once unsubscribed, a channel receives no event, even from deliveries
+	// that were under way.
+	events, unsubscribeChannel := leecherTorrent.SubscribeChannel(1000)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			leecherTorrent.emitPeerEvent(EventPeerConnected, nil)
+		}
+	}()
+	time.Sleep(time.Millisecond)
+	unsubscribeChannel()
+	received := len(events)
+	<-done
+	if len(events) != received { t.Errorf("Expected %d events, got %d", received, len(events)) }
+}
+
+func Test_Stats(t *testing.T) {
+	root := createTestFiles(t, []int{ 100000, 0, 70000, 5 })
+	seederClient := NewClient()
+	seederTorrent := createTestTorrent(t, seederClient, root, &CreateOptions{ PieceLength: 32768 })
+	seederStorage := NewFileStorage(seederTorrent, filepath.Dir(root))
+	defer seederStorage.Close()
+	have, _ := seederTorrent.Verify(seederStorage, nil)
+
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	seeder := seederClient.NewSeeder(seederTorrent, seederStorage, have)
+	go seeder.Serve(listener)
+	defer seeder.Close()
+	if seederTorrent.LeftSize() != 0 { t.Errorf("Expected nothing left for the seeder, got %d", seederTorrent.LeftSize()) }
+
+	leecherClient := NewClient()
+	leecherTorrent := createTestTorrent(t, leecherClient, root, &CreateOptions{ PieceLength: 32768 })
+	leecherTorrent.RestoreStats(1000, 2000)
+	if leecherTorrent.LeftSize() != 170005 { t.Errorf("Expected 170005 left, got %d", leecherTorrent.LeftSize()) }
+	leecherStorage := NewFileStorage(leecherTorrent, t.TempDir())
+	defer leecherStorage.Close()
+	downloader := leecherClient.NewDownloader(leecherTorrent, leecherStorage, nil)
+	downloader.AddPeers([]*net.TCPAddr{ listener.Addr().(*net.TCPAddr) })
+	err := downloader.Run()
+	if err != nil { t.Fatal("Expected no error, got", err) }
+
+	stats := leecherTorrent.Stats()
+	if stats.Downloaded != 170005 || stats.TotalDownloaded != 171005 || stats.TotalUploaded != 2000 || stats.Wasted != 0 { t.Errorf("Unexpected stats: %+v", stats) }
+	if stats.Left != 0 || stats.ETA != 0 || stats.KnownPeers != 1 || stats.HalfOpenPeers != 0 { t.Errorf("Unexpected stats: %+v", stats) }
+	if stats.DownloadRate <= 0 { t.Errorf("Expected a download rate, got %f", stats.DownloadRate) }
+	for _, file := range stats.Files {
+		if file.Completed != file.Length { t.Errorf("Unexpected file progress: %+v", file) }
+	}
+	if leecherTorrent.DownloadedSize() != 170005 { t.Errorf("Expected 170005, got %d", leecherTorrent.DownloadedSize()) }
+	if leecherClient.Stats().Downloaded != 170005 { t.Errorf("Unexpected client stats: %+v", leecherClient.Stats()) }
+
+	// The seeder counts the last block after sending it, possibly after the
+	// leecher has returned.
+	for i := 0; i < 100 && seederTorrent.UploadedSize() != 170005; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if seederTorrent.UploadedSize() != 170005 { t.Errorf("Expected 170005 uploaded, got %d", seederTorrent.UploadedSize()) }
+}
+
+func Test_RateMeter(t *testing.T) {
+	var meter rateMeter
+	now := time.Unix(1000, 0)
+	if meter.rate(now) != 0 { t.Error("Expected no rate") }
+	meter.add(1000, now)
+	meter.add(1000, now.Add(500 * time.Millisecond))
+	if meter.rate(now.Add(900 * time.Millisecond)) != 2000 { t.Errorf("Expected 2000, got %f", meter.rate(now)) }
+	meter.add(2000, now.Add(time.Second))
+	if meter.rate(now.Add(time.Second)) != 2000 { t.Errorf("Expected 2000, got %f", meter.rate(now.Add(time.Second))) }
+	if meter.rate(now.Add(5 * time.Second)) != 4000.0 / 6 { t.Errorf("Expected %f, got %f", 4000.0 / 6, meter.rate(now.Add(5 * time.Second))) }
+	if meter.rate(now.Add(10 * time.Second)) != 2000.0 / 10 { t.Errorf("Expected 200, got %f", meter.rate(now.Add(10 * time.Second))) }
+	if meter.rate(now.Add(30 * time.Second)) != 0 { t.Error("Expected the rate to drop to 0") }
+}
+
+func Test_Availability(t *testing.T) {
+	full := Bitfield{ 0xf0 }
+	half := Bitfield{ 0xc0 }
+	peers := map[*PeerConn]Bitfield{ &PeerConn{}: full, &PeerConn{}: half, &PeerConn{}: full }
+	if availability(peers, 4) != 2.5 { t.Errorf("Expected 2.5, got %f", availability(peers, 4)) }
+}
+
+func Test_TrackerPeers6(t *testing.T) {
+	compact6 := string(net.ParseIP("2001:db8::1")) + "\x1a\xe1"
+	tests := []struct {
+		response string
+		expected []string
+	}{
+		{ "d5:peers6:\x7f\x00\x00\x01\x1a\xe16:peers618:" + compact6 + "e", []string{ "127.0.0.1:6881", "[2001:db8::1]:6881" } },
+		{ "d6:peers618:" + compact6 + "e", []string{ "[2001:db8::1]:6881" } },
+		{ "d5:peersld2:ip11:2001:db8::24:porti80eeee", []string{ "[2001:db8::2]:80" } },
+	}
+	for _, test := range tests {
+		response, err := bencoding.Decode([]byte(test.response))
+		if err != nil { t.Fatal(err) }
+		peers, err := TrackerPeers(response)
+		if err != nil { t.Errorf("Expected no error, got %v", err); continue }
+		var output []string
+		for _, peer := range peers {
+			output = append(output, peerAddress(peer))
+		}
+		if !slices.Equal(output, test.expected) { t.Errorf("Expected %v, got %v", test.expected, output) }
+	}
+
+	response, _ := bencoding.Decode([]byte("d6:peers65:abcdee"))
+	_, err := TrackerPeers(response)
+	if err == nil { t.Error("Expected an error for a truncated peers6") }
+}
+
+func Test_ExternalAddresses(t *testing.T) {
+	client := NewClient()
+	client.SetExternalAddresses(net.ParseIP("203.0.113.5"), net.ParseIP("2001:db8::5"))
+	torr := createTestTorrent(t, client, createTestFiles(t, []int{ 10 }), &CreateOptions{})
+	query := client.NewTrackerQuery(torr, "")
+	if query["ipv4"] != "203.0.113.5" || query["ipv6"] != "2001:db8::5" { t.Errorf("Unexpected addresses %q %q", query["ipv4"], query["ipv6"]) }
+
+	client.SetExternalAddresses(nil, nil)
+	query = client.NewTrackerQuery(torr, "")
+	if _, ok := query["ipv6"]; ok { t.Error("Expected no ipv6 parameter") }
+}
+
+func Test_DualStack(t *testing.T) {
+	tests := []struct {
+		local string
+		address string
+		expected bool
+	}{
+		{ "[::]:6881", "127.0.0.1:1", true },
+		{ "[::]:6881", "[::1]:1", true },
+		{ "127.0.0.1:6881", "[::1]:1", false },
+		{ "0.0.0.0:6881", "[::1]:1", false },
+		{ "[::1]:6881", "127.0.0.1:1", false },
+		{ "127.0.0.1:6881", "10.0.0.1:1", true },
+	}
+	for _, test := range tests {
+		local, _ := net.ResolveUDPAddr("udp", test.local)
+		if canReach(local, test.address) != test.expected { t.Errorf("Expected %v from %s to %s", test.expected, test.local, test.address) }
+	}
+
+	probe, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil { t.Skip("IPv6 is not available:", err) }
+	probe.Close()
+
+	root := createTestFiles(t, []int{ 10000 })
+	client := NewClient()
+	err = client.Listen(":0")
+	if err != nil { t.Fatal(err) }
+	defer client.Close()
+	torr := createTestTorrent(t, client, root, &CreateOptions{})
+	client.AddTorrent(torr, filepath.Dir(root))
+	waitForState(t, client, torr, StateSeeding)
+
+	port := strconv.Itoa(client.Port())
+	for _, address := range []string{ "127.0.0.1:" + port, "[::1]:" + port } {
+		conn, err := DialPeer(address, torr.InfoHash(), GeneratePeerId(), time.Second)
+		if err != nil { t.Errorf("Cannot connect to %s: %v", address, err); continue }
+		conn.Close()
+	}
+}
+
+func Test_TrackerFailureReason(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason17:torrent not founde"))
+	}))
+	defer server.Close()
+
+	root := createTestFiles(t, []int{ 1000 })
+	client := NewClient()
+	torr := createTestTorrent(t, client, root, &CreateOptions{ Announce: [][]string{ { server.URL + "/announce" } } })
+	events, unsubscribe := torr.SubscribeChannel(10)
+	defer unsubscribe()
+
+	_, err := torr.CallTracker(client.NewTrackerQuery(torr, "started"))
+	var trackerErr *TrackerError
+	if !errors.As(err, &trackerErr) || !errors.Is(err, ErrTrackerFailure) { t.Fatalf("Expected a tracker failure, got %v", err) }
+	if trackerErr.FailureReason != "torrent not found" { t.Errorf("Unexpected failure reason: %s", trackerErr.FailureReason) }
+
+	event := <-events
+	if event.Type != EventTrackerFailed || event.TrackerUrl != server.URL + "/announce" || event.Err != err { t.Errorf("Unexpected event: %+v", event) }
+}
+
+func Test_TrackerSession(t *testing.T) {
+	var mutex sync.Mutex
+	var queries []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		queries = append(queries, r.URL.Query())
+		mutex.Unlock()
+		w.Write([]byte("d8:intervali60e10:tracker id3:abc5:peers0:e"))
+	}))
+	defer server.Close()
+
+	config := NewClientConfig()
+	config.AnnounceIp = "tracker.example.com"
+	config.NoPeerId = true
+	client, _ := NewClientWithConfig(config)
+	torr := createTestTorrent(t, client, createTestFiles(t, []int{ 10 }), &CreateOptions{ Announce: [][]string{ { server.URL + "/announce" } } })
+	for i := 0; i < 2; i++ {
+		query := client.NewTrackerQuery(torr, "")
+		_, err := torr.CallTracker(query)
+		if err != nil { t.Fatal(err) }
+		if _, ok := query["trackerid"]; ok { t.Error("Expected the query not to be modified") }
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if queries[0].Has("trackerid") || queries[1].Get("trackerid") != "abc" { t.Errorf("Unexpected tracker ids %q %q", queries[0].Get("trackerid"), queries[1].Get("trackerid")) }
+	for _, query := range queries {
+		if len(query.Get("key")) != 8 || query.Get("key") != queries[0].Get("key") { t.Errorf("Unexpected key %q", query.Get("key")) }
+		if query.Get("ip") != "tracker.example.com" || query.Get("no_peer_id") != "1" || query.Get("supportcrypto") != "1" { t.Errorf("Unexpected query %v", query) }
+	}
+
+	client.SetEncryptionPolicy(EncryptionDisabled)
+	if _, ok := client.NewTrackerQuery(torr, "")["supportcrypto"]; ok { t.Error("Expected no supportcrypto parameter") }
+}
+
+func Test_HttpProxy(t *testing.T) {
+	root := createTestFiles(t, []int{ 10 })
+	data, _ := os.ReadFile(filepath.Join(root, "dira", "file0"))
+	var mutex sync.Mutex
+	var requested []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requested = append(requested, r.URL.Host + r.URL.Path)
+		mutex.Unlock()
+		if r.URL.Path == "/announce" {
+			w.Write([]byte("d8:intervali60e5:peers0:e"))
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer proxy.Close()
+
+	config := NewClientConfig()
+	config.Proxy = ProxySettings{ HttpUrl: proxy.URL, Trackers: true, WebSeeds: true }
+	client, err := NewClientWithConfig(config)
+	if err != nil { t.Fatal(err) }
+	torr := createTestTorrent(t, client, root, &CreateOptions{ Announce: [][]string{ { "http://tracker.invalid/announce" } } })
+	_, err = torr.CallTracker(client.NewTrackerQuery(torr, ""))
+	if err != nil { t.Fatal(err) }
+	piece, err := torr.fetchWebSeedPiece(context.Background(), "http://seed.invalid/data", 0)
+	if err != nil || !bytes.Equal(piece, data) { t.Fatalf("Unexpected piece %q: %v", piece, err) }
+
+	mutex.Lock()
+	if !slices.Equal(requested, []string{ "tracker.invalid/announce", "seed.invalid/data/data/dira/file0" }) { t.Errorf("Unexpected proxied requests %v", requested) }
+	mutex.Unlock()
+
+	config.Proxy.WebSeeds = false
+	client, _ = NewClientWithConfig(config)
+	torr = client.NewTorrent("")
+	if torr.httpCallOptions().Proxy == nil || torr.webSeedCallOptions().Proxy != nil { t.Error("Expected only trackers to be proxied") }
+}
+
+// startTestSocks5 starts a SOCKS5 proxy that requires the given credentials,
+// if not empty, and returns its address.
+func startTestSocks5(t *testing.T, username string, password string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	t.Cleanup(func() { listener.Close() })
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		buffer := make([]byte, 512)
+		io.ReadFull(conn, buffer[:2])
+		io.ReadFull(conn, buffer[:buffer[1]])
+		if username == "" {
+			conn.Write([]byte{ 5, 0 })
+		} else {
+			conn.Write([]byte{ 5, 2 })
+			io.ReadFull(conn, buffer[:2])
+			user := make([]byte, buffer[1])
+			io.ReadFull(conn, user)
+			io.ReadFull(conn, buffer[:1])
+			pass := make([]byte, buffer[0])
+			io.ReadFull(conn, pass)
+			if string(user) != username || string(pass) != password {
+				conn.Write([]byte{ 1, 1 })
+				return
+			}
+			conn.Write([]byte{ 1, 0 })
+		}
+		io.ReadFull(conn, buffer[:4])
+		var host string
+		switch buffer[3] {
+			case 1:
+				io.ReadFull(conn, buffer[:4])
+				host = net.IP(buffer[:4]).String()
+			case 3:
+				io.ReadFull(conn, buffer[:1])
+				name := make([]byte, buffer[0])
+				io.ReadFull(conn, name)
+				host = string(name)
+		}
+		io.ReadFull(conn, buffer[:2])
+		target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(buffer[0]) << 8 | int(buffer[1]))))
+		if err != nil {
+			conn.Write([]byte{ 5, 5, 0, 1, 0, 0, 0, 0, 0, 0 })
+			return
+		}
+		defer target.Close()
+		conn.Write([]byte{ 5, 0, 0, 1, 127, 0, 0, 1, 0, 0 })
+		go io.Copy(target, conn)
+		io.Copy(conn, target)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil { return }
+			go serve(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func Test_Socks5Proxy(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil { return }
+			go func() { io.Copy(conn, conn); conn.Close() }()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+
+	config := NewClientConfig()
+	config.Proxy = ProxySettings{ Socks5Address: startTestSocks5(t, "user", "secret"), Socks5Username: "user", Socks5Password: "secret", Peers: true }
+	client, err := NewClientWithConfig(config)
+	if err != nil { t.Fatal(err) }
+	for _, address := range []string{ echo.Addr().String(), "localhost:" + port } {
+		conn, err := client.dial(context.Background(), address, time.Second)
+		if err != nil { t.Errorf("Cannot connect to %s: %v", address, err); continue }
+		conn.Write([]byte("ping"))
+		reply := make([]byte, 4)
+		_, err = io.ReadFull(conn, reply)
+		if err != nil || string(reply) != "ping" { t.Errorf("Unexpected reply %q: %v", reply, err) }
+		conn.Close()
+	}
+
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+	_, err = client.dial(context.Background(), closed.Addr().String(), time.Second)
+	var proxyErr *ProxyError
+	if !errors.As(err, &proxyErr) || proxyErr.Reply != 5 { t.Errorf("Expected a refused connection, got %v", err) }
+
+	config.Proxy.Socks5Password = "wrong"
+	client, _ = NewClientWithConfig(config)
+	_, err = client.dial(context.Background(), echo.Addr().String(), time.Second)
+	if !errors.Is(err, ErrProxyAuthentication) { t.Errorf("Expected an authentication error, got %v", err) }
+}
+
+// testTracker is a tracker that returns a fixed list of peers and records the
+// events it receives.
+type testTracker struct {
+	server *httptest.Server
+	mutex sync.Mutex
+	peers string
+	events []string
+	seeds int // Number of seeds returned by scrapes
+}
+
+func newTestTracker() *testTracker {
+	output := new(testTracker)
+	output.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		output.mutex.Lock()
+		defer output.mutex.Unlock()
+		if r.URL.Path == "/scrape" {
+			infoHash := r.URL.Query().Get("info_hash")
+			w.Write([]byte("d5:filesd20:" + infoHash + "d8:completei" + strconv.Itoa(output.seeds) + "e10:incompletei1eeee"))
+			return
+		}
+		output.events = append(output.events, r.URL.Query().Get("event"))
+		w.Write([]byte("d8:intervali60e5:peers" + strconv.Itoa(len(output.peers)) + ":" + output.peers + "e"))
+	}))
+	return output
+}
+
+func (this *testTracker) announceUrl() string {
+	return this.server.URL + "/announce"
+}
+
+func (this *testTracker) setPeer(addr net.Addr) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	tcpAddr := addr.(*net.TCPAddr)
+	this.peers = string(tcpAddr.IP.To4()) + string([]byte{ byte(tcpAddr.Port >> 8), byte(tcpAddr.Port) })
+}
+
+func (this *testTracker) eventCount(event string) int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	output := 0
+	for _, e := range this.events {
+		if e == event { output++ }
+	}
+	return output
+}
+
+func waitForState(t *testing.T, client *Client, torr *Torrent, expected TorrentState) {
+	t.Helper()
+	var state TorrentState
+	for i := 0; i < 500; i++ {
+		state, _ = client.TorrentState(torr.InfoHash())
+		if state == expected { return }
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected state %s, got %s (%v)", expected, state, client.TorrentError(torr.InfoHash()))
+}
+
+func Test_SessionDownload(t *testing.T) {
+	tracker := newTestTracker()
+	defer tracker.server.Close()
+	root := createTestFiles(t, []int{ 100000, 0, 70000, 5 })
+	options := &CreateOptions{ PieceLength: 32768, Announce: [][]string{ { tracker.announceUrl() } } }
+
+	seederClient := NewClient()
+	err := seederClient.Listen("127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	defer seederClient.Close()
+	tracker.setPeer(seederClient.listener.Addr())
+	seederTorrent := createTestTorrent(t, seederClient, root, options)
+	err = seederClient.AddTorrent(seederTorrent, filepath.Dir(root))
+	if err != nil { t.Fatal(err) }
+	waitForState(t, seederClient, seederTorrent, StateSeeding)
+
+	leecherClient := NewClient()
+	leecherClient.Listen("127.0.0.1:0")
+	defer leecherClient.Close()
+	leecherTorrent := createTestTorrent(t, leecherClient, root, options)
+	leecherTorrent.RestoreStats(1000, 2000)
+	downloadDir := t.TempDir()
+	err = leecherClient.AddTorrent(leecherTorrent, downloadDir)
+	if err != nil { t.Fatal(err) }
+	err = leecherClient.AddTorrent(createTestTorrent(t, leecherClient, root, options), downloadDir)
+	if err != ErrDuplicateTorrent { t.Errorf("Expected error '%s', got error '%v'", ErrDuplicateTorrent, err) }
+	waitForState(t, leecherClient, leecherTorrent, StateSeeding)
+
+	expected, _ := ioutil.ReadFile(filepath.Join(root, "dira", "file2"))
+	output, _ := ioutil.ReadFile(filepath.Join(downloadDir, "data", "dira", "file2"))
+	if !bytes.Equal(expected, output) { t.Error("Downloaded file differs from original") }
+	stats := leecherClient.Stats()
+	if len(leecherClient.Torrents()) != 1 || stats.Downloaded != 170005 { t.Errorf("Unexpected session: %v %+v", leecherClient.Torrents(), stats) }
+	if stats.TotalDownloaded != 171005 || stats.TotalUploaded != stats.Uploaded + 2000 || stats.KnownPeers != 1 { t.Errorf("Unexpected client stats: %+v", stats) }
+}
+
+func Test_EncryptionHandshake(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{ 1 }, 20)
+	otherHash := bytes.Repeat([]byte{ 2 }, 20)
+	tests := []struct {
+		dial EncryptionPolicy
+		accept EncryptionPolicy
+		acceptHash []byte
+		ok bool
+		encrypted bool
+	}{
+		{ EncryptionRequire, EncryptionRequire, infoHash, true, true },
+		{ EncryptionPrefer, EncryptionPrefer, infoHash, true, true },
+		{ EncryptionRequire, EncryptionPrefer, infoHash, true, true },
+		{ EncryptionPrefer, EncryptionRequire, infoHash, true, true },
+		{ EncryptionPrefer, EncryptionDisabled, infoHash, true, false },
+		{ EncryptionDisabled, EncryptionPrefer, infoHash, true, false },
+		{ EncryptionRequire, EncryptionDisabled, infoHash, false, false },
+		{ EncryptionDisabled, EncryptionRequire, infoHash, false, false },
+		{ EncryptionRequire, EncryptionRequire, otherHash, false, false },
+	}
+	for _, test := range tests {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil { t.Fatal(err) }
+		messages := make(chan *PeerMessage, 1)
+		go func() {
+			for {
+				netConn, err := listener.Accept()
+				if err != nil { return }
+				conn, _, err := AcceptPeerEncrypted(netConn, GeneratePeerId(), [][]byte{ otherHash, test.acceptHash }, test.accept, time.Second)
+				if err != nil { netConn.Close(); continue }
+				if conn.Encrypted() != test.encrypted { t.Errorf("%s/%s: expected encrypted %v", test.dial, test.accept, test.encrypted) }
+				message, _ := conn.ReadMessage()
+				messages <- message
+				conn.Close()
+			}
+		}()
+
+		conn, err := DialPeerEncrypted(listener.Addr().String(), infoHash, GeneratePeerId(), test.dial, time.Second)
+		if !test.ok {
+			if err == nil { t.Errorf("%s/%s: expected an error", test.dial, test.accept); conn.Close() }
+			listener.Close()
+			continue
+		}
+		if err != nil { t.Errorf("%s/%s: expected no error, got %s", test.dial, test.accept, err); listener.Close(); continue }
+		if conn.Encrypted() != test.encrypted { t.Errorf("%s/%s: expected encrypted %v", test.dial, test.accept, test.encrypted) }
+		conn.WriteRequest(1, 2, 3)
+		message := <-messages
+		if message == nil || message.Id != MsgRequest { t.Errorf("%s/%s: unexpected message %v", test.dial, test.accept, message) }
+		conn.Close()
+		listener.Close()
+	}
+}
+
+func Test_EncryptedSessionDownload(t *testing.T) {
+	tracker := newTestTracker()
+	defer tracker.server.Close()
+	root := createTestFiles(t, []int{ 100000, 70000 })
+	options := &CreateOptions{ PieceLength: 32768, Announce: [][]string{ { tracker.announceUrl() } } }
+
+	seederClient := NewClient()
+	seederClient.SetEncryptionPolicy(EncryptionRequire)
+	err := seederClient.Listen("127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	defer seederClient.Close()
+	tracker.setPeer(seederClient.listener.Addr())
+	seederTorrent := createTestTorrent(t, seederClient, root, options)
+	seederClient.AddTorrent(seederTorrent, filepath.Dir(root))
+	waitForState(t, seederClient, seederTorrent, StateSeeding)
+
+	leecherClient := NewClient()
+	leecherClient.SetEncryptionPolicy(EncryptionRequire)
+	defer leecherClient.Close()
+	leecherTorrent := createTestTorrent(t, leecherClient, root, options)
+	downloadDir := t.TempDir()
+	leecherClient.AddTorrent(leecherTorrent, downloadDir)
+	waitForState(t, leecherClient, leecherTorrent, StateSeeding)
+
+	expected, _ := ioutil.ReadFile(filepath.Join(root, "dirb", "file1"))
+	output, _ := ioutil.ReadFile(filepath.Join(downloadDir, "data", "dirb", "file1"))
+	if !bytes.Equal(expected, output) { t.Error("Downloaded file differs from original") }
+}
+
+func Test_UtpPeerConnection(t *testing.T) {
+	root := createTestFiles(t, []int{ 100000 })
+	seederClient := NewClient()
+	err := seederClient.Listen("127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	defer seederClient.Close()
+	seederTorrent := createTestTorrent(t, seederClient, root, &CreateOptions{ PieceLength: 32768 })
+	seederClient.AddTorrent(seederTorrent, filepath.Dir(root))
+	waitForState(t, seederClient, seederTorrent, StateSeeding)
+
+	leecherClient := NewClient()
+	err = leecherClient.Listen("127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	defer leecherClient.Close()
+	address := seederClient.listener.Addr().String()
+	conn, err := dialPeer(context.Background(), leecherClient.dial, address, seederTorrent.InfoHash(), leecherClient.PeerId(), EncryptionRequire, time.Second)
+	if err != nil { t.Fatal("Expected no error, got", err) }
+	defer conn.Close()
+	if _, ok := conn.RemoteAddr().(*net.UDPAddr); !ok || !conn.Encrypted() { t.Errorf("Expected an encrypted uTP connection, got %v", conn.RemoteAddr()) }
+	message, err := conn.ReadMessage()
+	if err != nil || message.Id != MsgHaveAll { t.Errorf("Expected have all, got %v, %v", message, err) }
+
+	// Peers without uTP are reached over TCP.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil { conn.Close() }
+	}()
+	tcpConn, err := leecherClient.dial(context.Background(), listener.Addr().String(), 200 * time.Millisecond)
+	if err != nil { t.Fatal("Expected no error, got", err) }
+	tcpConn.Close()
+	if _, ok := tcpConn.RemoteAddr().(*net.TCPAddr); !ok { t.Errorf("Expected a TCP connection, got %v", tcpConn.RemoteAddr()) }
+}
+
+func Test_SessionQueue(t *testing.T) {
+	tracker := newTestTracker()
+	defer tracker.server.Close()
+	client := NewClient()
+	client.Listen("127.0.0.1:0")
+	limits := NewSessionLimits()
+	limits.MaxActiveDownloads = 1
+	client.SetSessionLimits(limits)
+
+	// Nothing to download from: the first torrent keeps downloading.
+	first := createTestTorrent(t, client, createTestFiles(t, []int{ 1000 }), &CreateOptions{ Announce: [][]string{ { tracker.announceUrl() } } })
+	second := createTestTorrent(t, client, createTestFiles(t, []int{ 2000 }), &CreateOptions{ Announce: [][]string{ { tracker.announceUrl() } } })
+	client.AddTorrent(first, t.TempDir())
+	client.AddTorrent(second, t.TempDir())
+	waitForState(t, client, first, StateDownloading)
+	waitForState(t, client, second, StateQueued)
+
+	client.PauseTorrent(first.InfoHash())
+	waitForState(t, client, first, StatePaused)
+	waitForState(t, client, second, StateDownloading)
+
+	client.ResumeTorrent(first.InfoHash())
+	waitForState(t, client, first, StateQueued)
+	err := client.RemoveTorrent(second.InfoHash())
+	if err != nil { t.Error("Expected no error, got", err) }
+	waitForState(t, client, first, StateDownloading)
+	_, err = client.TorrentState(second.InfoHash())
+	if err != ErrTorrentNotFound { t.Errorf("Expected error '%s', got error '%v'", ErrTorrentNotFound, err) }
+
+	client.Close()
+	if tracker.eventCount("stopped") != 3 { t.Errorf("Expected 3 stopped events, got %v", tracker.events) }
+	err = client.AddTorrent(second, t.TempDir())
+	if err != ErrClientClosed { t.Errorf("Expected error '%s', got error '%v'", ErrClientClosed, err) }
+}
+
+func Test_SeedingPolicy(t *testing.T) {
+	tracker := newTestTracker()
+	defer tracker.server.Close()
+	root := createTestFiles(t, []int{ 100000, 70000 })
+	options := &CreateOptions{ PieceLength: 32768, Announce: [][]string{ { tracker.announceUrl() } } }
+
+	seederClient := NewClient()
+	seederClient.policyInterval = 10 * time.Millisecond
+	seederClient.SetSeedingPolicy(&SeedingPolicy{ Ratio: 1, Action: SeedingActionPause })
+	seederClient.Listen("127.0.0.1:0")
+	defer seederClient.Close()
+	tracker.setPeer(seederClient.listener.Addr())
+	seederTorrent := createTestTorrent(t, seederClient, root, options)
+	events, unsubscribe := seederTorrent.SubscribeChannel(100)
+	defer unsubscribe()
+	seederClient.AddTorrent(seederTorrent, filepath.Dir(root))
+	waitForState(t, seederClient, seederTorrent, StateSeeding)
+
+	leecherClient := NewClient()
+	leecherClient.Listen("127.0.0.1:0")
+	defer leecherClient.Close()
+	leecherTorrent := createTestTorrent(t, leecherClient, root, options)
+	leecherClient.AddTorrent(leecherTorrent, t.TempDir())
+
+	// The seeder has uploaded the whole torrent once.
+	waitForState(t, seederClient, seederTorrent, StatePaused)
+	timeout := time.After(5 * time.Second)
+	for goalReached := false; !goalReached; {
+		select {
+			case event := <-events:
+				goalReached = event.Type == EventSeedingGoalReached && event.Goal == GoalRatio
+			case <-timeout:
+				t.Fatal("Expected a seeding goal event")
+		}
+	}
+
+	// Once resumed, the torrent seeds until paused.
+	seederClient.ResumeTorrent(seederTorrent.InfoHash())
+	waitForState(t, seederClient, seederTorrent, StateSeeding)
+	time.Sleep(50 * time.Millisecond)
+	waitForState(t, seederClient, seederTorrent, StateSeeding)
+
+	// The leecher is now a seed, and the tracker reports 2 seeds including it.
+	waitForState(t, leecherClient, leecherTorrent, StateSeeding)
+	tracker.mutex.Lock()
+	tracker.seeds = 2
+	tracker.mutex.Unlock()
+	leecherClient.SetTorrentSeedingPolicy(leecherTorrent.InfoHash(), &SeedingPolicy{ MinSwarmSeeds: 1, Action: SeedingActionRemove })
+	leecherClient.checkSeedingGoals()
+	_, err := leecherClient.TorrentState(leecherTorrent.InfoHash())
+	if err != ErrTorrentNotFound { t.Errorf("Expected error '%s', got error '%v'", ErrTorrentNotFound, err) }
+
+	durationClient := NewClient()
+	durationClient.Listen("127.0.0.1:0")
+	defer durationClient.Close()
+	durationTorrent := createTestTorrent(t, durationClient, root, &CreateOptions{})
+	durationClient.AddTorrent(durationTorrent, filepath.Dir(root))
+	durationClient.SetTorrentSeedingPolicy(durationTorrent.InfoHash(), &SeedingPolicy{ Duration: 20 * time.Millisecond })
+	waitForState(t, durationClient, durationTorrent, StateSeeding)
+	durationClient.checkSeedingGoals()
+	state, _ := durationClient.TorrentState(durationTorrent.InfoHash())
+	if state != StateSeeding { t.Errorf("Expected state %s, got %s", StateSeeding, state) }
+	time.Sleep(30 * time.Millisecond)
+	durationClient.checkSeedingGoals()
+	waitForState(t, durationClient, durationTorrent, StatePaused)
+
+	// Closing the client cancels its pending scrapes.
+	durationClient.Close()
+	if durationClient.ctx.Err() == nil { t.Error("Expected the context of the client to be cancelled") }
+}
+
+func Test_ScrapeUrl(t *testing.T) {
+	type ScrapeUrlTest struct {
+		input string
+		expected string
+		ok bool
+	}
+	var tests = []ScrapeUrlTest{
+		{ "http://example.com/announce", "http://example.com/scrape", true },
+		{ "http://example.com/x/announce.php?k=1", "http://example.com/x/scrape.php?k=1", true },
+		{ "http://example.com/a", "", false },
+		{ "http://example.com/announce/x", "", false },
+	}
+	for _, d := range tests {
+		output, ok := scrapeUrl(d.input)
+		if output != d.expected || ok != d.ok { t.Errorf("%s: expected %q %v, got %q %v", d.input, d.expected, d.ok, output, ok) }
+	}
+}
+
+func Test_WebSeed(t *testing.T) {
+	root := createTestFiles(t, []int{ 100000, 0, 70000, 5 })
+	var mutex sync.Mutex
+	requests := 0
+	fileServer := http.FileServer(http.Dir(filepath.Dir(root)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests++
+		fail := requests <= 2
+		mutex.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	client := NewClient()
+	torr := createTestTorrent(t, client, root, &CreateOptions{ PieceLength: 32768, WebSeeds: []string{ server.URL + "/", "ftp://example.com/" } })
+	downloadDir := t.TempDir()
+	storage := NewFileStorage(torr, downloadDir)
+	defer storage.Close()
+	downloader := client.NewDownloader(torr, storage, nil)
+	downloader.webSeedBackoff = 10 * time.Millisecond
+	err := downloader.Run()
+	if err != nil { t.Fatal("Expected no error, got", err) }
+
+	for _, file := range []string{ "dira/file0", "dira/file2", "dirb/file3" } {
+		expected, _ := ioutil.ReadFile(filepath.Join(root, file))
+		output, _ := ioutil.ReadFile(filepath.Join(downloadDir, "data", file))
+		if !bytes.Equal(expected, output) { t.Errorf("Downloaded file %s differs from original", file) }
+	}
+	// Pieces spanning files need one request per file.
+	if requests < 2 + torr.PieceCount() + 2 { t.Errorf("Unexpected number of requests: %d", requests) }
+
+	// A server that ignores ranges cannot be used.
+	ignoreRanges := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 200000))
+	}))
+	defer ignoreRanges.Close()
+	_, err = torr.fetchWebSeedPiece(context.Background(), ignoreRanges.URL + "/", 0)
+	if err != ErrRangeNotSupported { t.Errorf("Expected error '%s', got error '%v'", ErrRangeNotSupported, err) }
+}
+
+func Test_HttpSeed(t *testing.T) {
+	root := createTestFiles(t, []int{ 100000, 70000 })
+	client := NewClient()
+	seedTorrent := createTestTorrent(t, client, root, &CreateOptions{ PieceLength: 32768 })
+	seedStorage := NewFileStorage(seedTorrent, filepath.Dir(root))
+	defer seedStorage.Close()
+
+	var mutex sync.Mutex
+	busy := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if busy {
+			busy = false
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("7"))
+			return
+		}
+		index, _ := strconv.Atoi(r.URL.Query().Get("piece"))
+		if r.URL.Query().Get("info_hash") != string(seedTorrent.InfoHash()) || r.URL.Query().Get("key") != "1" { w.WriteHeader(http.StatusNotFound); return }
+		data, err := seedTorrent.ReadPiece(seedStorage, index)
+		if err != nil { w.WriteHeader(http.StatusNotFound); return }
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	torr := createTestTorrent(t, client, root, &CreateOptions{ PieceLength: 32768, HttpSeeds: []string{ server.URL + "/seed?key=1" } })
+	if len(torr.HttpSeeds()) != 1 { t.Fatalf("Unexpected HTTP seeds: %v", torr.HttpSeeds()) }
+
+	_, err := torr.fetchHttpSeedPiece(context.Background(), torr.HttpSeeds()[0], 0)
+	var httpErr *HttpError
+	if !errors.As(err, &httpErr) || httpErr.RetryAfter != 7 * time.Second { t.Errorf("Expected to retry after 7s, got %v", err) }
+
+	downloadDir := t.TempDir()
+	storage := NewFileStorage(torr, downloadDir)
+	defer storage.Close()
+	downloader := client.NewDownloader(torr, storage, nil)
+	err = downloader.Run()
+	if err != nil { t.Fatal("Expected no error, got", err) }
+	for _, file := range []string{ "dira/file0", "dirb/file1" } {
+		expected, _ := ioutil.ReadFile(filepath.Join(root, file))
+		output, _ := ioutil.ReadFile(filepath.Join(downloadDir, "data", file))
+		if !bytes.Equal(expected, output) { t.Errorf("Downloaded file %s differs from original", file) }
+	}
+
+	// A broken seed that streams without end.
+	endless := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := make([]byte, 65536)
+		for {
+			_, err := w.Write(chunk)
+			if err != nil { return }
+		}
+	}))
+	defer endless.Close()
+	_, err = torr.fetchHttpSeedPiece(context.Background(), endless.URL, 0)
+	if err != ErrInvalidPieceLength { t.Errorf("Expected error '%s', got error '%v'", ErrInvalidPieceLength, err) }
+}
+
+func Test_WebSeedFileUrl(t *testing.T) {
+	root := createTestFiles(t, []int{ 10, 10 })
+	client := NewClient()
+	multi := createTestTorrent(t, client, root, &CreateOptions{})
+	file := multi.Files()[1]
+	file.Path = []string{ "data", "dir b", "file#1" }
+	if url := multi.webSeedFileUrl("http://a/files", file); url != "http://a/files/data/dir%20b/file%231" { t.Errorf("Unexpected URL: %s", url) }
+	if url := multi.webSeedFileUrl("http://a/files/", file); url != "http://a/files/data/dir%20b/file%231" { t.Errorf("Unexpected URL: %s", url) }
+
+	single := createTestTorrent(t, client, filepath.Join(root, "dira", "file0"), &CreateOptions{})
+	if url := single.webSeedFileUrl("http://a/files/", single.Files()[0]); url != "http://a/files/file0" { t.Errorf("Unexpected URL: %s", url) }
+	if url := single.webSeedFileUrl("http://a/other.bin", single.Files()[0]); url != "http://a/other.bin" { t.Errorf("Unexpected URL: %s", url) }
+}
+
+func Test_RateLimiter(t *testing.T) {
+	var limiter rateLimiter
+	limiter.setRate(100000)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		limiter.wait(10000)
+	}
+	if time.Since(start) < 400 * time.Millisecond { t.Errorf("Expected the limiter to wait, took %s", time.Since(start)) }
+}
+
+func Test_Report(t *testing.T) {
+	root := createTestFiles(t, []int{ 40000, 0, 16384 })
+	client := NewClient()
+	torr := createTestTorrent(t, client, root, &CreateOptions{ PieceLength: 16384, Comment: "test", Private: true, WebSeeds: []string{ "http://seed/" } })
+	// Files are sorted by path: dira/file0, dira/file2, dirb/file1
+	torr.SetSelectedFileIndexes([]int{ 0, 2 })
+
+	report := torr.Report()
+	if len(report.InfoHashHex) != 40 || len(report.InfoHashBase32) != 32 { t.Errorf("Unexpected info hashes: %s %s", report.InfoHashHex, report.InfoHashBase32) }
+	if report.TotalSize != 56384 || report.SelectedSize != 40000 { t.Errorf("Unexpected sizes: %d %d", report.TotalSize, report.SelectedSize) }
+	if report.PieceCount != 4 || !report.Private || report.Comment != "test" { t.Errorf("Unexpected report: %+v", report) }
+	if len(report.WebSeeds) != 1 || report.WebSeeds[0] != "http://seed/" { t.Errorf("Unexpected web seeds: %v", report.WebSeeds) }
+	if report.CreationDate.IsZero() { t.Error("Expected a creation date") }
+
+	if len(report.Files.Children) != 2 || report.Files.Size != 56384 { t.Fatalf("Unexpected file tree: %+v", report.Files) }
+	dira := report.Files.Children[0]
+	if dira.Name != "dira" || dira.Size != 56384 || len(dira.Children) != 2 || dira.Index != -1 { t.Errorf("Unexpected directory: %+v", dira) }
+	if !dira.Children[0].Selected || dira.Children[1].Selected { t.Error("Unexpected selection in file tree") }
+
+	// The only warning is about the private torrent having no tracker.
+	if len(report.Warnings) != 1 { t.Errorf("Unexpected warnings: %v", report.Warnings) }
+	if !strings.Contains(report.String(), "dira/") { t.Errorf("Unexpected text report: %s", report.String()) }
+}
+
+func Test_ReportWarnings(t *testing.T) {
+	metaInfo := "d8:announce8:http://a4:infod5:filesld6:lengthi1e4:pathl2:..1:aeed6:lengthi1e4:pathl1:Aeed6:lengthi1e4:pathl1:aeee4:name1:x12:piece lengthi16384e6:pieces0:e8:url-listl14:ftp://a.test/x8:http://bee"
+	torr := NewClient().NewTorrent("")
+	err := torr.LoadMetaInfo([]byte(metaInfo))
+	if err != nil { t.Fatal("Cannot load meta info:", err) }
+
+	warnings := strings.Join(torr.Report().Warnings, "\n")
+	for _, expected := range []string{ "pieces field is empty", "file 0: \"x/../a\" -> \"x/__/a\" (relative component)", "file 2: \"x/a\" -> \"x/a (1)\" (duplicate path)", "unsupported web seed, ignored: ftp://a.test/x" } {
+		if !strings.Contains(warnings, expected) { t.Errorf("Expected warning \"%s\" in: %s", expected, warnings) }
+	}
+
+	for _, path := range []string{ "testing/LibreOffice.torrent", "testing/Despicable Me (2010) [1080p].torrent" } {
+		data, _ := ioutil.ReadFile(path)
+		torr := NewClient().NewTorrent(path)
+		torr.LoadMetaInfo(data)
+		report := torr.Report()
+		if len(report.Warnings) != 0 { t.Errorf("Unexpected warnings for %s: %v", path, report.Warnings) }
+	}
+}
+
+func Test_PathSanitizer(t *testing.T) {
+	sanitizer := NewPathSanitizer()
+	type SanitizePathTest struct {
+		input []string
+		expected []string
+	}
+	var tests = []SanitizePathTest{
+		{ []string{ "dir", "file.txt" }, []string{ "dir", "file.txt" } },
+		{ []string{ "..", "..", "etc", "passwd" }, []string{ "__", "__", "etc", "passwd" } },
+		{ []string{ "/etc/passwd" }, []string{ "_etc_passwd" } },
+		{ []string{ "C:\\Windows" }, []string{ "C__Windows" } },
+		{ []string{ "", "a", "" }, []string{ "a" } },
+		{ []string{ "" }, []string{ "_" } },
+		{ []string{ "a\x00b" }, []string{ "ab" } },
+		{ []string{ "con.txt" }, []string{ "_con.txt" } },
+		{ []string{ "Lpt1" }, []string{ "_Lpt1" } },
+		{ []string{ "console" }, []string{ "console" } },
+		{ []string{ "name. " }, []string{ "name" } },
+		{ []string{ "\xff.bin" }, []string{ "_.bin" } },
+		{ []string{ strings.Repeat("a", 300) + ".txt" }, []string{ strings.Repeat("a", 251) + ".txt" } },
+	}
+	for _, d := range tests {
+		output, reasons := sanitizer.SanitizePath(d.input)
+		if strings.Join(output, "/") != strings.Join(d.expected, "/") { t.Errorf("Expected %q, got %q", d.expected, output) }
+		unchanged := strings.Join(d.input, "/") == strings.Join(d.expected, "/")
+		if unchanged != (len(reasons) == 0) { t.Errorf("Unexpected reasons for %q: %v", d.input, reasons) }
+	}
+
+	// Truncation doesn't cut multi-byte characters.
+	output, _ := sanitizer.SanitizeComponent(strings.Repeat("é", 200))
+	if len(output) > defaultMaxComponentLength || !utf8.ValidString(output) { t.Errorf("Invalid truncation: %q", output) }
+
+	files := []FileInfo{
+		{ Path: []string{ "x", "..", "a" }, Length: 1 },
+		{ Path: []string{ "x", "A" }, Length: 1, Offset: 1 },
+		{ Path: []string{ "x", "a" }, Length: 1, Offset: 2 },
+	}
+	sanitized, changes, err := sanitizer.SanitizeFiles(files)
+	if err != nil { t.Fatal(err) }
+	if len(changes) != 2 || changes[0].FileIndex != 0 || changes[1].FileIndex != 2 { t.Fatalf("Unexpected changes: %v", changes) }
+	if strings.Join(sanitized[2].Path, "/") != "x/a (1)" || sanitized[2].Offset != 2 { t.Errorf("Unexpected file: %v", sanitized[2]) }
+	if strings.Join(files[2].Path, "/") != "x/a" { t.Error("Input files should not be modified") }
+
+	// The suffix of a duplicate still fits in the maximum length.
+	long := strings.Repeat("a", 300) + ".txt"
+	sanitized, _, err = sanitizer.SanitizeFiles([]FileInfo{ { Path: []string{ long } }, { Path: []string{ long } } })
+	if err != nil { t.Fatal(err) }
+	if sanitized[1].Path[0] != strings.Repeat("a", 247) + " (1).txt" { t.Errorf("Unexpected duplicate name: %q", sanitized[1].Path[0]) }
+
+	sanitizer.Policy = PathPolicyReject
+	_, _, err = sanitizer.SanitizeFiles(files)
+	var pathErr *UnsafePathError
+	if !errors.Is(err, ErrUnsafePath) || !errors.As(err, &pathErr) || pathErr.Change.FileIndex != 0 { t.Errorf("Expected an unsafe path error, got %v", err) }
+}
+
+func Test_FileStorageUnsafePaths(t *testing.T) {
+	metaInfo := "d8:announce8:http://a4:infod5:filesld6:lengthi1e4:pathl2:..2:..6:escapeeed6:lengthi1e4:pathl1:/3:tmpeee4:name2:..12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaaee"
+	torr := NewClient().NewTorrent("")
+	err := torr.LoadMetaInfo([]byte(metaInfo))
+	if err != nil { t.Fatal("Cannot load meta info:", err) }
+
+	root := filepath.Join(t.TempDir(), "download")
+	storage := NewFileStorage(torr, root)
+	defer storage.Close()
+	if len(storage.PathChanges()) != 2 { t.Errorf("Expected 2 path changes, got %v", storage.PathChanges()) }
+	_, err = storage.WriteAt([]byte("ab"), 0)
+	if err != nil { t.Fatal(err) }
+	for i := 0; i < torr.FileCount(); i++ {
+		path, err := filepath.Rel(root, storage.FilePath(i))
+		if err != nil || strings.HasPrefix(path, "..") { t.Errorf("File %d escapes the download directory: %s", i, storage.FilePath(i)) }
+		_, err = os.Stat(storage.FilePath(i))
+		if err != nil { t.Errorf("File %d not created: %v", i, err) }
+	}
+
+	strict := NewPathSanitizer()
+	strict.Policy = PathPolicyReject
+	_, err = NewFileStorageWithSanitizer(torr, root, strict)
+	if !errors.Is(err, ErrUnsafePath) { t.Errorf("Expected ErrUnsafePath, got %v", err) }
+}
@@ -0,0 +1,472 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Peer wire protocol, as defined by BEP 3.
+
+const (
+	protocolName = "BitTorrent protocol"
+	handshakeLength = 1 + len(protocolName) + 8 + 20 + 20
+
+	// Size of the blocks requested from peers. Most clients reject requests
+	// for more than 16 KiB.
+	BlockSize = 16 * 1024
+	maxRequestLength = 128 * 1024
+
+	// Upper bound on the length of a message, to avoid allocating whatever
+	// a peer announces. The largest legitimate messages are bitfields
+	// and piece messages.
+	maxMessageLength = 1024 * 1024 + 13
+
+	// Reserved bit of the Fast extension (BEP 6), in the last reserved byte.
+	reservedFast = 0x04
+)
+
+const (
+	MsgChoke = 0
+	MsgUnchoke = 1
+	MsgInterested = 2
+	MsgNotInterested = 3
+	MsgHave = 4
+	MsgBitfield = 5
+	MsgRequest = 6
+	MsgPiece = 7
+	MsgCancel = 8
+	MsgPort = 9
+	MsgSuggestPiece = 13
+	MsgHaveAll = 14
+	MsgHaveNone = 15
+	MsgRejectRequest = 16
+	MsgAllowedFast = 17
+	MsgHashRequest = 21
+	MsgHashes = 22
+	MsgHashReject = 23
+)
+
+var ErrInvalidHandshake = errors.New("invalid handshake")
+var ErrInfoHashMismatch = errors.New("info hash mismatch")
+var ErrMessageTooLong = errors.New("message too long")
+var ErrInvalidMessage = errors.New("invalid message")
+
+// Bitfield is a set of piece indexes, stored as in the "bitfield" message:
+// the high bit of the first byte is piece 0.
+type Bitfield []byte
+
+func NewBitfield(pieceCount int) Bitfield {
+	return make(Bitfield, (pieceCount + 7) / 8)
+}
+
+func (this Bitfield) Has(index int) bool {
+	if index < 0 || index / 8 >= len(this) { return false }
+	return this[index / 8] & (0x80 >> uint(index % 8)) != 0
+}
+
+func (this Bitfield) Set(index int) {
+	if index < 0 || index / 8 >= len(this) { return }
+	this[index / 8] |= 0x80 >> uint(index % 8)
+}
+
+func (this Bitfield) Count() int {
+	output := 0
+	for i := 0; i < len(this) * 8; i++ {
+		if this.Has(i) { output++ }
+	}
+	return output
+}
+
+type PeerMessage struct {
+	Id byte
+	Payload []byte
+}
+
+// PeerConn is a connection to a peer, after the handshake has been done.
+type PeerConn struct {
+	conn net.Conn
+	reader *bufio.Reader
+	peerId []byte
+	reserved []byte
+	readTimeout time.Duration
+	writeMutex sync.Mutex
+}
+
+func handshakeBytes(infoHash []byte, peerId string) []byte {
+	output := make([]byte, 0, handshakeLength)
+	output = append(output, byte(len(protocolName)))
+	output = append(output, protocolName...)
+	output = append(output, 0, 0, 0, 0, 0, 0, 0, reservedFast)
+	output = append(output, infoHash...)
+	output = append(output, peerId...)
+	return output
+}
+
+// readHandshake reads the handshake of the remote peer and returns its
+// reserved bytes, info hash and peer id.
+func readHandshake(reader io.Reader) ([]byte, []byte, []byte, error) {
+	buffer := make([]byte, handshakeLength)
+	_, err := io.ReadFull(reader, buffer)
+	if err != nil { return nil, nil, nil, err }
+	if int(buffer[0]) != len(protocolName) || string(buffer[1 : 1 + len(protocolName)]) != protocolName { return nil, nil, nil, ErrInvalidHandshake }
+	reserved := buffer[1 + len(protocolName) : handshakeLength - 40]
+	infoHash := buffer[handshakeLength - 40 : handshakeLength - 20]
+	peerId := buffer[handshakeLength - 20:]
+	return reserved, infoHash, peerId, nil
+}
+
+func newPeerConn(conn net.Conn, reader *bufio.Reader, reserved []byte, peerId []byte) *PeerConn {
+	output := new(PeerConn)
+	output.conn = conn
+	output.reader = reader
+	output.reserved = reserved
+	output.peerId = peerId
+	output.readTimeout = 2 * time.Minute
+	return output
+}
+
+// peerDialer opens a connection to a peer, over TCP or uTP.
+type peerDialer func(ctx context.Context, address string, timeout time.Duration) (net.Conn, error)
+
+func dialTCP(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{ Timeout: timeout }
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// DialPeer connects to a peer and performs the handshake for the given
+// torrent.
+func DialPeer(address string, infoHash []byte, peerId string, timeout time.Duration) (*PeerConn, error) {
+	return dialPeer(context.Background(), dialTCP, address, infoHash, peerId, EncryptionDisabled, timeout)
+}
+
+// DialPeerEncrypted is DialPeer with the given encryption policy. With
+// EncryptionPrefer, the connection is made again in plaintext if the
+// encryption handshake fails.
+func DialPeerEncrypted(address string, infoHash []byte, peerId string, policy EncryptionPolicy, timeout time.Duration) (*PeerConn, error) {
+	return dialPeer(context.Background(), dialTCP, address, infoHash, peerId, policy, timeout)
+}
+
+// DialPeerContext is DialPeerEncrypted, aborted when the context is
+// cancelled. The context only applies to the connection and handshake.
+func DialPeerContext(ctx context.Context, address string, infoHash []byte, peerId string, policy EncryptionPolicy, timeout time.Duration) (*PeerConn, error) {
+	return dialPeer(ctx, dialTCP, address, infoHash, peerId, policy, timeout)
+}
+
+func dialPeer(ctx context.Context, dial peerDialer, address string, infoHash []byte, peerId string, policy EncryptionPolicy, timeout time.Duration) (*PeerConn, error) {
+	conn, err := dial(ctx, address, timeout)
+	if err != nil { return nil, err }
+	// Cancelling the context closes the connection, which interrupts the
+	// handshake.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	output, err := handshakePeer(conn, infoHash, peerId, policy, timeout)
+	if !stop() { return nil, ctx.Err() }
+	if err != nil {
+		conn.Close()
+		if policy == EncryptionPrefer { return dialPeer(ctx, dial, address, infoHash, peerId, EncryptionDisabled, timeout) }
+		return nil, err
+	}
+	return output, nil
+}
+
+func handshakePeer(conn net.Conn, infoHash []byte, peerId string, policy EncryptionPolicy, timeout time.Duration) (*PeerConn, error) {
+	if policy == EncryptionDisabled { return peerHandshake(conn, infoHash, peerId, timeout) }
+	provide := uint32(cryptoRC4)
+	if policy == EncryptionPrefer { provide |= cryptoPlaintext }
+	conn.SetDeadline(time.Now().Add(timeout))
+	encrypted, err := mseInitiate(conn, infoHash, provide)
+	if err != nil { return nil, err }
+	return peerHandshake(encrypted, infoHash, peerId, timeout)
+}
+
+func peerHandshake(conn net.Conn, infoHash []byte, peerId string, timeout time.Duration) (*PeerConn, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	_, err := conn.Write(handshakeBytes(infoHash, peerId))
+	if err != nil { return nil, err }
+	reader := bufio.NewReader(conn)
+	reserved, remoteInfoHash, remotePeerId, err := readHandshake(reader)
+	if err != nil { return nil, err }
+	if !bytes.Equal(remoteInfoHash, infoHash) { return nil, ErrInfoHashMismatch }
+	conn.SetDeadline(time.Time{})
+	return newPeerConn(conn, reader, reserved, remotePeerId), nil
+}
+
+// AcceptPeer performs the handshake of an incoming connection. The
+// accept function tells whether we serve the torrent that the peer asks
+// for.
+func AcceptPeer(conn net.Conn, peerId string, accept func(infoHash []byte) bool, timeout time.Duration) (*PeerConn, []byte, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	return acceptHandshake(conn, bufio.NewReader(conn), peerId, accept)
+}
+
+// AcceptPeerEncrypted performs the handshake of an incoming connection, which
+// is encrypted or not, for one of the given torrents.
+func AcceptPeerEncrypted(conn net.Conn, peerId string, infoHashes [][]byte, policy EncryptionPolicy, timeout time.Duration) (*PeerConn, []byte, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	reader := bufio.NewReader(conn)
+	plaintext, err := isPlaintextHandshake(reader)
+	if err != nil { return nil, nil, err }
+	if plaintext && policy == EncryptionRequire { return nil, nil, ErrEncryptionRequired }
+	if !plaintext && policy == EncryptionDisabled { return nil, nil, ErrInvalidHandshake }
+
+	var accepted []byte
+	if !plaintext {
+		encrypted, infoHash, err := mseRespond(conn, reader, infoHashes, policy)
+		if err != nil { return nil, nil, err }
+		conn = encrypted
+		reader = bufio.NewReader(encrypted)
+		accepted = infoHash
+	}
+	accept := func(infoHash []byte) bool {
+		if accepted != nil { return bytes.Equal(infoHash, accepted) }
+		for _, h := range infoHashes {
+			if bytes.Equal(h, infoHash) { return true }
+		}
+		return false
+	}
+	return acceptHandshake(conn, reader, peerId, accept)
+}
+
+func acceptHandshake(conn net.Conn, reader *bufio.Reader, peerId string, accept func(infoHash []byte) bool) (*PeerConn, []byte, error) {
+	reserved, infoHash, remotePeerId, err := readHandshake(reader)
+	if err != nil { return nil, nil, err }
+	if !accept(infoHash) { return nil, nil, ErrInfoHashMismatch }
+	_, err = conn.Write(handshakeBytes(infoHash, peerId))
+	if err != nil { return nil, nil, err }
+	conn.SetDeadline(time.Time{})
+	return newPeerConn(conn, reader, reserved, remotePeerId), infoHash, nil
+}
+
+func (this *PeerConn) PeerId() []byte {
+	return this.peerId
+}
+
+// SupportsFast tells whether the Fast extension (BEP 6) is enabled on the
+// connection, which is the case if the peer supports it, since we always do.
+func (this *PeerConn) SupportsFast() bool {
+	return this.reserved[7] & reservedFast != 0
+}
+
+// Encrypted tells whether the connection is obfuscated with RC4.
+func (this *PeerConn) Encrypted() bool {
+	encrypted, ok := this.conn.(*encryptedConn)
+	return ok && encrypted.isEncrypted()
+}
+
+func (this *PeerConn) RemoteAddr() net.Addr {
+	return this.conn.RemoteAddr()
+}
+
+func (this *PeerConn) Close() error {
+	return this.conn.Close()
+}
+
+// ReadMessage reads the next message. Keep-alive messages are returned as
+// nil messages.
+func (this *PeerConn) ReadMessage() (*PeerMessage, error) {
+	if this.readTimeout > 0 { this.conn.SetReadDeadline(time.Now().Add(this.readTimeout)) }
+	var lengthBuffer [4]byte
+	_, err := io.ReadFull(this.reader, lengthBuffer[:])
+	if err != nil { return nil, err }
+	length := binary.BigEndian.Uint32(lengthBuffer[:])
+	if length == 0 { return nil, nil }
+	if length > maxMessageLength { return nil, ErrMessageTooLong }
+	buffer := make([]byte, length)
+	_, err = io.ReadFull(this.reader, buffer)
+	if err != nil { return nil, err }
+	return &PeerMessage{ Id: buffer[0], Payload: buffer[1:] }, nil
+}
+
+func (this *PeerConn) WriteMessage(id byte, payload []byte) error {
+	buffer := make([]byte, 5 + len(payload))
+	binary.BigEndian.PutUint32(buffer, uint32(1 + len(payload)))
+	buffer[4] = id
+	copy(buffer[5:], payload)
+	return this.write(buffer)
+}
+
+func (this *PeerConn) write(buffer []byte) error {
+	this.writeMutex.Lock()
+	defer this.writeMutex.Unlock()
+	_, err := this.conn.Write(buffer)
+	return err
+}
+
+func (this *PeerConn) WriteKeepAlive() error {
+	return this.write([]byte{ 0, 0, 0, 0 })
+}
+
+func uint32Payload(values ...int) []byte {
+	output := make([]byte, 4 * len(values))
+	for i, value := range values {
+		binary.BigEndian.PutUint32(output[i * 4:], uint32(value))
+	}
+	return output
+}
+
+func (this *PeerConn) WriteHave(index int) error {
+	return this.WriteMessage(MsgHave, uint32Payload(index))
+}
+
+func (this *PeerConn) WriteRequest(index int, begin int, length int) error {
+	return this.WriteMessage(MsgRequest, uint32Payload(index, begin, length))
+}
+
+func (this *PeerConn) WriteCancel(index int, begin int, length int) error {
+	return this.WriteMessage(MsgCancel, uint32Payload(index, begin, length))
+}
+
+func (this *PeerConn) WritePiece(index int, begin int, block []byte) error {
+	return this.WriteMessage(MsgPiece, append(uint32Payload(index, begin), block...))
+}
+
+func (this *PeerConn) WriteSuggestPiece(index int) error {
+	return this.WriteMessage(MsgSuggestPiece, uint32Payload(index))
+}
+
+func (this *PeerConn) WriteHaveAll() error {
+	return this.WriteMessage(MsgHaveAll, nil)
+}
+
+func (this *PeerConn) WriteHaveNone() error {
+	return this.WriteMessage(MsgHaveNone, nil)
+}
+
+func (this *PeerConn) WriteRejectRequest(index int, begin int, length int) error {
+	return this.WriteMessage(MsgRejectRequest, uint32Payload(index, begin, length))
+}
+
+func (this *PeerConn) WriteAllowedFast(index int) error {
+	return this.WriteMessage(MsgAllowedFast, uint32Payload(index))
+}
+
+// writeHave sends the pieces we have as the first message: with the Fast
+// extension, "have all" or "have none" replace full and empty bitfields.
+func (this *PeerConn) writeHave(have Bitfield, pieceCount int) error {
+	if this.SupportsFast() && have.Count() == pieceCount { return this.WriteHaveAll() }
+	if this.SupportsFast() && have.Count() == 0 { return this.WriteHaveNone() }
+	return this.WriteMessage(MsgBitfield, have)
+}
+
+// HashRequest identifies a range of hashes in a layer of the merkle tree of a
+// file (BEP 52), along with the number of layers of uncle hashes needed to
+// verify them. The base layer is counted from the 16 KiB blocks.
+type HashRequest struct {
+	PiecesRoot []byte
+	BaseLayer int
+	Index int
+	Length int
+	ProofLayers int
+}
+
+func (this *HashRequest) payload() []byte {
+	output := append([]byte(nil), this.PiecesRoot...)
+	return append(output, uint32Payload(this.BaseLayer, this.Index, this.Length, this.ProofLayers)...)
+}
+
+func (this *PeerConn) WriteHashRequest(request *HashRequest) error {
+	return this.WriteMessage(MsgHashRequest, request.payload())
+}
+
+// WriteHashes answers a hash request with the requested hashes followed by
+// the uncle hashes.
+func (this *PeerConn) WriteHashes(request *HashRequest, hashes [][]byte) error {
+	payload := request.payload()
+	for _, hash := range hashes {
+		payload = append(payload, hash...)
+	}
+	return this.WriteMessage(MsgHashes, payload)
+}
+
+func (this *PeerConn) WriteHashReject(request *HashRequest) error {
+	return this.WriteMessage(MsgHashReject, request.payload())
+}
+
+// ParseHave returns the piece index of a "have", "suggest piece" or "allowed
+// fast" message.
+func (this *PeerMessage) ParseHave() (int, error) {
+	if len(this.Payload) != 4 { return 0, ErrInvalidMessage }
+	return int(binary.BigEndian.Uint32(this.Payload)), nil
+}
+
+// ParseRequest returns the index, begin and length of a "request", "cancel"
+// or "reject request" message.
+func (this *PeerMessage) ParseRequest() (int, int, int, error) {
+	if len(this.Payload) != 12 { return 0, 0, 0, ErrInvalidMessage }
+	index := int(binary.BigEndian.Uint32(this.Payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(this.Payload[4:8]))
+	length := int(binary.BigEndian.Uint32(this.Payload[8:12]))
+	return index, begin, length, nil
+}
+
+// ParsePiece returns the index, begin and data of a "piece" message.
+func (this *PeerMessage) ParsePiece() (int, int, []byte, error) {
+	if len(this.Payload) < 8 { return 0, 0, nil, ErrInvalidMessage }
+	index := int(binary.BigEndian.Uint32(this.Payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(this.Payload[4:8]))
+	return index, begin, this.Payload[8:], nil
+}
+
+// ParseHashRequest returns the request of a "hash request" or "hash reject"
+// message.
+func (this *PeerMessage) ParseHashRequest() (*HashRequest, error) {
+	if len(this.Payload) != hashRequestLength { return nil, ErrInvalidMessage }
+	return parseHashRequest(this.Payload), nil
+}
+
+// ParseHashes returns the request and the hashes of a "hashes" message.
+func (this *PeerMessage) ParseHashes() (*HashRequest, [][]byte, error) {
+	if len(this.Payload) < hashRequestLength || (len(this.Payload) - hashRequestLength) % sha256.Size != 0 { return nil, nil, ErrInvalidMessage }
+	return parseHashRequest(this.Payload), splitHashes(string(this.Payload[hashRequestLength:])), nil
+}
+
+const hashRequestLength = sha256.Size + 16
+
+func parseHashRequest(payload []byte) *HashRequest {
+	output := new(HashRequest)
+	output.PiecesRoot = append([]byte(nil), payload[:sha256.Size]...)
+	output.BaseLayer = int(binary.BigEndian.Uint32(payload[32:36]))
+	output.Index = int(binary.BigEndian.Uint32(payload[36:40]))
+	output.Length = int(binary.BigEndian.Uint32(payload[40:44]))
+	output.ProofLayers = int(binary.BigEndian.Uint32(payload[44:48]))
+	return output
+}
+
+// allowedFastSet returns the k pieces that a peer at the given address may
+// request while choked, computed as in BEP 6 so that both sides agree. Only
+// IPv4 addresses have a set.
+func allowedFastSet(ip net.IP, infoHash []byte, pieceCount int, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || pieceCount <= 0 { return nil }
+	k = min(k, pieceCount)
+	x := binary.BigEndian.AppendUint32(nil, binary.BigEndian.Uint32(ip4) & 0xffffff00)
+	x = append(x, infoHash...)
+	var output []int
+	for len(output) < k {
+		hash := sha1.Sum(x)
+		x = hash[:]
+		for i := 0; i < 5 && len(output) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[4 * i:]) % uint32(pieceCount))
+			if !slices.Contains(output, index) { output = append(output, index) }
+		}
+	}
+	return output
+}
+
+// addrIP returns the IP address of a TCP or uTP connection.
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+		case *net.TCPAddr: return addr.IP
+		case *net.UDPAddr: return addr.IP
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package torrent
+
+import (
+	"time"
+)
+
+const (
+	defaultPolicyInterval = time.Minute
+	scrapeInterval = 30 * time.Minute
+)
+
+type SeedingAction int
+
+const (
+	// The torrent is paused, and can be resumed with Client.ResumeTorrent.
+	SeedingActionPause SeedingAction = iota
+	// The torrent is removed from the session. Its files are left on disk.
+	SeedingActionRemove
+)
+
+type SeedingGoal int
+
+const (
+	GoalRatio SeedingGoal = iota
+	GoalDuration
+	GoalSwarmSeeds
+)
+
+var seedingGoalNames = []string{ "share ratio", "seeding duration", "swarm seeds" }
+
+func (this SeedingGoal) String() string {
+	if this < 0 || int(this) >= len(seedingGoalNames) { return "unknown goal" }
+	return seedingGoalNames[this]
+}
+
+// SeedingPolicy tells when a torrent has been seeded enough. Seeding stops as
+// soon as one of the goals is reached, after which the policy no longer
+// applies to the torrent: if resumed, it seeds until paused. Zero disables a
+// goal.
+type SeedingPolicy struct {
+	// Uploaded bytes divided by downloaded bytes, or by the size of the
+	// selected files if nothing was downloaded.
+	Ratio float64
+	// Time spent seeding in this session.
+	Duration time.Duration
+	// Number of other seeds in the swarm, according to the scrape data of
+	// the trackers.
+	MinSwarmSeeds int
+	Action SeedingAction
+}
+
+// SetSeedingPolicy sets the policy of the torrents that don't have their own.
+// A nil policy seeds forever.
+func (this *Client) SetSeedingPolicy(policy *SeedingPolicy) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.seedingPolicy = policy
+}
+
+// SetTorrentSeedingPolicy overrides the policy of the client for one torrent.
+// A nil policy reverts to the policy of the client.
+func (this *Client) SetTorrentSeedingPolicy(infoHash []byte, policy *SeedingPolicy) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	m, err := this.managedTorrent(infoHash)
+	if err != nil { return err }
+	m.seedingPolicy = policy
+	m.seedingGoalReached = false
+	return nil
+}
+
+// seedingTime returns the time the torrent has spent seeding. The client
+// mutex must be held.
+func (this *managedTorrent) seedingTime(now time.Time) time.Duration {
+	output := this.seedingDuration
+	if this.state == StateSeeding { output += now.Sub(this.seedingSince) }
+	return output
+}
+
+func shareRatio(torr *Torrent) float64 {
+	stats := torr.Stats()
+	downloaded := stats.TotalDownloaded
+	if downloaded == 0 { downloaded = int64(torr.SelectedFileSize()) }
+	if downloaded == 0 { return 0 }
+	return float64(stats.TotalUploaded) / float64(downloaded)
+}
+
+func (this *Client) policyLoop() {
+	defer this.background.Done()
+	ticker := time.NewTicker(this.policyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+			case <-ticker.C:
+				this.checkSeedingGoals()
+			case <-this.ctx.Done():
+				return
+		}
+	}
+}
+
+// checkSeedingGoals applies the seeding policies to the seeding torrents.
+func (this *Client) checkSeedingGoals() {
+	type candidate struct {
+		m *managedTorrent
+		policy *SeedingPolicy
+		seedingTime time.Duration
+		scrape bool
+	}
+	var candidates []candidate
+
+	now := time.Now()
+	this.mutex.Lock()
+	for _, key := range this.torrentOrder {
+		m := this.torrents[key]
+		policy := m.seedingPolicy
+		if policy == nil { policy = this.seedingPolicy }
+		if m.state != StateSeeding || policy == nil || m.seedingGoalReached { continue }
+		scrape := policy.MinSwarmSeeds > 0 && now.Sub(m.lastScrape) >= scrapeInterval
+		if scrape { m.lastScrape = now }
+		candidates = append(candidates, candidate{ m, policy, m.seedingTime(now), scrape })
+	}
+	this.mutex.Unlock()
+
+	for _, c := range candidates {
+		goal := SeedingGoal(-1)
+		if c.policy.Ratio > 0 && shareRatio(c.m.torrent) >= c.policy.Ratio {
+			goal = GoalRatio
+		} else if c.policy.Duration > 0 && c.seedingTime >= c.policy.Duration {
+			goal = GoalDuration
+		} else if c.scrape {
+			// The tracker counts this client as one of the seeds.
+			result, err := c.m.torrent.ScrapeContext(this.ctx)
+			if err == nil && result.Complete - 1 >= c.policy.MinSwarmSeeds { goal = GoalSwarmSeeds }
+		}
+		if goal < 0 { continue }
+		this.seedingGoalReached(c.m, goal, c.policy.Action)
+	}
+}
+
+func (this *Client) seedingGoalReached(m *managedTorrent, goal SeedingGoal, action SeedingAction) {
+	this.mutex.Lock()
+	if this.torrents[m.torrent.InfoHashHex()] != m || m.state != StateSeeding {
+		this.mutex.Unlock()
+		return
+	}
+	m.seedingGoalReached = true
+	var done chan bool
+	if action == SeedingActionPause {
+		done = this.stopTorrent(m, StatePaused)
+		this.schedule()
+	}
+	this.mutex.Unlock()
+
+	if action == SeedingActionRemove {
+		this.RemoveTorrent(m.torrent.InfoHash())
+	} else if done != nil {
+		<-done
+	}
+
+	event := newEvent(EventSeedingGoalReached, m.torrent)
+	event.Goal = goal
+	m.torrent.emit(event)
+}
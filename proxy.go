@@ -0,0 +1,163 @@
+package torrent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 (RFC 1928) client, with username/password authentication (RFC
+// 1929), through which peer connections are made. Only the CONNECT command
+// is supported: UDP ASSOCIATE would only serve UDP trackers, which aren't.
+
+// ProxySettings configures the proxies of outgoing connections. Each
+// subsystem goes through its proxy only if its toggle is set.
+type ProxySettings struct {
+	HttpUrl string // "http://" or "https://" proxy of trackers and web seeds
+	Socks5Address string // "host:port" of the SOCKS5 proxy of peers
+	Socks5Username string // Optional
+	Socks5Password string
+	Trackers bool // Including the download of .torrent files
+	WebSeeds bool
+	Peers bool // uTP is then not used for outgoing connections
+}
+
+const (
+	socks5Version = 0x05
+	socks5AuthVersion = 0x01
+	socks5NoAuth = 0x00
+	socks5UserPass = 0x02
+	socks5Connect = 0x01
+	socks5AddrIPv4 = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6 = 0x04
+)
+
+var ErrProxyAuthentication = errors.New("proxy authentication failed")
+var ErrInvalidProxyResponse = errors.New("invalid proxy response")
+
+var socks5Replies = []string{ "succeeded", "general failure", "connection not allowed", "network unreachable", "host unreachable", "connection refused", "TTL expired", "command not supported", "address type not supported" }
+
+// ProxyError is returned when the SOCKS5 proxy fails to connect to the peer.
+// Reply is the reply code of the proxy.
+type ProxyError struct {
+	Address string
+	Reply byte
+}
+
+func (this *ProxyError) Error() string {
+	reason := "reply " + strconv.Itoa(int(this.Reply))
+	if int(this.Reply) < len(socks5Replies) { reason = socks5Replies[this.Reply] }
+	return "proxy cannot connect to " + this.Address + ": " + reason
+}
+
+func (this *ProxySettings) httpProxy(enabled bool) *url.URL {
+	if !enabled { return nil }
+	output, err := url.Parse(this.HttpUrl)
+	if err != nil { return nil }
+	return output
+}
+
+func (this *ProxySettings) validHttpUrl() bool {
+	proxyUrl, err := url.Parse(this.HttpUrl)
+	return err == nil && (proxyUrl.Scheme == "http" || proxyUrl.Scheme == "https") && proxyUrl.Host != ""
+}
+
+// dialSocks5 connects to the address through the SOCKS5 proxy.
+func (this *ProxySettings) dialSocks5(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	conn, err := dialTCP(ctx, this.Socks5Address, timeout)
+	if err != nil { return nil, err }
+	conn.SetDeadline(time.Now().Add(timeout))
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	err = socks5Handshake(conn, this.Socks5Username, this.Socks5Password, address)
+	if !stop() { return nil, ctx.Err() }
+	if err != nil { conn.Close(); return nil, err }
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func socks5Handshake(conn io.ReadWriter, username string, password string, address string) error {
+	destination, err := socks5Address(address)
+	if err != nil { return err }
+	methods := []byte{ socks5NoAuth }
+	if username != "" { methods = append(methods, socks5UserPass) }
+	_, err = conn.Write(append([]byte{ socks5Version, byte(len(methods)) }, methods...))
+	if err != nil { return err }
+
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil { return err }
+	if reply[0] != socks5Version { return ErrInvalidProxyResponse }
+	switch reply[1] {
+		case socks5NoAuth:
+		case socks5UserPass:
+			if username == "" { return ErrInvalidProxyResponse }
+			err = socks5Authenticate(conn, username, password)
+			if err != nil { return err }
+		default:
+			return ErrProxyAuthentication
+	}
+
+	_, err = conn.Write(append([]byte{ socks5Version, socks5Connect, 0 }, destination...))
+	if err != nil { return err }
+	// The reply ends with the address the proxy bound, which is ignored.
+	header := make([]byte, 4)
+	_, err = io.ReadFull(conn, header)
+	if err != nil { return err }
+	if header[0] != socks5Version { return ErrInvalidProxyResponse }
+	if header[1] != 0 { return &ProxyError{ Address: address, Reply: header[1] } }
+	var addressLength int
+	switch header[3] {
+		case socks5AddrIPv4: addressLength = net.IPv4len
+		case socks5AddrIPv6: addressLength = net.IPv6len
+		case socks5AddrDomain:
+			length := make([]byte, 1)
+			_, err = io.ReadFull(conn, length)
+			if err != nil { return err }
+			addressLength = int(length[0])
+		default:
+			return ErrInvalidProxyResponse
+	}
+	_, err = io.ReadFull(conn, make([]byte, addressLength + 2))
+	return err
+}
+
+func socks5Authenticate(conn io.ReadWriter, username string, password string) error {
+	request := []byte{ socks5AuthVersion, byte(len(username)) }
+	request = append(request, username...)
+	request = append(request, byte(len(password)))
+	request = append(request, password...)
+	_, err := conn.Write(request)
+	if err != nil { return err }
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil { return err }
+	if reply[0] != socks5AuthVersion { return ErrInvalidProxyResponse }
+	if reply[1] != 0 { return ErrProxyAuthentication }
+	return nil
+}
+
+// socks5Address encodes a "host:port" address as the type, address and port
+// of a SOCKS5 request. Host names are resolved by the proxy.
+func socks5Address(address string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil { return nil, err }
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil { return nil, err }
+	var output []byte
+	ip := net.ParseIP(host)
+	if ip.To4() != nil {
+		output = append([]byte{ socks5AddrIPv4 }, ip.To4()...)
+	} else if ip != nil {
+		output = append([]byte{ socks5AddrIPv6 }, ip.To16()...)
+	} else {
+		if len(host) == 0 || len(host) > 255 { return nil, &net.AddrError{ Err: "invalid host name", Addr: address } }
+		output = append([]byte{ socks5AddrDomain, byte(len(host)) }, host...)
+	}
+	return binary.BigEndian.AppendUint16(output, uint16(port)), nil
+}
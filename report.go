@@ -0,0 +1,239 @@
+package torrent
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"torrent/bencoding"
+)
+
+// FileTreeNode is a file or directory of a torrent. The size of a directory
+// is the total size of the files it contains.
+type FileTreeNode struct {
+	Name string
+	Size int
+	Index int // Index of the file in the torrent, -1 for directories
+	Selected bool
+	Children []*FileTreeNode `json:",omitempty"`
+}
+
+// Report describes the content of a torrent, in a form suitable for
+// displaying to users or serializing to JSON.
+type Report struct {
+	InfoHashHex string
+	InfoHashBase32 string
+	InfoHashV2Hex string // Empty for v1 torrents
+	Version string
+	Name string
+	TotalSize int
+	SelectedSize int
+	PieceLength int
+	PieceCount int
+	FileCount int
+	Files *FileTreeNode
+	Private bool
+	Trackers [][]string
+	WebSeeds []string
+	HttpSeeds []string
+	CreationDate time.Time
+	CreatedBy string
+	Comment string
+	Warnings []string
+}
+
+func (this *Torrent) IsPrivate() bool {
+	private, err := this.MetaInfo().GetInt("info", "private")
+	return err == nil && private == 1
+}
+
+// WebSeeds returns the URLs of the "url-list" key (BEP 19), which may be a
+// single string or a list.
+func (this *Torrent) WebSeeds() []string {
+	var output []string
+	urlList, ok := this.MetaInfo().Get("url-list")
+	if !ok { return output }
+	if urlList.Type == bencoding.String {
+		if urlList.AsString != "" { output = append(output, urlList.AsString) }
+		return output
+	}
+	for _, e := range urlList.AsList {
+		if e.Type == bencoding.String && e.AsString != "" { output = append(output, e.AsString) }
+	}
+	return output
+}
+
+func (this *Torrent) CreationDate() time.Time {
+	date, err := this.MetaInfo().GetInt("creation date")
+	if err != nil || date <= 0 { return time.Time{} }
+	return time.Unix(int64(date), 0).UTC()
+}
+
+func (this *Torrent) fileTree() *FileTreeNode {
+	if this.IsSingleFile() {
+		return &FileTreeNode{ Name: this.Name(), Size: this.TotalFileSize(), Index: 0, Selected: this.FileIndexIsSelected(0) }
+	}
+
+	root := &FileTreeNode{ Name: this.Name(), Index: -1 }
+	for i, file := range this.Files() {
+		node := root
+		// The first component is the name of the torrent, i.e. the root.
+		path := file.Path[1:]
+		for j, component := range path {
+			var child *FileTreeNode
+			isFile := j == len(path) - 1
+			if !isFile {
+				for _, c := range node.Children {
+					if c.Name == component && c.Index < 0 { child = c }
+				}
+			}
+			if child == nil {
+				child = &FileTreeNode{ Name: component, Index: -1 }
+				node.Children = append(node.Children, child)
+			}
+			child.Size += file.Length
+			if isFile {
+				child.Index = i
+				child.Selected = this.FileIndexIsSelected(i)
+			}
+			node = child
+		}
+		root.Size += file.Length
+	}
+	return root
+}
+
+// reportWarnings looks for content that is valid but suspicious, such as
+// paths that would escape the download directory.
+func (this *Torrent) reportWarnings() []string {
+	var output []string
+
+	pieces, _ := this.MetaInfo().GetString("info", "pieces")
+	if len(pieces) == 0 && this.Version() != TorrentV2 { output = append(output, "the pieces field is empty") }
+
+	pieceLength := this.PieceLength()
+	if pieceLength <= 0 { return append(output, "the piece length is invalid") }
+	expectedPieceCount := (dataSize(this.files) + pieceLength - 1) / pieceLength
+	if len(pieces) > 0 && expectedPieceCount != this.PieceCount() {
+		output = append(output, fmt.Sprintf("the torrent has %d pieces but its size requires %d", this.PieceCount(), expectedPieceCount))
+	}
+
+	_, changes, _ := NewPathSanitizer().SanitizeFiles(this.Files())
+	for _, change := range changes {
+		output = append(output, "unsafe path, " + change.String())
+	}
+
+	if this.IsPrivate() && len(this.Trackers()) == 0 { output = append(output, "the torrent is private but has no tracker") }
+
+	for _, seedUrl := range append(this.WebSeeds(), this.HttpSeeds()...) {
+		if !isHttpUrl(seedUrl) { output = append(output, "unsupported web seed, ignored: " + seedUrl) }
+	}
+
+	return output
+}
+
+// Report returns a summary of the content of the torrent.
+func (this *Torrent) Report() *Report {
+	output := new(Report)
+	infoHash := this.InfoHash()
+	output.InfoHashHex = this.InfoHashHex()
+	output.InfoHashBase32 = base32.StdEncoding.EncodeToString(infoHash)
+	output.InfoHashV2Hex = hex.EncodeToString(this.InfoHashV2())
+	output.Version = this.Version().String()
+	output.Name = this.Name()
+	output.TotalSize = this.TotalFileSize()
+	output.SelectedSize = this.SelectedFileSize()
+	output.PieceLength = this.PieceLength()
+	output.PieceCount = this.PieceCount()
+	output.FileCount = this.FileCount()
+	output.Files = this.fileTree()
+	output.Private = this.IsPrivate()
+	output.Trackers = this.Trackers()
+	output.WebSeeds = this.WebSeeds()
+	output.HttpSeeds = this.HttpSeeds()
+	output.CreationDate = this.CreationDate()
+	output.CreatedBy, _ = this.MetaInfo().GetString("created by")
+	output.Comment, _ = this.MetaInfo().GetString("comment")
+	output.Warnings = this.reportWarnings()
+	return output
+}
+
+// FormatSize returns a human-readable size such as "1.5 MiB".
+func FormatSize(size int) string {
+	units := []string{ "B", "KiB", "MiB", "GiB", "TiB" }
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units) - 1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 { return fmt.Sprintf("%d B", size) }
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+func (this *FileTreeNode) format(builder *strings.Builder, indent string) {
+	selected := " "
+	if this.Index >= 0 && !this.Selected { selected = "-" }
+	name := this.Name
+	if this.Index < 0 { name += "/" }
+	fmt.Fprintf(builder, "  %s %10s  %s%s\n", selected, FormatSize(this.Size), indent, name)
+	children := make([]*FileTreeNode, len(this.Children))
+	copy(children, this.Children)
+	sort.SliceStable(children, func(i, j int) bool { return children[i].Name < children[j].Name })
+	for _, child := range children {
+		child.format(builder, indent + "  ")
+	}
+}
+
+// String formats the report as text.
+func (this *Report) String() string {
+	var builder strings.Builder
+	line := func(label string, format string, args ...interface{}) {
+		fmt.Fprintf(&builder, "%-18s" + format + "\n", append([]interface{}{ label + ":" }, args...)...)
+	}
+
+	line("Name", "%s", this.Name)
+	line("Info hash", "%s", this.InfoHashHex)
+	line("Info hash (b32)", "%s", this.InfoHashBase32)
+	if this.InfoHashV2Hex != "" { line("Info hash (v2)", "%s", this.InfoHashV2Hex) }
+	line("Version", "%s", this.Version)
+	line("Total size", "%s (%d bytes)", FormatSize(this.TotalSize), this.TotalSize)
+	if this.SelectedSize != this.TotalSize { line("Selected size", "%s (%d bytes)", FormatSize(this.SelectedSize), this.SelectedSize) }
+	line("Pieces", "%d x %s", this.PieceCount, FormatSize(this.PieceLength))
+	line("Private", "%v", this.Private)
+	if !this.CreationDate.IsZero() { line("Created on", "%s", this.CreationDate.Format(time.RFC3339)) }
+	if this.CreatedBy != "" { line("Created by", "%s", this.CreatedBy) }
+	if this.Comment != "" { line("Comment", "%s", this.Comment) }
+
+	builder.WriteString("Trackers:\n")
+	for i, tier := range this.Trackers {
+		for _, url := range tier {
+			fmt.Fprintf(&builder, "  [tier %d] %s\n", i, url)
+		}
+	}
+	if len(this.WebSeeds) > 0 {
+		builder.WriteString("Web seeds:\n")
+		for _, url := range this.WebSeeds {
+			fmt.Fprintf(&builder, "  %s\n", url)
+		}
+	}
+	if len(this.HttpSeeds) > 0 {
+		builder.WriteString("HTTP seeds:\n")
+		for _, url := range this.HttpSeeds {
+			fmt.Fprintf(&builder, "  %s\n", url)
+		}
+	}
+
+	fmt.Fprintf(&builder, "Files (%d):\n", this.FileCount)
+	this.Files.format(&builder, "")
+
+	if len(this.Warnings) > 0 {
+		builder.WriteString("Warnings:\n")
+		for _, warning := range this.Warnings {
+			fmt.Fprintf(&builder, "  %s\n", warning)
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,207 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var ErrUnsafePath = errors.New("unsafe path")
+
+type PathPolicy int
+
+const (
+	// Unsafe paths are rewritten to safe equivalents.
+	PathPolicyRewrite PathPolicy = iota
+	// Torrents with unsafe paths are rejected.
+	PathPolicyReject
+)
+
+const defaultMaxComponentLength = 255
+
+// Names that cannot be used as file names on Windows, with or without an
+// extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// PathSanitizer makes the file paths of a torrent, which come from untrusted
+// .torrent files, safe to use on the local file system.
+type PathSanitizer struct {
+	Policy PathPolicy
+	MaxComponentLength int // In bytes
+	RewriteReservedNames bool // Rewrite the names reserved on Windows, whatever the current OS
+}
+
+// PathChange describes a path that has been rewritten, or that was rejected.
+type PathChange struct {
+	FileIndex int
+	Original []string
+	Sanitized []string
+	Reasons []string
+}
+
+func (this PathChange) String() string {
+	return fmt.Sprintf("file %d: %q -> %q (%s)", this.FileIndex, strings.Join(this.Original, "/"), strings.Join(this.Sanitized, "/"), strings.Join(this.Reasons, ", "))
+}
+
+// UnsafePathError is returned when a path is rejected.
+type UnsafePathError struct {
+	Change PathChange
+}
+
+func (this *UnsafePathError) Error() string {
+	return ErrUnsafePath.Error() + ": " + this.Change.String()
+}
+
+func (this *UnsafePathError) Unwrap() error {
+	return ErrUnsafePath
+}
+
+func NewPathSanitizer() *PathSanitizer {
+	output := new(PathSanitizer)
+	output.Policy = PathPolicyRewrite
+	output.MaxComponentLength = defaultMaxComponentLength
+	output.RewriteReservedNames = true
+	return output
+}
+
+func isInvalidPathChar(r rune) bool {
+	if r < 0x20 || r == 0x7f { return true }
+	return strings.ContainsRune("/\\:*?\"<>|", r)
+}
+
+// truncateComponent shortens a component to the given number of bytes,
+// keeping its extension and without cutting UTF-8 sequences.
+func truncateComponent(component string, maxLength int) string {
+	extension := filepath.Ext(component)
+	if len(extension) > maxLength / 2 { extension = "" }
+	base := component[:len(component) - len(extension)]
+	base = base[:maxLength - len(extension)]
+	for len(base) > 0 && !utf8.ValidString(base) {
+		base = base[:len(base) - 1]
+	}
+	return base + extension
+}
+
+// SanitizeComponent returns a safe version of a path component and the
+// reasons why it was changed, if it was.
+func (this *PathSanitizer) SanitizeComponent(component string) (string, []string) {
+	var reasons []string
+	output := component
+
+	if strings.ContainsRune(output, 0) {
+		output = strings.Replace(output, "\x00", "", -1)
+		reasons = append(reasons, "NUL byte")
+	}
+
+	if !utf8.ValidString(output) {
+		output = strings.ToValidUTF8(output, "_")
+		reasons = append(reasons, "invalid UTF-8")
+	}
+
+	if strings.IndexFunc(output, isInvalidPathChar) >= 0 {
+		reason := "invalid character"
+		if strings.ContainsAny(output, "/\\") { reason = "path separator" }
+		output = strings.Map(func(r rune) rune {
+			if isInvalidPathChar(r) { return '_' }
+			return r
+		}, output)
+		reasons = append(reasons, reason)
+	}
+
+	if output == "." || output == ".." {
+		output = strings.Repeat("_", len(output))
+		reasons = append(reasons, "relative component")
+	}
+
+	trimmed := strings.TrimRight(output, ". ")
+	if trimmed != output && trimmed != "" {
+		output = trimmed
+		reasons = append(reasons, "trailing dot or space")
+	}
+
+	if this.RewriteReservedNames {
+		name := strings.ToUpper(output)
+		if i := strings.Index(name, "."); i >= 0 { name = name[:i] }
+		if reservedNames[name] {
+			output = "_" + output
+			reasons = append(reasons, "reserved name")
+		}
+	}
+
+	if this.MaxComponentLength > 0 && len(output) > this.MaxComponentLength {
+		output = truncateComponent(output, this.MaxComponentLength)
+		reasons = append(reasons, "name too long")
+	}
+
+	return output, reasons
+}
+
+// SanitizePath returns a safe version of a relative path. Empty components
+// are removed, and an empty path becomes "_".
+func (this *PathSanitizer) SanitizePath(path []string) ([]string, []string) {
+	var output []string
+	var reasons []string
+	for _, component := range path {
+		if component == "" {
+			reasons = append(reasons, "empty component")
+			continue
+		}
+		sanitized, componentReasons := this.SanitizeComponent(component)
+		output = append(output, sanitized)
+		reasons = append(reasons, componentReasons...)
+	}
+	if len(output) == 0 {
+		output = []string{ "_" }
+		reasons = append(reasons, "empty path")
+	}
+	return output, reasons
+}
+
+// SanitizeFiles returns the files with safe paths, and the list of the
+// paths that have been rewritten. With PathPolicyReject, the first unsafe
+// path is returned as an *UnsafePathError instead. Paths that are duplicates once
+// sanitized, ignoring case, get a numeric suffix so that files don't
+// overwrite each other.
+func (this *PathSanitizer) SanitizeFiles(files []FileInfo) ([]FileInfo, []PathChange, error) {
+	output := make([]FileInfo, len(files))
+	var changes []PathChange
+	seenPaths := make(map[string]bool)
+
+	for i, file := range files {
+		path, reasons := this.SanitizePath(file.Path)
+
+		key := strings.ToLower(strings.Join(path, "/"))
+		if seenPaths[key] {
+			last := path[len(path) - 1]
+			for n := 1; seenPaths[key]; n++ {
+				suffix := " (" + strconv.Itoa(n) + ")"
+				name := last
+				if this.MaxComponentLength > 0 && len(name) + len(suffix) > this.MaxComponentLength {
+					name = truncateComponent(name, this.MaxComponentLength - len(suffix))
+				}
+				extension := filepath.Ext(name)
+				path[len(path) - 1] = name[:len(name) - len(extension)] + suffix + extension
+				key = strings.ToLower(strings.Join(path, "/"))
+			}
+			reasons = append(reasons, "duplicate path")
+		}
+		seenPaths[key] = true
+
+		output[i] = file
+		output[i].Path = path
+
+		if len(reasons) == 0 { continue }
+		change := PathChange{ FileIndex: i, Original: file.Path, Sanitized: path, Reasons: reasons }
+		if this.Policy == PathPolicyReject { return nil, nil, &UnsafePathError{ change } }
+		changes = append(changes, change)
+	}
+
+	return output, changes, nil
+}
@@ -0,0 +1,283 @@
+package torrent
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	peerHandshakeTimeout = 30 * time.Second
+	// Size of the allowed fast sets given to peers (BEP 6).
+	allowedFastCount = 10
+)
+
+// Seeder serves the pieces of a torrent to the peers that connect to it.
+type Seeder struct {
+	client *Client
+	torrent *Torrent
+	storage *FileStorage
+	have Bitfield
+
+	mutex sync.Mutex
+	listener net.Listener
+	connections map[*PeerConn]bool
+	closed bool
+	stopAnnounce chan bool
+	ctx context.Context // Cancelled by Close
+	cancel context.CancelFunc
+	announcing sync.WaitGroup
+}
+
+// NewSeeder creates a seeder for the pieces in `have`, typically the result
+// of Torrent.Verify or Downloader.Have.
+func (this *Client) NewSeeder(torr *Torrent, storage *FileStorage, have Bitfield) *Seeder {
+	output := new(Seeder)
+	output.client = this
+	output.torrent = torr
+	output.storage = storage
+	output.have = have
+	output.connections = make(map[*PeerConn]bool)
+	output.stopAnnounce = make(chan bool)
+	output.ctx, output.cancel = context.WithCancel(context.Background())
+	torr.setHave(have)
+	return output
+}
+
+func (this *Seeder) announce(ctx context.Context, event string) (time.Duration, error) {
+	query := this.client.NewTrackerQuery(this.torrent, event)
+	response, err := this.torrent.CallTrackerContext(ctx, query)
+	if err != nil { return trackerRetryInterval, err }
+	return TrackerInterval(response), nil
+}
+
+// startAnnouncing announces to the trackers until Close is called. The result
+// of the first announce is sent to `errors`, which may be nil.
+func (this *Seeder) startAnnouncing(errors chan<- error) {
+	this.announcing.Add(1)
+	go func() {
+		defer this.announcing.Done()
+		this.announceLoop(errors)
+	}()
+}
+
+func (this *Seeder) announceLoop(errors chan<- error) {
+	event := "started"
+	for {
+		interval, err := this.announce(this.ctx, event)
+		if errors != nil {
+			errors <- err
+			errors = nil
+		}
+		// An announce aborted by Close may have reached the tracker, which is
+		// then told that we stopped.
+		if err == nil || this.ctx.Err() != nil { event = "" }
+		select {
+			case <-time.After(interval):
+			case <-this.stopAnnounce:
+				if event == "" { this.announce(context.Background(), "stopped") }
+				return
+		}
+	}
+}
+
+// Serve accepts connections on the listener until Close is called. If the
+// torrent has trackers, the seeder announces itself and Serve returns the
+// error of the first announce if it fails.
+func (this *Seeder) Serve(listener net.Listener) error {
+	this.mutex.Lock()
+	this.listener = listener
+	this.mutex.Unlock()
+
+	if len(this.torrent.Trackers()) > 0 {
+		announceErrors := make(chan error, 1)
+		this.startAnnouncing(announceErrors)
+		err := <-announceErrors
+		if err != nil {
+			this.Close()
+			return err
+		}
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			this.mutex.Lock()
+			closed := this.closed
+			this.mutex.Unlock()
+			if closed { return nil }
+			return err
+		}
+		go this.servePeer(conn)
+	}
+}
+
+// Close stops serving peers and returns once the "stopped" event has been
+// announced.
+func (this *Seeder) Close() error {
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		return nil
+	}
+	this.closed = true
+	close(this.stopAnnounce)
+	this.cancel()
+	for conn, _ := range this.connections {
+		conn.Close()
+	}
+	var err error
+	if this.listener != nil { err = this.listener.Close() }
+	this.mutex.Unlock()
+
+	this.announcing.Wait()
+	return err
+}
+
+func (this *Seeder) servePeer(netConn net.Conn) {
+	infoHashes := [][]byte{ this.torrent.InfoHash() }
+	conn, _, err := AcceptPeerEncrypted(netConn, this.client.PeerId(), infoHashes, this.client.EncryptionPolicy(), peerHandshakeTimeout)
+	if err != nil {
+		netConn.Close()
+		return
+	}
+	this.serveConn(conn)
+}
+
+// serveConn serves a peer whose handshake has been done.
+func (this *Seeder) serveConn(conn *PeerConn) {
+	if !this.client.acquireConnection() {
+		conn.Close()
+		return
+	}
+	defer this.client.releaseConnection()
+
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	this.connections[conn] = true
+	this.mutex.Unlock()
+	this.torrent.addPeer(conn)
+
+	defer func() {
+		this.mutex.Lock()
+		delete(this.connections, conn)
+		this.mutex.Unlock()
+		conn.Close()
+		this.torrent.removePeer(conn)
+	}()
+
+	err := conn.writeHave(this.have, this.torrent.PieceCount())
+	if err != nil { return }
+	if conn.SupportsFast() {
+		for _, index := range allowedFastSet(addrIP(conn.RemoteAddr()), this.torrent.InfoHash(), this.torrent.PieceCount(), allowedFastCount) {
+			if !this.have.Has(index) { continue }
+			err = conn.WriteAllowedFast(index)
+			if err != nil { return }
+		}
+	}
+
+	for {
+		message, err := conn.ReadMessage()
+		if err != nil { return }
+		if message == nil { continue }
+
+		switch message.Id {
+
+			case MsgHave:
+
+				index, err := message.ParseHave()
+				if err != nil { return }
+				this.torrent.setPeerPieces(conn, index)
+
+			case MsgBitfield:
+
+				var pieces []int
+				for i := 0; i < this.torrent.PieceCount(); i++ {
+					if Bitfield(message.Payload).Has(i) { pieces = append(pieces, i) }
+				}
+				this.torrent.setPeerPieces(conn, pieces...)
+
+			case MsgHaveAll, MsgHaveNone:
+
+				if !conn.SupportsFast() { return }
+				if message.Id == MsgHaveNone { continue }
+				pieces := make([]int, this.torrent.PieceCount())
+				for i, _ := range pieces {
+					pieces[i] = i
+				}
+				this.torrent.setPeerPieces(conn, pieces...)
+
+			case MsgInterested:
+
+				err = conn.WriteMessage(MsgUnchoke, nil)
+				if err != nil { return }
+
+			case MsgRequest:
+
+				index, begin, length, err := message.ParseRequest()
+				if err != nil { return }
+				if !this.have.Has(index) || length <= 0 || length > maxRequestLength || begin + length > this.torrent.PieceSize(index) {
+					// With the Fast extension, requests are rejected instead
+					// of silently dropped.
+					if !conn.SupportsFast() { return }
+					err = conn.WriteRejectRequest(index, begin, length)
+					if err != nil { return }
+					continue
+				}
+				block := make([]byte, length)
+				offset := int64(index) * int64(this.torrent.PieceLength()) + int64(begin)
+				_, err = this.storage.ReadAt(block, offset)
+				if err != nil {
+					event := newEvent(EventStorageError, this.torrent)
+					event.PieceIndex = index
+					event.Err = err
+					this.torrent.emit(event)
+					return
+				}
+				this.client.uploadLimiter.wait(length)
+				err = conn.WritePiece(index, begin, block)
+				if err != nil { return }
+				this.torrent.addUploaded(length)
+
+			case MsgHashRequest:
+
+				request, err := message.ParseHashRequest()
+				if err != nil { return }
+				hashes, ok := this.torrent.hashesForRequest(request)
+				if ok {
+					err = conn.WriteHashes(request, hashes)
+				} else {
+					err = conn.WriteHashReject(request)
+				}
+				if err != nil { return }
+		}
+	}
+}
+
+// hashesForRequest returns the hashes of a hash request followed by their
+// uncle hashes. Only the piece layers, which the meta info carries, are
+// served.
+func (this *Torrent) hashesForRequest(request *HashRequest) ([][]byte, bool) {
+	pieceLength := this.PieceLength()
+	if request.BaseLayer != log2(pieceLength / merkleBlockSize) { return nil, false }
+	if request.Length <= 0 || nextPowerOfTwo(request.Length) != request.Length || request.Index % request.Length != 0 { return nil, false }
+	layer, err := this.MetaInfo().GetString("piece layers", string(request.PiecesRoot))
+	if err != nil { return nil, false }
+
+	layers := merkleLayers(splitHashes(layer), pieceLength)
+	if request.Index + request.Length > len(layers[0]) { return nil, false }
+	output := slices.Clone(layers[0][request.Index : request.Index + request.Length])
+	height := log2(request.Length)
+	position := request.Index / request.Length
+	for i := 0; i < request.ProofLayers && height + i < len(layers) - 1; i++ {
+		output = append(output, layers[height + i][position ^ 1])
+		position /= 2
+	}
+	return output, true
+}
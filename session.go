@@ -0,0 +1,536 @@
+package torrent
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+	"torrent/utp"
+)
+
+var ErrDuplicateTorrent = errors.New("torrent already added")
+var ErrTorrentNotFound = errors.New("torrent not found")
+var ErrClientClosed = errors.New("client closed")
+
+type TorrentState int
+
+const (
+	// Waiting for a download or seed slot.
+	StateQueued TorrentState = iota
+	// Verifying the data already on disk.
+	StateChecking
+	StateDownloading
+	StateSeeding
+	StatePaused
+	// Stopped because of an error, see Client.TorrentError.
+	StateError
+)
+
+var torrentStateNames = []string{ "queued", "checking", "downloading", "seeding", "paused", "error" }
+
+func (this TorrentState) String() string {
+	if this < 0 || int(this) >= len(torrentStateNames) { return "unknown" }
+	return torrentStateNames[this]
+}
+
+// SessionLimits are the limits shared by all the torrents of a client. Zero
+// means unlimited.
+type SessionLimits struct {
+	MaxActiveDownloads int
+	MaxActiveSeeds int
+	MaxConnections int
+	DownloadRateLimit int // In bytes per second
+	UploadRateLimit int // In bytes per second
+}
+
+func NewSessionLimits() *SessionLimits {
+	output := new(SessionLimits)
+	output.MaxActiveDownloads = 3
+	output.MaxActiveSeeds = 5
+	output.MaxConnections = 200
+	return output
+}
+
+// rateLimiter is a token bucket shared by all the connections of a client.
+// The zero value doesn't limit anything.
+type rateLimiter struct {
+	mutex sync.Mutex
+	rate int
+	tokens float64
+	last time.Time
+}
+
+func (this *rateLimiter) setRate(rate int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.rate = rate
+	this.tokens = 0
+	this.last = time.Now()
+}
+
+// wait blocks until n bytes can be transferred.
+func (this *rateLimiter) wait(n int) {
+	this.mutex.Lock()
+	if this.rate <= 0 {
+		this.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	this.tokens = min(this.tokens + now.Sub(this.last).Seconds() * float64(this.rate), float64(this.rate))
+	this.last = now
+	this.tokens -= float64(n)
+	delay := time.Duration(-this.tokens / float64(this.rate) * float64(time.Second))
+	this.mutex.Unlock()
+	if delay > 0 { time.Sleep(delay) }
+}
+
+// managedTorrent is a torrent added to the session of a client.
+type managedTorrent struct {
+	torrent *Torrent
+	storage *FileStorage
+	state TorrentState
+	err error
+	have Bitfield // Nil until the data has been checked
+	downloader *Downloader
+	seeder *Seeder
+	done chan bool // Closed when the download goroutine returns, nil if none is running
+
+	seedingPolicy *SeedingPolicy // Nil to use the policy of the client
+	seedingGoalReached bool
+	seedingSince time.Time
+	seedingDuration time.Duration // Before seedingSince
+	lastScrape time.Time
+}
+
+func (this *managedTorrent) isComplete() bool {
+	if this.have == nil { return false }
+	for i, wanted := range this.torrent.WantedPieces() {
+		if wanted && !this.have.Has(i) { return false }
+	}
+	return true
+}
+
+func (this *Client) SetSessionLimits(limits *SessionLimits) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.limits = limits
+	this.downloadLimiter.setRate(limits.DownloadRateLimit)
+	this.uploadLimiter.setRate(limits.UploadRateLimit)
+	this.schedule()
+}
+
+func (this *Client) acquireConnection() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.limits.MaxConnections > 0 && this.connectionCount >= this.limits.MaxConnections { return false }
+	this.connectionCount++
+	return true
+}
+
+func (this *Client) releaseConnection() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.connectionCount--
+}
+
+// AddTorrent adds a torrent to the session. Its files are stored in `dir`,
+// or in the StorageRoot of the configuration if empty, and it is started as
+// soon as the limits allow it.
+func (this *Client) AddTorrent(torr *Torrent, dir string) error {
+	if torr.MetaInfo() == nil { return ErrInvalidMetaInfo }
+	if dir == "" { dir = this.config.StorageRoot }
+	storage := NewFileStorage(torr, dir)
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed { return ErrClientClosed }
+	key := torr.InfoHashHex()
+	if _, ok := this.torrents[key]; ok { return ErrDuplicateTorrent }
+	torr.client = this
+	this.torrents[key] = &managedTorrent{ torrent: torr, storage: storage, state: StateQueued }
+	this.torrentOrder = append(this.torrentOrder, key)
+	if !this.policyLoopStarted {
+		this.policyLoopStarted = true
+		this.background.Add(1)
+		go this.policyLoop()
+	}
+	this.schedule()
+	return nil
+}
+
+func (this *Client) managedTorrent(infoHash []byte) (*managedTorrent, error) {
+	output, ok := this.torrents[hex.EncodeToString(infoHash)]
+	if !ok { return nil, ErrTorrentNotFound }
+	return output, nil
+}
+
+// Torrents returns the torrents of the session, in the order they were
+// added.
+func (this *Client) Torrents() []*Torrent {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	output := make([]*Torrent, 0, len(this.torrentOrder))
+	for _, key := range this.torrentOrder {
+		output = append(output, this.torrents[key].torrent)
+	}
+	return output
+}
+
+func (this *Client) Torrent(infoHash []byte) (*Torrent, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	m, err := this.managedTorrent(infoHash)
+	if err != nil { return nil, err }
+	return m.torrent, nil
+}
+
+func (this *Client) TorrentState(infoHash []byte) (TorrentState, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	m, err := this.managedTorrent(infoHash)
+	if err != nil { return 0, err }
+	return m.state, nil
+}
+
+// TorrentError returns the error that stopped a torrent in StateError.
+func (this *Client) TorrentError(infoHash []byte) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	m, err := this.managedTorrent(infoHash)
+	if err != nil { return err }
+	return m.err
+}
+
+// stopTorrent stops the download or seeding of a torrent, and returns the
+// channel closed once the download goroutine has returned, if any. The
+// client mutex must be held.
+func (this *Client) stopTorrent(m *managedTorrent, state TorrentState) chan bool {
+	if m.state == StateSeeding { m.seedingDuration = m.seedingTime(time.Now()) }
+	m.state = state
+	if m.downloader != nil { m.downloader.Stop() }
+	if m.seeder != nil {
+		// Close waits for the "stopped" announce, so it must not hold the
+		// client mutex.
+		seeder := m.seeder
+		m.seeder = nil
+		done := make(chan bool)
+		this.background.Add(1)
+		go func() {
+			defer this.background.Done()
+			seeder.Close()
+			close(done)
+		}()
+		return done
+	}
+	return m.done
+}
+
+func (this *Client) PauseTorrent(infoHash []byte) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	m, err := this.managedTorrent(infoHash)
+	if err != nil { return err }
+	if m.state == StatePaused { return nil }
+	this.stopTorrent(m, StatePaused)
+	this.schedule()
+	return nil
+}
+
+// ResumeTorrent queues a paused torrent, or a torrent that stopped because
+// of an error.
+func (this *Client) ResumeTorrent(infoHash []byte) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	m, err := this.managedTorrent(infoHash)
+	if err != nil { return err }
+	if m.state != StatePaused && m.state != StateError { return nil }
+	m.state = StateQueued
+	m.err = nil
+	this.schedule()
+	return nil
+}
+
+// RemoveTorrent stops a torrent and removes it from the session. Its files
+// are left on disk.
+func (this *Client) RemoveTorrent(infoHash []byte) error {
+	this.mutex.Lock()
+	m, err := this.managedTorrent(infoHash)
+	if err != nil {
+		this.mutex.Unlock()
+		return err
+	}
+	done := this.stopTorrent(m, StatePaused)
+	key := hex.EncodeToString(infoHash)
+	delete(this.torrents, key)
+	for i, k := range this.torrentOrder {
+		if k == key {
+			this.torrentOrder = append(this.torrentOrder[:i], this.torrentOrder[i + 1:]...)
+			break
+		}
+	}
+	this.schedule()
+	this.mutex.Unlock()
+
+	if done != nil { <-done }
+	return m.storage.Close()
+}
+
+// schedule starts the queued torrents, in the order they were added, as long
+// as the limits allow it. The client mutex must be held.
+func (this *Client) schedule() {
+	if this.closed { return }
+	downloads := 0
+	seeds := 0
+	for _, m := range this.torrents {
+		switch m.state {
+			case StateChecking, StateDownloading: downloads++
+			case StateSeeding: seeds++
+		}
+	}
+
+	for _, key := range this.torrentOrder {
+		m := this.torrents[key]
+		if m.state != StateQueued { continue }
+		if m.isComplete() {
+			if this.limits.MaxActiveSeeds > 0 && seeds >= this.limits.MaxActiveSeeds { continue }
+			this.startSeeding(m)
+			if m.state == StateSeeding { seeds++ }
+		} else {
+			if this.limits.MaxActiveDownloads > 0 && downloads >= this.limits.MaxActiveDownloads { continue }
+			downloads++
+			m.state = StateChecking
+			m.done = make(chan bool)
+			this.background.Add(1)
+			go this.runDownload(m, m.done)
+		}
+	}
+}
+
+// runDownload checks the data of a torrent, if it hasn't been done yet, and
+// downloads the missing pieces. The torrent is queued again for seeding once
+// complete.
+func (this *Client) runDownload(m *managedTorrent, done chan bool) {
+	defer this.background.Done()
+	defer close(done)
+
+	this.mutex.Lock()
+	have := m.have
+	this.mutex.Unlock()
+
+	if have == nil {
+		var err error
+		have, err = m.torrent.Verify(m.storage, nil)
+		this.mutex.Lock()
+		if err == nil { m.have = have }
+		if m.state != StateChecking || m.done != done || this.closed {
+			// Paused, removed, restarted or closed in the meantime.
+			this.mutex.Unlock()
+			return
+		}
+		if err != nil {
+			m.state = StateError
+			m.err = err
+			this.schedule()
+			this.mutex.Unlock()
+			return
+		}
+		if m.isComplete() {
+			m.state = StateQueued
+			this.schedule()
+			this.mutex.Unlock()
+			return
+		}
+	} else {
+		this.mutex.Lock()
+	}
+
+	downloader := this.NewDownloader(m.torrent, m.storage, have)
+	m.downloader = downloader
+	m.state = StateDownloading
+	this.mutex.Unlock()
+
+	err := downloader.Run()
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if m.done != done {
+		// The torrent was paused and resumed while the downloader was
+		// stopping, and another goroutine has taken over.
+		return
+	}
+	m.downloader = nil
+	m.have = downloader.Have()
+	if m.state == StateDownloading && !this.closed {
+		if err == nil {
+			m.state = StateQueued
+		} else {
+			m.state = StateError
+			m.err = err
+		}
+	}
+	this.schedule()
+}
+
+// startSeeding creates the seeder of a complete torrent. Incoming
+// connections are dispatched to it by the listener of the client. The
+// client mutex must be held.
+func (this *Client) startSeeding(m *managedTorrent) {
+	err := this.listen("")
+	if err != nil {
+		m.state = StateError
+		m.err = err
+		return
+	}
+	m.seeder = this.NewSeeder(m.torrent, m.storage, m.have)
+	m.state = StateSeeding
+	m.seedingSince = time.Now()
+	if len(m.torrent.Trackers()) > 0 { m.seeder.startAnnouncing(nil) }
+}
+
+// Listen accepts incoming peer connections for the seeding torrents of the
+// session on the given address, such as ":6881". Otherwise, the client
+// listens on the ListenHost of the configuration on Port when the first
+// torrent starts seeding. Without a host, the client listens on both IPv4
+// and IPv6.
+func (this *Client) Listen(address string) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed { return ErrClientClosed }
+	return this.listen(address)
+}
+
+// listen accepts peers over TCP, and over uTP on the same UDP port if it is
+// enabled.
+func (this *Client) listen(address string) error {
+	if this.listener != nil { return nil }
+	if address == "" { address = net.JoinHostPort(this.config.ListenHost, strconv.Itoa(this.Port())) }
+	host, _, err := net.SplitHostPort(address)
+	if err != nil { return err }
+	listener, err := net.Listen("tcp", address)
+	if err != nil { return err }
+	port := listener.Addr().(*net.TCPAddr).Port
+	if this.config.EnableUtp {
+		utpSocket, err := utp.Listen(net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		this.utpSocket = utpSocket
+		this.background.Add(1)
+		go this.acceptLoop(utpSocket)
+	}
+	this.listener = listener
+	this.identityMutex.Lock()
+	this.port = port
+	this.identityMutex.Unlock()
+	this.background.Add(1)
+	go this.acceptLoop(listener)
+	return nil
+}
+
+// dial connects to a peer with uTP if the client listens on a uTP socket,
+// and falls back to TCP. Peers behind the SOCKS5 proxy are only reached over
+// TCP.
+func (this *Client) dial(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	if this.config.Proxy.Peers { return this.config.Proxy.dialSocks5(ctx, address, timeout) }
+	this.mutex.Lock()
+	utpSocket := this.utpSocket
+	this.mutex.Unlock()
+	if utpSocket != nil && canReach(utpSocket.Addr(), address) {
+		utpCtx, cancel := context.WithTimeout(ctx, min(timeout, utpConnectTimeout))
+		conn, err := utpSocket.DialContext(utpCtx, address)
+		cancel()
+		if err == nil { return conn, nil }
+		if ctx.Err() != nil { return nil, ctx.Err() }
+	}
+	return dialTCP(ctx, address, timeout)
+}
+
+// canReach tells whether a socket bound to the given address can send to
+// the given peer address: only dual-stack sockets, bound to "::", reach
+// peers of both address families.
+func canReach(local net.Addr, address string) bool {
+	localIP := addrIP(local)
+	host, _, err := net.SplitHostPort(address)
+	if err != nil { return false }
+	ip := net.ParseIP(host)
+	if localIP == nil || ip == nil || localIP.Equal(net.IPv6unspecified) { return true }
+	return (localIP.To4() == nil) == (ip.To4() == nil)
+}
+
+func (this *Client) acceptLoop(listener net.Listener) {
+	defer this.background.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil { return }
+		go this.acceptPeer(conn)
+	}
+}
+
+func (this *Client) acceptPeer(netConn net.Conn) {
+	var infoHashes [][]byte
+	this.mutex.Lock()
+	for _, key := range this.torrentOrder {
+		m := this.torrents[key]
+		if m.seeder != nil { infoHashes = append(infoHashes, m.torrent.InfoHash()) }
+	}
+	policy := this.encryptionPolicy
+	this.mutex.Unlock()
+
+	conn, infoHash, err := AcceptPeerEncrypted(netConn, this.PeerId(), infoHashes, policy, peerHandshakeTimeout)
+	if err != nil {
+		netConn.Close()
+		return
+	}
+	var seeder *Seeder
+	this.mutex.Lock()
+	m, err := this.managedTorrent(infoHash)
+	if err == nil { seeder = m.seeder }
+	this.mutex.Unlock()
+	if seeder == nil {
+		conn.Close()
+		return
+	}
+	seeder.serveConn(conn)
+}
+
+// Close stops all the torrents of the session, announcing the "stopped" event
+// to their trackers, and closes their files.
+func (this *Client) Close() error {
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		return nil
+	}
+	this.closed = true
+	this.cancel()
+	var waits []chan bool
+	for _, m := range this.torrents {
+		state := m.state
+		done := this.stopTorrent(m, state)
+		if done != nil { waits = append(waits, done) }
+	}
+	if this.listener != nil {
+		this.listener.Close()
+		if this.utpSocket != nil { this.utpSocket.Close() }
+	}
+	this.mutex.Unlock()
+
+	// Paused torrents may still be announcing "stopped".
+	for _, done := range waits {
+		<-done
+	}
+	this.background.Wait()
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	var output error
+	for _, m := range this.torrents {
+		err := m.storage.Close()
+		if err != nil && output == nil { output = err }
+	}
+	return output
+}
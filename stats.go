@@ -0,0 +1,373 @@
+package torrent
+
+import (
+	"sync"
+	"time"
+)
+
+// Rates are averaged over this number of seconds.
+const rateWindow = 10
+
+// rateMeter measures a transfer rate, as a moving average over the last
+// rateWindow seconds. It is not safe for concurrent use.
+type rateMeter struct {
+	buckets [rateWindow]int64
+	start int64
+	last int64
+}
+
+// advance moves the current bucket to the given second, clearing the buckets
+// of the seconds that have passed.
+func (this *rateMeter) advance(now time.Time) {
+	second := now.Unix()
+	if this.start == 0 {
+		this.start = second
+		this.last = second
+	}
+	if second - this.last >= rateWindow {
+		clear(this.buckets[:])
+	} else {
+		for s := this.last + 1; s <= second; s++ {
+			this.buckets[s % rateWindow] = 0
+		}
+	}
+	if second > this.last { this.last = second }
+}
+
+func (this *rateMeter) add(n int64, now time.Time) {
+	this.advance(now)
+	this.buckets[this.last % rateWindow] += n
+}
+
+// rate returns the average number of bytes per second.
+func (this *rateMeter) rate(now time.Time) float64 {
+	if this.start == 0 { return 0 }
+	this.advance(now)
+	var total int64
+	for _, n := range this.buckets {
+		total += n
+	}
+	elapsed := min(this.last - this.start + 1, rateWindow)
+	return float64(total) / float64(elapsed)
+}
+
+// FileProgress is the number of bytes of a file that have been downloaded
+// and verified.
+type FileProgress struct {
+	Index int
+	Length int
+	Completed int
+	Selected bool
+}
+
+// TorrentStats is a snapshot of the transfer statistics of a torrent. Byte
+// counts only include piece data, not protocol overhead.
+type TorrentStats struct {
+	Downloaded int64 // In this session
+	Uploaded int64 // In this session
+	TotalDownloaded int64 // Including previous sessions, see RestoreStats
+	TotalUploaded int64 // Including previous sessions, see RestoreStats
+	Wasted int64 // Pieces that failed the hash check, and duplicate or unrequested blocks
+	DownloadRate float64 // In bytes per second
+	UploadRate float64 // In bytes per second
+	Left int // Bytes of the selected files that are still missing
+	ETA time.Duration // -1 if unknown
+	ConnectedPeers int
+	HalfOpenPeers int // Connections being established
+	KnownPeers int // Peers received from trackers or added manually
+	Seeds int // Connected peers that have all the pieces
+	Leechers int
+	Availability float64 // Number of distributed copies among connected peers
+	Files []FileProgress
+}
+
+// torrentStats holds the counters of a torrent, updated by its downloader
+// and seeder. The zero value is ready to use.
+type torrentStats struct {
+	mutex sync.Mutex
+	downloaded int64
+	uploaded int64
+	previousDownloaded int64
+	previousUploaded int64
+	wasted int64
+	downloadRate rateMeter
+	uploadRate rateMeter
+	have Bitfield
+	peers map[*PeerConn]Bitfield
+	halfOpen int
+	knownPeers int
+}
+
+func (this *Torrent) addDownloaded(n int) {
+	this.stats.mutex.Lock()
+	this.stats.downloaded += int64(n)
+	this.stats.downloadRate.add(int64(n), time.Now())
+	this.stats.mutex.Unlock()
+	if this.client != nil { this.client.stats.addDownloaded(n) }
+}
+
+func (this *Torrent) addUploaded(n int) {
+	this.stats.mutex.Lock()
+	this.stats.uploaded += int64(n)
+	this.stats.uploadRate.add(int64(n), time.Now())
+	this.stats.mutex.Unlock()
+	if this.client != nil { this.client.stats.addUploaded(n) }
+}
+
+func (this *Torrent) addWasted(n int) {
+	this.stats.mutex.Lock()
+	this.stats.wasted += int64(n)
+	this.stats.mutex.Unlock()
+	if this.client != nil { this.client.stats.addWasted(n) }
+}
+
+// setHave sets the pieces that are available locally.
+func (this *Torrent) setHave(have Bitfield) {
+	this.stats.mutex.Lock()
+	defer this.stats.mutex.Unlock()
+	this.stats.have = make(Bitfield, len(have))
+	copy(this.stats.have, have)
+}
+
+func (this *Torrent) setPieceHave(index int) {
+	this.stats.mutex.Lock()
+	defer this.stats.mutex.Unlock()
+	if this.stats.have == nil { this.stats.have = NewBitfield(this.PieceCount()) }
+	this.stats.have.Set(index)
+}
+
+func (this *Torrent) addHalfOpenPeers(delta int) {
+	this.stats.mutex.Lock()
+	this.stats.halfOpen += delta
+	this.stats.mutex.Unlock()
+	if this.client != nil { this.client.stats.addHalfOpenPeers(delta) }
+}
+
+func (this *Torrent) setKnownPeers(count int) {
+	this.stats.mutex.Lock()
+	defer this.stats.mutex.Unlock()
+	this.stats.knownPeers = count
+}
+
+func (this *Torrent) addPeer(conn *PeerConn) {
+	this.stats.mutex.Lock()
+	if this.stats.peers == nil { this.stats.peers = make(map[*PeerConn]Bitfield) }
+	this.stats.peers[conn] = NewBitfield(this.PieceCount())
+	this.stats.mutex.Unlock()
+	if this.client != nil { this.client.stats.addConnectedPeers(1) }
+	this.emitPeerEvent(EventPeerConnected, conn.RemoteAddr())
+}
+
+func (this *Torrent) removePeer(conn *PeerConn) {
+	this.stats.mutex.Lock()
+	_, ok := this.stats.peers[conn]
+	delete(this.stats.peers, conn)
+	this.stats.mutex.Unlock()
+	if !ok { return }
+	if this.client != nil { this.client.stats.addConnectedPeers(-1) }
+	this.emitPeerEvent(EventPeerDisconnected, conn.RemoteAddr())
+}
+
+// setPeerPieces records the pieces of a "have" or "bitfield" message.
+func (this *Torrent) setPeerPieces(conn *PeerConn, pieces ...int) {
+	this.stats.mutex.Lock()
+	defer this.stats.mutex.Unlock()
+	has, ok := this.stats.peers[conn]
+	if !ok { return }
+	for _, index := range pieces {
+		has.Set(index)
+	}
+}
+
+// RestoreStats sets the amount of data transferred in previous sessions,
+// typically saved by the application from TorrentStats.TotalDownloaded and
+// TotalUploaded.
+func (this *Torrent) RestoreStats(downloaded int64, uploaded int64) {
+	this.stats.mutex.Lock()
+	defer this.stats.mutex.Unlock()
+	this.stats.previousDownloaded = downloaded
+	this.stats.previousUploaded = uploaded
+}
+
+// leftSize returns the size of the wanted pieces that are not in `have`.
+func (this *Torrent) leftSize(have Bitfield) int {
+	output := 0
+	for i, wanted := range this.WantedPieces() {
+		if wanted && !have.Has(i) { output += this.PieceSize(i) }
+	}
+	return output
+}
+
+// filesProgress returns the number of verified bytes of each file.
+func (this *Torrent) filesProgress(have Bitfield) []FileProgress {
+	files := this.Files()
+	output := make([]FileProgress, len(files))
+	pieceLength := this.PieceLength()
+	for i, file := range files {
+		output[i] = FileProgress{ Index: i, Length: file.Length, Selected: this.FileIndexIsSelected(i) }
+		first, last := this.piecesForFile(file)
+		for j := first; j <= last; j++ {
+			if !have.Has(j) { continue }
+			start := max(j * pieceLength, file.Offset)
+			end := min((j + 1) * pieceLength, file.Offset + file.Length)
+			output[i].Completed += end - start
+		}
+	}
+	return output
+}
+
+// availability returns the number of distributed copies: the number of
+// complete copies of the torrent among the peers, plus the fraction of the
+// pieces that are available more than that.
+func availability(peers map[*PeerConn]Bitfield, pieceCount int) float64 {
+	if pieceCount == 0 { return 0 }
+	counts := make([]int, pieceCount)
+	for _, has := range peers {
+		for i := range counts {
+			if has.Has(i) { counts[i]++ }
+		}
+	}
+	minimum := counts[0]
+	for _, count := range counts {
+		minimum = min(minimum, count)
+	}
+	above := 0
+	for _, count := range counts {
+		if count > minimum { above++ }
+	}
+	return float64(minimum) + float64(above) / float64(pieceCount)
+}
+
+// Stats returns a snapshot of the transfer statistics of the torrent.
+func (this *Torrent) Stats() TorrentStats {
+	var output TorrentStats
+	if this.MetaInfo() == nil { return output }
+	now := time.Now()
+	pieceCount := this.PieceCount()
+
+	this.stats.mutex.Lock()
+	output.Downloaded = this.stats.downloaded
+	output.Uploaded = this.stats.uploaded
+	output.TotalDownloaded = this.stats.previousDownloaded + this.stats.downloaded
+	output.TotalUploaded = this.stats.previousUploaded + this.stats.uploaded
+	output.Wasted = this.stats.wasted
+	output.DownloadRate = this.stats.downloadRate.rate(now)
+	output.UploadRate = this.stats.uploadRate.rate(now)
+	output.ConnectedPeers = len(this.stats.peers)
+	output.HalfOpenPeers = this.stats.halfOpen
+	output.KnownPeers = this.stats.knownPeers
+	for _, has := range this.stats.peers {
+		if has.Count() == pieceCount {
+			output.Seeds++
+		} else {
+			output.Leechers++
+		}
+	}
+	output.Availability = availability(this.stats.peers, pieceCount)
+	have := make(Bitfield, len(this.stats.have))
+	copy(have, this.stats.have)
+	this.stats.mutex.Unlock()
+
+	output.Left = this.leftSize(have)
+	output.Files = this.filesProgress(have)
+	output.ETA = -1
+	if output.Left == 0 {
+		output.ETA = 0
+	} else if output.DownloadRate > 0 {
+		output.ETA = time.Duration(float64(output.Left) / output.DownloadRate * float64(time.Second))
+	}
+	return output
+}
+
+// ClientStats is a snapshot of the transfer statistics of all the torrents
+// of a client. The totals of previous sessions and the peers of the swarms
+// are those of the torrents added with AddTorrent.
+type ClientStats struct {
+	Downloaded int64 // In this session
+	Uploaded int64 // In this session
+	TotalDownloaded int64 // Including previous sessions, see RestoreStats
+	TotalUploaded int64 // Including previous sessions, see RestoreStats
+	Wasted int64
+	DownloadRate float64 // In bytes per second
+	UploadRate float64 // In bytes per second
+	ConnectedPeers int
+	HalfOpenPeers int
+	KnownPeers int
+	Seeds int
+	Leechers int
+	Availability float64 // Lowest availability among the torrents, 0 if none
+}
+
+type clientStats struct {
+	mutex sync.Mutex
+	downloaded int64
+	uploaded int64
+	wasted int64
+	downloadRate rateMeter
+	uploadRate rateMeter
+	connectedPeers int
+	halfOpen int
+}
+
+func (this *clientStats) addDownloaded(n int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.downloaded += int64(n)
+	this.downloadRate.add(int64(n), time.Now())
+}
+
+func (this *clientStats) addUploaded(n int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.uploaded += int64(n)
+	this.uploadRate.add(int64(n), time.Now())
+}
+
+func (this *clientStats) addWasted(n int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.wasted += int64(n)
+}
+
+func (this *clientStats) addConnectedPeers(delta int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.connectedPeers += delta
+}
+
+func (this *clientStats) addHalfOpenPeers(delta int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.halfOpen += delta
+}
+
+// Stats returns a snapshot of the transfer statistics of all the torrents
+// created by the client.
+func (this *Client) Stats() ClientStats {
+	var output ClientStats
+	var previousDownloaded int64
+	var previousUploaded int64
+	for i, torr := range this.Torrents() {
+		stats := torr.Stats()
+		previousDownloaded += stats.TotalDownloaded - stats.Downloaded
+		previousUploaded += stats.TotalUploaded - stats.Uploaded
+		output.KnownPeers += stats.KnownPeers
+		output.Seeds += stats.Seeds
+		output.Leechers += stats.Leechers
+		if i == 0 || stats.Availability < output.Availability { output.Availability = stats.Availability }
+	}
+
+	now := time.Now()
+	this.stats.mutex.Lock()
+	defer this.stats.mutex.Unlock()
+	output.Downloaded = this.stats.downloaded
+	output.Uploaded = this.stats.uploaded
+	output.TotalDownloaded = previousDownloaded + this.stats.downloaded
+	output.TotalUploaded = previousUploaded + this.stats.uploaded
+	output.Wasted = this.stats.wasted
+	output.DownloadRate = this.stats.downloadRate.rate(now)
+	output.UploadRate = this.stats.uploadRate.rate(now)
+	output.ConnectedPeers = this.stats.connectedPeers
+	output.HalfOpenPeers = this.stats.halfOpen
+	return output
+}
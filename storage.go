@@ -0,0 +1,228 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FileStorage maps the torrent data, seen as the concatenation of all its
+// files, onto the files of a download directory. Files are created on the
+// first write.
+type FileStorage struct {
+	root string
+	files []FileInfo
+	pathChanges []PathChange
+	handles map[int]*os.File
+	mutex sync.Mutex
+}
+
+// NewFileStorage creates a storage in the given directory. Unsafe file paths
+// are rewritten by the default PathSanitizer, see PathChanges.
+func NewFileStorage(torr *Torrent, root string) *FileStorage {
+	output, _ := NewFileStorageWithSanitizer(torr, root, NewPathSanitizer())
+	return output
+}
+
+// NewFileStorageWithSanitizer creates a storage whose file paths are
+// sanitized by the given sanitizer. It fails if the sanitizer rejects a path.
+func NewFileStorageWithSanitizer(torr *Torrent, root string, sanitizer *PathSanitizer) (*FileStorage, error) {
+	files, changes, err := sanitizer.SanitizeFiles(torr.Files())
+	if err != nil { return nil, err }
+	output := new(FileStorage)
+	output.root = root
+	output.files = files
+	output.pathChanges = changes
+	output.handles = make(map[int]*os.File)
+	return output, nil
+}
+
+// PathChanges returns the file paths that have been rewritten because they
+// were unsafe.
+func (this *FileStorage) PathChanges() []PathChange {
+	return this.pathChanges
+}
+
+func (this *FileStorage) FilePath(index int) string {
+	return filepath.Join(append([]string{ this.root }, this.files[index].Path...)...)
+}
+
+// isInsideRoot is a last line of defense against paths escaping the
+// download directory, in case a path was not sanitized.
+func (this *FileStorage) isInsideRoot(path string) bool {
+	relativePath, err := filepath.Rel(this.root, path)
+	if err != nil { return false }
+	return relativePath != ".." && !strings.HasPrefix(relativePath, ".." + string(filepath.Separator)) && !filepath.IsAbs(relativePath)
+}
+
+func (this *FileStorage) open(index int, create bool) (*os.File, error) {
+	handle, ok := this.handles[index]
+	if ok { return handle, nil }
+	path := this.FilePath(index)
+	if !this.isInsideRoot(path) { return nil, ErrUnsafePath }
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil { return nil, err }
+	}
+	handle, err := os.OpenFile(path, flags, 0644)
+	if os.IsPermission(err) && !create {
+		// Seeding data from a read-only location is fine.
+		handle, err = os.Open(path)
+	}
+	if err != nil { return nil, err }
+	this.handles[index] = handle
+	return handle, nil
+}
+
+// eachFileRange calls fn for every file that overlaps [offset, offset +
+// length) of the torrent data, with the position within the file and within
+// the given range.
+func eachFileRange(files []FileInfo, offset int64, length int, fn func(index int, fileOffset int64, start int, end int) error) error {
+	if offset < 0 { return ErrIndexOutOfBound }
+	end := offset + int64(length)
+	for i, file := range files {
+		fileStart := int64(file.Offset)
+		fileEnd := fileStart + int64(file.Length)
+		if fileEnd <= offset || fileStart >= end || file.Length == 0 { continue }
+		start := offset
+		if fileStart > start { start = fileStart }
+		stop := end
+		if fileEnd < stop { stop = fileEnd }
+		err := fn(i, start - fileStart, int(start - offset), int(stop - offset))
+		if err != nil { return err }
+	}
+	return nil
+}
+
+func (this *FileStorage) each(offset int64, length int, fn func(index int, fileOffset int64, start int, end int) error) error {
+	return eachFileRange(this.files, offset, length, fn)
+}
+
+func (this *FileStorage) size() int64 {
+	return int64(dataSize(this.files))
+}
+
+func (this *FileStorage) ReadAt(p []byte, offset int64) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if offset + int64(len(p)) > this.size() { return 0, io.ErrUnexpectedEOF }
+	// The padding between files is not stored and reads as zeros.
+	clear(p)
+	n := 0
+	err := this.each(offset, len(p), func(index int, fileOffset int64, start int, end int) error {
+		handle, err := this.open(index, false)
+		if err != nil { return err }
+		read, err := handle.ReadAt(p[start:end], fileOffset)
+		n += read
+		return err
+	})
+	return n, err
+}
+
+func (this *FileStorage) WriteAt(p []byte, offset int64) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if offset + int64(len(p)) > this.size() { return 0, ErrIndexOutOfBound }
+	n := 0
+	err := this.each(offset, len(p), func(index int, fileOffset int64, start int, end int) error {
+		handle, err := this.open(index, true)
+		if err != nil { return err }
+		written, err := handle.WriteAt(p[start:end], fileOffset)
+		n += written
+		return err
+	})
+	return n, err
+}
+
+// CreateFiles creates the empty files, which are never written to since they
+// don't overlap any piece.
+func (this *FileStorage) CreateFiles() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for i, file := range this.files {
+		if file.Length != 0 { continue }
+		_, err := this.open(i, true)
+		if err != nil { return err }
+	}
+	return nil
+}
+
+func (this *FileStorage) Close() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	var output error
+	for index, handle := range this.handles {
+		err := handle.Close()
+		if err != nil && output == nil { output = err }
+		delete(this.handles, index)
+	}
+	return output
+}
+
+// ReadPiece reads the piece at the given index from storage.
+func (this *Torrent) ReadPiece(storage *FileStorage, index int) ([]byte, error) {
+	size := this.PieceSize(index)
+	if size <= 0 { return nil, ErrIndexOutOfBound }
+	output := make([]byte, size)
+	_, err := storage.ReadAt(output, int64(index) * int64(this.PieceLength()))
+	if err != nil { return nil, err }
+	return output, nil
+}
+
+// CheckPiece tells whether data matches the hash of the piece at the given
+// index.
+func (this *Torrent) CheckPiece(index int, data []byte) bool {
+	if len(data) != this.PieceSize(index) { return false }
+	if this.Version() != TorrentV2 {
+		hash := sha1.Sum(data)
+		if !bytes.Equal(hash[:], this.PieceHash(index)) { return false }
+	}
+	if this.Version() != TorrentV1 { return this.checkPieceV2(index, data) }
+	return true
+}
+
+// checkPieceV2 checks the part of the piece that belongs to its file against
+// the piece layer, or against the pieces root for files of a single piece.
+func (this *Torrent) checkPieceV2(index int, data []byte) bool {
+	pieceLength := this.PieceLength()
+	start := index * pieceLength
+	file, ok := this.fileAt(start)
+	if !ok { return false }
+	data = data[:min(len(data), file.Offset + file.Length - start)]
+	if file.Length <= pieceLength { return bytes.Equal(piecesRoot(nil, blockHashes(data), pieceLength), file.PiecesRoot) }
+
+	layer, _ := this.MetaInfo().GetString("piece layers", string(file.PiecesRoot))
+	entry := (start - file.Offset) / pieceLength * sha256.Size
+	if entry + sha256.Size > len(layer) { return false }
+	return bytes.Equal(pieceLayerHash(data, pieceLength), []byte(layer[entry : entry + sha256.Size]))
+}
+
+// Verify reads back all the pieces from storage and returns those that are
+// present and valid. Missing or short files are not errors: the pieces they
+// overlap are simply reported as missing.
+func (this *Torrent) Verify(storage *FileStorage, progress func(index int, valid bool)) (Bitfield, error) {
+	output := NewBitfield(this.PieceCount())
+	for i := 0; i < this.PieceCount(); i++ {
+		data, err := this.ReadPiece(storage, i)
+		valid := false
+		if err == nil {
+			valid = this.CheckPiece(i, data)
+		} else if !os.IsNotExist(err) && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return output, err
+		}
+		if valid { output.Set(i) }
+		if progress != nil { progress(i, valid) }
+	}
+	return output, nil
+}
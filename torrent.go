@@ -1,8 +1,12 @@
 package torrent
 
 import (
-	"errors"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"slices"
 	"sort"
+	"sync"
 	"torrent/bencoding"
 )
 
@@ -12,11 +16,19 @@ type Torrent struct {
 	client *Client
 	selectedFileIndexes []int
 	fileCount int
+	files []FileInfo
+	singleFile bool
+	trackerMutex sync.Mutex
+	trackers [][]string
+	trackerIds map[string]string // By announce URL
+	events eventDispatcher
+	stats torrentStats
 }
 
 func (this *Client) NewTorrent(url string) *Torrent {
 	output := new(Torrent)
 	output.url = url
+	output.client = this
 	return output
 }
 
@@ -46,16 +58,31 @@ func (this *Torrent) Url() string {
 	return this.url
 }
 
+// DownloadedSize returns the number of bytes downloaded in this session, as
+// reported to trackers.
 func (this *Torrent) DownloadedSize() int {
-	return 0 // TODO
+	this.stats.mutex.Lock()
+	defer this.stats.mutex.Unlock()
+	return int(this.stats.downloaded)
 }
 
+// UploadedSize returns the number of bytes uploaded in this session, as
+// reported to trackers.
 func (this *Torrent) UploadedSize() int {
-	return 0 // TODO
+	this.stats.mutex.Lock()
+	defer this.stats.mutex.Unlock()
+	return int(this.stats.uploaded)
 }
 
+// LeftSize returns the number of bytes of the selected files that are still
+// missing, counting whole pieces.
 func (this *Torrent) LeftSize() int {
-	return this.SelectedFileSize() - this.DownloadedSize()
+	if this.MetaInfo() == nil { return 0 }
+	this.stats.mutex.Lock()
+	have := make(Bitfield, len(this.stats.have))
+	copy(have, this.stats.have)
+	this.stats.mutex.Unlock()
+	return this.leftSize(have)
 }
 
 func (this *Torrent) FileIndexIsSelected(index int) bool {
@@ -65,40 +92,30 @@ func (this *Torrent) FileIndexIsSelected(index int) bool {
 	return false
 }
 
+// fileLength returns the length of the file at the given index.
+func (this *Torrent) fileLength(index int) int {
+	if index < 0 || index >= len(this.files) { return 0 }
+	return this.files[index].Length
+}
+
 func (this *Torrent) SelectedFileSize() int {
-	info := this.MetaInfo().AsDictionary["info"].AsDictionary
-	
-	if this.IsSingleFile() {
-		return info["length"].AsInt
-	}
-	
 	output := 0
-	for i, dic := range info["files"].AsList {
-		if this.FileIndexIsSelected(i) {
-			output += dic.AsDictionary["length"].AsInt
-		}
+	for _, index := range this.selectedFileIndexes {
+		output += this.fileLength(index)
 	}
-	return output	
+	return output
 }
 
 func (this *Torrent) TotalFileSize() int {
-	info := this.MetaInfo().AsDictionary["info"].AsDictionary
-	
-	if this.IsSingleFile() {
-		return info["length"].AsInt
-	}
-	
 	output := 0
-	for _, dic := range info["files"].AsList {
-		output += dic.AsDictionary["length"].AsInt
+	for i := 0; i < this.fileCount; i++ {
+		output += this.fileLength(i)
 	}
 	return output
 }
 
 func (this *Torrent) IsSingleFile() bool {
-	info := this.MetaInfo().AsDictionary["info"].AsDictionary
-	_, hasMultipleFiles := info["files"]
-	return !hasMultipleFiles	
+	return this.MetaInfo() == nil || this.singleFile
 }
 
 func (this *Torrent) MetaInfo() *bencoding.Any {
@@ -106,51 +123,139 @@ func (this *Torrent) MetaInfo() *bencoding.Any {
 }
 
 func (this *Torrent) initializeSelectedFileIndexes() {
-	if this.IsSingleFile() {
-		this.selectedFileIndexes = make([]int, 0, 1)
-		this.selectedFileIndexes = append(this.selectedFileIndexes, 0)
+	if metaInfoVersion(this.MetaInfo()) == 2 {
+		this.files, this.singleFile, _ = filesV2(this.MetaInfo())
 	} else {
-		files := this.MetaInfo().AsDictionary["info"].AsDictionary["files"].AsList
-		this.selectedFileIndexes = make([]int, 0, len(files))
-		for i, _ := range files {
-			this.selectedFileIndexes = append(this.selectedFileIndexes, i)
-		}
+		this.files, this.singleFile = filesV1(this.MetaInfo())
+	}
+	this.selectedFileIndexes = make([]int, 0, len(this.files))
+	for i, _ := range this.files {
+		this.selectedFileIndexes = append(this.selectedFileIndexes, i)
 	}
 	
 	this.fileCount = len(this.selectedFileIndexes)
 }
 
-func (this *Torrent) FetchMetaInfo() error {
-	body, err := httpGet(this.Url(), NewHttpCallOptions())
+// validateMetaInfo checks that the keys the Torrent relies on are present and
+// of the right type, so that accessors don't need to handle missing keys.
+func validateMetaInfo(metaInfo *bencoding.Any) error {
+	_, err := metaInfo.GetDictionary("info")
 	if err != nil { return err }
-	metaInfo, err := bencoding.Decode(body)
+	_, err = metaInfo.GetString("info", "name")
 	if err != nil { return err }
-	this.metaInfo = metaInfo
-	this.initializeSelectedFileIndexes()
-	return nil
+	pieceLength, err := metaInfo.GetInt("info", "piece length")
+	if err != nil { return err }
+	if pieceLength <= 0 { return ErrInvalidMetaInfo }
+	if _, ok := metaInfo.Get("info", "meta version"); ok {
+		_, err = metaInfo.GetInt("info", "meta version")
+		if err != nil { return err }
+	}
+
+	switch metaInfoVersion(metaInfo) {
+		case 1:
+			return validateMetaInfoV1(metaInfo)
+		case 2:
+			err = validateMetaInfoV2(metaInfo)
+			if err != nil { return err }
+			if _, ok := metaInfo.Get("info", "pieces"); !ok { return nil }
+			err = validateMetaInfoV1(metaInfo)
+			if err != nil { return err }
+			return validateHybrid(metaInfo)
+	}
+	return ErrUnsupportedMetaVersion
 }
 
-func (this *Torrent) CallTracker(query TrackerQuery) (*bencoding.Any, error) {
-	announceUrl := this.MetaInfo().AsDictionary["announce"].AsString
-	callUrl := httpGetUrl(announceUrl, map[string]string(query))
-	body, err := httpGet(callUrl, NewHttpCallOptions())
-	if err != nil {
-		return nil, err
+func validateMetaInfoV1(metaInfo *bencoding.Any) error {
+	pieces, err := metaInfo.Query("info", "pieces")
+	if err != nil { return err }
+	_, err = pieces.AsHashes()
+	if err != nil { return err }
+
+	if _, ok := metaInfo.Get("info", "files"); !ok {
+		length, err := metaInfo.GetInt("info", "length")
+		if err != nil { return err }
+		if length < 0 { return ErrInvalidMetaInfo }
+		return nil
 	}
-	output, err := bencoding.Decode(body)
-	if err != nil {
-		return output, err
+
+	files, err := metaInfo.GetList("info", "files")
+	if err != nil { return err }
+	if len(files) == 0 { return ErrInvalidMetaInfo }
+	for i, _ := range files {
+		length, err := metaInfo.GetInt("info", "files", i, "length")
+		if err != nil { return err }
+		if length < 0 { return ErrInvalidMetaInfo }
+		_, err = metaInfo.GetList("info", "files", i, "path")
+		if err != nil { return err }
 	}
-	// Check that the response is a bencoded dictionary and whether
-	// it includes the "failure reason" key. If it does, it's an error.
-	if output.Type != bencoding.Dictionary {
-		return output, ErrInvalidBencodedData
+	return nil
+}
+
+// validateMetaInfoV2 checks the file tree and the piece layers, whose hashes
+// must lead to the pieces root of their file.
+func validateMetaInfoV2(metaInfo *bencoding.Any) error {
+	pieceLength, _ := metaInfo.GetInt("info", "piece length")
+	if pieceLength < merkleBlockSize || nextPowerOfTwo(pieceLength) != pieceLength { return ErrInvalidPieceLength }
+	files, _, err := filesV2(metaInfo)
+	if err != nil { return err }
+	for _, file := range files {
+		if file.Length <= pieceLength { continue }
+		layer, err := metaInfo.GetString("piece layers", string(file.PiecesRoot))
+		if err != nil { return err }
+		if len(layer) != sha256.Size * ((file.Length + pieceLength - 1) / pieceLength) { return ErrInvalidMetaInfo }
+		if !bytes.Equal(piecesRoot(splitHashes(layer), nil, pieceLength), file.PiecesRoot) { return ErrInvalidMetaInfo }
 	}
-	failureReason, ok := output.AsDictionary["failure reason"]
-	if ok {
-		return output, errors.New(failureReason.AsString)
+	return nil
+}
+
+// validateHybrid checks that both layouts of a hybrid torrent describe the
+// same files at the same offsets, so that they share piece indexes.
+func validateHybrid(metaInfo *bencoding.Any) error {
+	filesV1, _ := filesV1(metaInfo)
+	filesV2, _, _ := filesV2(metaInfo)
+	if len(filesV1) != len(filesV2) { return ErrInvalidMetaInfo }
+	for i, file := range filesV1 {
+		if !slices.Equal(file.Path, filesV2[i].Path) || file.Length != filesV2[i].Length || file.Offset != filesV2[i].Offset { return ErrInvalidMetaInfo }
 	}
-	return output, nil
+	pieces, _ := metaInfo.GetString("info", "pieces")
+	pieceLength, _ := metaInfo.GetInt("info", "piece length")
+	if len(pieces) / bencoding.HashLength != (dataSize(filesV2) + pieceLength - 1) / pieceLength { return ErrInvalidMetaInfo }
+	return nil
+}
+
+// metaInfoVersion returns the "meta version" of the info dictionary, 1 when
+// absent.
+func metaInfoVersion(metaInfo *bencoding.Any) int {
+	output, err := metaInfo.GetInt("info", "meta version")
+	if err != nil { return 1 }
+	return output
+}
+
+func (this *Torrent) FetchMetaInfo() error {
+	return this.FetchMetaInfoContext(context.Background())
+}
+
+// FetchMetaInfoContext is FetchMetaInfo, aborted when the context is
+// cancelled.
+func (this *Torrent) FetchMetaInfoContext(ctx context.Context) error {
+	body, err := httpGet(ctx, this.Url(), this.httpCallOptions())
+	if err != nil { return err }
+	return this.LoadMetaInfo(body)
+}
+
+// LoadMetaInfo sets the meta info from the content of a .torrent file.
+func (this *Torrent) LoadMetaInfo(data []byte) error {
+	metaInfo, err := bencoding.Decode(data)
+	if err != nil { return err }
+	err = validateMetaInfo(metaInfo)
+	if err != nil { return err }
+	this.metaInfo = metaInfo
+	this.trackerMutex.Lock()
+	this.trackers = nil
+	this.trackerMutex.Unlock()
+	this.initializeSelectedFileIndexes()
+	this.emit(newEvent(EventMetaInfoReceived, this))
+	return nil
 }
 
 func (this *Torrent) TrackerUpdate() {
@@ -0,0 +1,239 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"torrent/bencoding"
+)
+
+var ErrNoTracker = errors.New("torrent has no tracker")
+var ErrUnsupportedTracker = errors.New("unsupported tracker protocol")
+var ErrTrackerFailure = errors.New("tracker failure")
+
+// TrackerError is returned when announcing to a tracker fails. If the tracker
+// responded with a "failure reason", Err is ErrTrackerFailure and
+// FailureReason is the message of the tracker.
+type TrackerError struct {
+	Url string
+	Err error
+	FailureReason string
+}
+
+func (this *TrackerError) Error() string {
+	if this.FailureReason != "" { return "tracker " + this.Url + ": " + this.FailureReason }
+	return "tracker " + this.Url + ": " + this.Err.Error()
+}
+
+func (this *TrackerError) Unwrap() error {
+	return this.Err
+}
+
+const defaultAnnounceInterval = 30 * time.Minute
+
+// TrackerPeers returns the peers of an announce response, which may be in
+// the compact format (BEP 23) or a list of dictionaries. IPv6 peers may also
+// be in the compact "peers6" key (BEP 7).
+func TrackerPeers(response *bencoding.Any) ([]*net.TCPAddr, error) {
+	var peers6 []*net.TCPAddr
+	compact6, hasPeers6 := response.Get("peers6")
+	if hasPeers6 {
+		var err error
+		peers6, err = compact6.AsCompactPeers6()
+		if err != nil { return nil, err }
+	}
+
+	peers, err := response.Query("peers")
+	if err != nil && hasPeers6 { return peers6, nil }
+	if err != nil { return nil, err }
+
+	if peers.Type == bencoding.String {
+		output, err := peers.AsCompactPeers()
+		if err != nil { return nil, err }
+		return append(output, peers6...), nil
+	}
+
+	list, err := response.GetList("peers")
+	if err != nil { return nil, err }
+	output := make([]*net.TCPAddr, 0, len(list) + len(peers6))
+	for _, peer := range list {
+		ip, err := peer.GetString("ip")
+		if err != nil { continue }
+		port, err := peer.GetInt("port")
+		if err != nil || port <= 0 || port > 65535 { continue }
+		parsedIp := net.ParseIP(ip)
+		if parsedIp == nil { continue }
+		output = append(output, &net.TCPAddr{ IP: parsedIp, Port: port })
+	}
+	return append(output, peers6...), nil
+}
+
+// TrackerInterval returns the number of seconds the client should wait
+// before announcing again.
+func TrackerInterval(response *bencoding.Any) time.Duration {
+	interval, err := response.GetInt("interval")
+	if err != nil || interval <= 0 { return defaultAnnounceInterval }
+	return time.Duration(interval) * time.Second
+}
+
+func callTracker(ctx context.Context, announceUrl string, query TrackerQuery, options *HttpCallOptions) (*bencoding.Any, error) {
+	callUrl := httpGetUrl(announceUrl, map[string]string(query))
+	body, err := httpGet(ctx, callUrl, options)
+	if err != nil {
+		return nil, err
+	}
+	output, err := bencoding.Decode(body)
+	if err != nil {
+		return output, err
+	}
+	// Check that the response is a bencoded dictionary and whether
+	// it includes the "failure reason" key. If it does, it's an error.
+	if output.Type != bencoding.Dictionary {
+		return output, ErrInvalidBencodedData
+	}
+	failureReason, err := output.GetString("failure reason")
+	if err == nil {
+		return output, &TrackerError{ Url: announceUrl, Err: ErrTrackerFailure, FailureReason: failureReason }
+	}
+	return output, nil
+}
+
+func isHttpTracker(announceUrl string) bool {
+	return len(announceUrl) > 7 && (announceUrl[:7] == "http://" || (len(announceUrl) > 8 && announceUrl[:8] == "https://"))
+}
+
+func (this *Torrent) emitTrackerEvent(announceUrl string, err error) {
+	event := newEvent(EventTrackerAnnounced, this)
+	event.TrackerUrl = announceUrl
+	if err != nil {
+		event.Type = EventTrackerFailed
+		event.Err = err
+	}
+	this.emit(event)
+}
+
+// CallTracker announces to the trackers of the torrent, in tier order as
+// defined by BEP 12, and returns the first successful response. A tracker
+// that responds is moved to the front of its tier. Errors are *TrackerError.
+func (this *Torrent) CallTracker(query TrackerQuery) (*bencoding.Any, error) {
+	return this.CallTrackerContext(context.Background(), query)
+}
+
+// CallTrackerContext is CallTracker, aborted when the context is cancelled.
+// The remaining trackers are then not tried.
+func (this *Torrent) CallTrackerContext(ctx context.Context, query TrackerQuery) (*bencoding.Any, error) {
+	// Announces of the same torrent are serialized since they reorder the
+	// tiers.
+	this.trackerMutex.Lock()
+	defer this.trackerMutex.Unlock()
+	if this.trackers == nil { this.trackers = this.Trackers() }
+	if len(this.trackers) == 0 { return nil, ErrNoTracker }
+
+	var lastErr error
+	for _, tier := range this.trackers {
+		for i, announceUrl := range tier {
+			if !isHttpTracker(announceUrl) {
+				if lastErr == nil { lastErr = &TrackerError{ Url: announceUrl, Err: ErrUnsupportedTracker } }
+				continue
+			}
+			output, err := callTracker(ctx, announceUrl, this.withTrackerId(query, announceUrl), this.httpCallOptions())
+			if err != nil {
+				if _, ok := err.(*TrackerError); !ok { err = &TrackerError{ Url: announceUrl, Err: err } }
+				lastErr = err
+				this.emitTrackerEvent(announceUrl, err)
+				if ctx.Err() != nil { return nil, err }
+				continue
+			}
+			this.setTrackerId(announceUrl, output)
+			this.emitTrackerEvent(announceUrl, nil)
+			copy(tier[1 : i + 1], tier[0:i])
+			tier[0] = announceUrl
+			return output, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// withTrackerId returns the query with the "trackerid" the tracker sent in a
+// previous response, if any. The query itself is not modified.
+func (this *Torrent) withTrackerId(query TrackerQuery, announceUrl string) TrackerQuery {
+	trackerId, ok := this.trackerIds[announceUrl]
+	if !ok { return query }
+	output := make(TrackerQuery, len(query) + 1)
+	for key, value := range query { output[key] = value }
+	output["trackerid"] = trackerId
+	return output
+}
+
+func (this *Torrent) setTrackerId(announceUrl string, response *bencoding.Any) {
+	trackerId, err := response.GetString("tracker id")
+	if err != nil { return }
+	if this.trackerIds == nil { this.trackerIds = make(map[string]string) }
+	this.trackerIds[announceUrl] = trackerId
+}
+
+// ScrapeResult is the state of the swarm of a torrent, as reported by a
+// tracker.
+type ScrapeResult struct {
+	Complete int // Number of seeders
+	Incomplete int // Number of leechers
+	Downloaded int // Number of completed downloads
+}
+
+// scrapeUrl returns the scrape URL of a tracker. As defined by BEP 48, only
+// trackers whose announce URL ends with "announce" support scraping.
+func scrapeUrl(announceUrl string) (string, bool) {
+	slash := strings.LastIndex(announceUrl, "/")
+	if slash < 0 || !strings.HasPrefix(announceUrl[slash + 1:], "announce") { return "", false }
+	return announceUrl[:slash + 1] + "scrape" + announceUrl[slash + 1 + len("announce"):], true
+}
+
+func scrapeTracker(ctx context.Context, announceUrl string, infoHash []byte, options *HttpCallOptions) (*ScrapeResult, error) {
+	callUrl, ok := scrapeUrl(announceUrl)
+	if !ok { return nil, ErrUnsupportedTracker }
+	body, err := httpGet(ctx, httpGetUrl(callUrl, map[string]string{ "info_hash": string(infoHash) }), options)
+	if err != nil { return nil, err }
+	response, err := bencoding.Decode(body)
+	if err != nil { return nil, err }
+	failureReason, err := response.GetString("failure reason")
+	if err == nil { return nil, &TrackerError{ Url: announceUrl, Err: ErrTrackerFailure, FailureReason: failureReason } }
+	_, err = response.GetDictionary("files", string(infoHash))
+	if err != nil { return nil, err }
+	output := new(ScrapeResult)
+	output.Complete, _ = response.GetInt("files", string(infoHash), "complete")
+	output.Incomplete, _ = response.GetInt("files", string(infoHash), "incomplete")
+	output.Downloaded, _ = response.GetInt("files", string(infoHash), "downloaded")
+	return output, nil
+}
+
+// Scrape asks the trackers of the torrent, in tier order, for the state of
+// the swarm, and returns the first successful response.
+func (this *Torrent) Scrape() (*ScrapeResult, error) {
+	return this.ScrapeContext(context.Background())
+}
+
+// ScrapeContext is Scrape, aborted when the context is cancelled.
+func (this *Torrent) ScrapeContext(ctx context.Context) (*ScrapeResult, error) {
+	trackers := this.Trackers()
+	if len(trackers) == 0 { return nil, ErrNoTracker }
+	var lastErr error
+	for _, tier := range trackers {
+		for _, announceUrl := range tier {
+			if !isHttpTracker(announceUrl) { continue }
+			output, err := scrapeTracker(ctx, announceUrl, this.InfoHash(), this.httpCallOptions())
+			if err == nil { return output, nil }
+			if _, ok := err.(*TrackerError); !ok { err = &TrackerError{ Url: announceUrl, Err: err } }
+			if ctx.Err() != nil { return nil, err }
+			lastErr = err
+		}
+	}
+	if lastErr == nil { lastErr = &TrackerError{ Url: trackers[0][0], Err: ErrUnsupportedTracker } }
+	return nil, lastErr
+}
+
+func peerAddress(addr *net.TCPAddr) string {
+	return net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port))
+}
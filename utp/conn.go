@@ -0,0 +1,563 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Payload of the data packets, small enough to avoid IP fragmentation
+	// on most links.
+	maxPayloadLength = 1400
+	minWindow = 2 * maxPayloadLength
+	initialWindow = 4 * maxPayloadLength
+	maxWindow = 1024 * 1024
+	receiveBufferSize = 1024 * 1024
+	// Number of out of order packets kept while waiting for a lost one.
+	maxReorder = 1024
+
+	// LEDBAT parameters: the congestion window grows by at most
+	// maxWindowIncrease bytes per round trip while the queuing delay that
+	// the connection causes is below targetDelay, and shrinks above it.
+	targetDelay = 100000 // Microseconds
+	maxWindowIncrease = 3000
+
+	initialTimeout = time.Second
+	minTimeout = 500 * time.Millisecond
+	maxTimeout = 30 * time.Second
+	maxTimeouts = 8
+	// Time a closed connection waits for its FIN to be acknowledged.
+	closeLinger = 30 * time.Second
+)
+
+var ErrConnectionReset = errors.New("connection reset by peer")
+var ErrConnectionTimeout = errors.New("connection timed out")
+
+const (
+	stateSynSent = iota
+	stateConnected
+	stateClosed
+)
+
+type outgoingPacket struct {
+	typ int
+	seqNr uint16
+	payload []byte
+	sentAt time.Time
+	transmissions int
+	needResend bool
+	// Number of the transmission, and number of packets transmitted later
+	// that have been acknowledged.
+	sentIndex uint64
+	ackedAfter int
+}
+
+// delayHistory keeps the base delay, the lowest one-way delay seen in the
+// last two minutes. The delay above it is the queuing delay.
+type delayHistory struct {
+	minuteStart time.Time
+	current uint32
+	previous uint32
+	hasPrevious bool
+}
+
+// add records a delay sample and returns the queuing delay, in microseconds.
+func (this *delayHistory) add(sample uint32, now time.Time) int64 {
+	if this.minuteStart.IsZero() || now.Sub(this.minuteStart) >= time.Minute {
+		this.previous = this.current
+		this.hasPrevious = !this.minuteStart.IsZero()
+		this.current = sample
+		this.minuteStart = now
+	} else if int32(sample - this.current) < 0 {
+		this.current = sample
+	}
+	base := this.current
+	if this.hasPrevious && int32(this.previous - base) < 0 { base = this.previous }
+	return max(int64(int32(sample - base)), 0)
+}
+
+// Conn is a uTP connection. It implements net.Conn.
+type Conn struct {
+	socket *Socket
+	remote net.Addr
+	recvId uint16
+	sendId uint16
+
+	mutex sync.Mutex
+	changed chan struct{}
+	state int
+	err error
+	closed bool
+	closedAt time.Time
+	readDeadline time.Time
+	writeDeadline time.Time
+
+	// Sending
+	seqNr uint16
+	outgoing []*outgoingPacket
+	sendCount uint64
+	maxWindow int
+	peerWindow int
+	lastAckNr uint16
+	duplicateAcks int
+	rtt time.Duration
+	rttVariance time.Duration
+	timeout time.Duration
+	timeouts int
+	lastLoss time.Time
+	delays delayHistory
+	finSent bool
+
+	// Receiving
+	ackNr uint16
+	reorder map[uint16][]byte
+	readBuffer []byte
+	finReceived bool
+	finSeqNr uint16
+	replyMicro uint32
+	advertisedWindow int
+}
+
+func newConn(socket *Socket, remote net.Addr, recvId uint16, sendId uint16) *Conn {
+	output := new(Conn)
+	output.socket = socket
+	output.remote = remote
+	output.recvId = recvId
+	output.sendId = sendId
+	output.changed = make(chan struct{})
+	output.maxWindow = initialWindow
+	output.peerWindow = maxPayloadLength
+	output.timeout = initialTimeout
+	output.reorder = make(map[uint16][]byte)
+	return output
+}
+
+// broadcast wakes up the goroutines waiting for a change of state. The
+// mutex must be held.
+func (this *Conn) broadcast() {
+	close(this.changed)
+	this.changed = make(chan struct{})
+}
+
+// wait releases the mutex until the state changes or the deadline expires.
+func (this *Conn) wait(deadline time.Time) error {
+	changed := this.changed
+	this.mutex.Unlock()
+	defer this.mutex.Lock()
+	if deadline.IsZero() {
+		<-changed
+		return nil
+	}
+	duration := time.Until(deadline)
+	if duration <= 0 { return os.ErrDeadlineExceeded }
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+		case <-changed: return nil
+		case <-timer.C: return os.ErrDeadlineExceeded
+	}
+}
+
+func (this *Conn) receiveWindow() int {
+	return max(receiveBufferSize - len(this.readBuffer), 0)
+}
+
+func (this *Conn) sendPacket(typ int, seqNr uint16, payload []byte) {
+	p := new(packet)
+	p.typ = typ
+	p.connectionId = this.sendId
+	if typ == stSyn { p.connectionId = this.recvId }
+	p.timestamp = timestampNow()
+	p.timestampDifference = this.replyMicro
+	p.windowSize = uint32(this.receiveWindow())
+	p.seqNr = seqNr
+	p.ackNr = this.ackNr
+	p.payload = payload
+	if typ == stState && len(this.reorder) > 0 { p.selectiveAck = this.selectiveAck() }
+	this.advertisedWindow = this.receiveWindow()
+	this.socket.WriteTo(p.encode(), this.remote)
+}
+
+func (this *Conn) sendState() {
+	this.sendPacket(stState, this.seqNr, nil)
+}
+
+// selectiveAck returns the bitmask of the packets received after the first
+// missing one: bit i is set if packet ackNr + 2 + i has been received.
+func (this *Conn) selectiveAck() []byte {
+	output := make([]byte, 4)
+	for seqNr := range this.reorder {
+		i := int(seqNr - this.ackNr - 2)
+		if i >= maxReorder { continue }
+		for i / 8 >= len(output) {
+			output = append(output, 0, 0, 0, 0)
+		}
+		output[i / 8] |= 1 << uint(i % 8)
+	}
+	return output
+}
+
+func (this *Conn) transmit(o *outgoingPacket) {
+	o.sentAt = time.Now()
+	o.transmissions++
+	o.needResend = false
+	this.sendCount++
+	o.sentIndex = this.sendCount
+	o.ackedAfter = 0
+	this.sendPacket(o.typ, o.seqNr, o.payload)
+}
+
+func (this *Conn) queue(typ int, payload []byte) {
+	o := &outgoingPacket{ typ: typ, seqNr: this.seqNr, payload: payload }
+	this.seqNr++
+	this.outgoing = append(this.outgoing, o)
+	this.transmit(o)
+}
+
+func (this *Conn) inFlight() int {
+	output := 0
+	for _, o := range this.outgoing {
+		if !o.needResend { output += len(o.payload) }
+	}
+	return output
+}
+
+// canSend tells whether n more bytes fit in the window. A packet can always
+// be sent when nothing is in flight, which probes a closed receive window.
+func (this *Conn) canSend(n int) bool {
+	inFlight := this.inFlight()
+	return inFlight == 0 || inFlight + n <= min(this.maxWindow, this.peerWindow)
+}
+
+func (this *Conn) hasResends() bool {
+	for _, o := range this.outgoing {
+		if o.needResend { return true }
+	}
+	return false
+}
+
+// flush retransmits the lost packets that fit in the window.
+func (this *Conn) flush() {
+	for _, o := range this.outgoing {
+		if !o.needResend { continue }
+		if !this.canSend(len(o.payload)) { return }
+		this.transmit(o)
+	}
+}
+
+// terminate closes the connection without notifying the peer. The mutex
+// must be held.
+func (this *Conn) terminate(err error) {
+	if this.state == stateClosed { return }
+	this.state = stateClosed
+	if this.err == nil { this.err = err }
+	this.outgoing = nil
+	this.broadcast()
+	this.socket.remove(this)
+}
+
+// accept answers the SYN of an incoming connection.
+func (this *Conn) accept(syn *packet, seqNr uint16) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.state = stateConnected
+	this.seqNr = seqNr
+	this.ackNr = syn.seqNr
+	this.replyMicro = timestampNow() - syn.timestamp
+	this.sendState()
+}
+
+func (this *Conn) reset() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.sendPacket(stReset, this.seqNr, nil)
+	this.terminate(ErrConnectionReset)
+}
+
+func (this *Conn) handle(p *packet) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.state == stateClosed { return }
+	now := time.Now()
+	this.replyMicro = timestampNow() - p.timestamp
+	this.peerWindow = int(p.windowSize)
+
+	switch p.typ {
+		case stReset:
+			this.terminate(ErrConnectionReset)
+			return
+		case stSyn:
+			// Our answer to the SYN was lost.
+			this.sendState()
+			return
+	}
+	if this.state == stateSynSent {
+		if p.typ != stState { return }
+		this.state = stateConnected
+		this.ackNr = p.seqNr - 1
+	}
+
+	this.processAck(p, now)
+	if p.typ == stData || p.typ == stFin { this.processData(p) }
+	this.flush()
+	this.broadcast()
+}
+
+func isSelectivelyAcked(p *packet, seqNr uint16) bool {
+	i := int(seqNr - p.ackNr - 2)
+	return i < len(p.selectiveAck) * 8 && p.selectiveAck[i / 8] & (1 << uint(i % 8)) != 0
+}
+
+func (this *Conn) processAck(p *packet, now time.Time) {
+	if len(this.outgoing) == 0 || seqLess(p.ackNr, this.outgoing[0].seqNr - 1) || !seqLess(p.ackNr, this.seqNr) {
+		this.lastAckNr = p.ackNr
+		return
+	}
+
+	ackedBytes := 0
+	var ackedIndexes []uint64
+	var kept []*outgoingPacket
+	for _, o := range this.outgoing {
+		if !seqLess(p.ackNr, o.seqNr) || isSelectivelyAcked(p, o.seqNr) {
+			ackedBytes += len(o.payload)
+			ackedIndexes = append(ackedIndexes, o.sentIndex)
+			if o.transmissions == 1 { this.updateRtt(now.Sub(o.sentAt)) }
+			continue
+		}
+		kept = append(kept, o)
+	}
+	this.outgoing = kept
+	acked := len(ackedIndexes) > 0
+
+	if acked {
+		this.timeouts = 0
+		this.timeout = max(this.rtt + 4 * this.rttVariance, minTimeout)
+	}
+	if p.ackNr == this.lastAckNr && p.typ == stState && ackedBytes == 0 && len(this.outgoing) > 0 {
+		this.duplicateAcks++
+		if this.duplicateAcks == 3 { this.lost(this.outgoing[0], now) }
+	} else if p.ackNr != this.lastAckNr {
+		this.duplicateAcks = 0
+	}
+	this.lastAckNr = p.ackNr
+
+	// A packet is lost if three packets transmitted after it have been
+	// received.
+	for _, o := range this.outgoing {
+		if o.needResend { continue }
+		for _, index := range ackedIndexes {
+			if index > o.sentIndex { o.ackedAfter++ }
+		}
+		if o.ackedAfter >= 3 { this.lost(o, now) }
+	}
+
+	if ackedBytes > 0 && p.timestampDifference != 0 {
+		delay := this.delays.add(p.timestampDifference, now)
+		offTarget := float64(targetDelay - delay) / targetDelay
+		windowFactor := float64(min(ackedBytes, this.maxWindow)) / float64(this.maxWindow)
+		this.maxWindow += int(maxWindowIncrease * offTarget * windowFactor)
+		this.maxWindow = min(max(this.maxWindow, minWindow), maxWindow)
+	}
+}
+
+func (this *Conn) updateRtt(sample time.Duration) {
+	if this.rtt == 0 {
+		this.rtt = sample
+		this.rttVariance = sample / 2
+		return
+	}
+	delta := this.rtt - sample
+	if delta < 0 { delta = -delta }
+	this.rttVariance += (delta - this.rttVariance) / 4
+	this.rtt += (sample - this.rtt) / 8
+}
+
+// lost schedules the retransmission of a packet, and halves the window at
+// most once per round trip.
+func (this *Conn) lost(o *outgoingPacket, now time.Time) {
+	if o.needResend { return }
+	o.needResend = true
+	if now.Sub(this.lastLoss) > this.rtt {
+		this.maxWindow = max(this.maxWindow / 2, minWindow)
+		this.lastLoss = now
+	}
+}
+
+func (this *Conn) processData(p *packet) {
+	if p.typ == stFin && !this.finReceived {
+		this.finReceived = true
+		this.finSeqNr = p.seqNr
+	}
+	offset := p.seqNr - this.ackNr
+	if offset == 1 {
+		if this.deliver(p.payload) {
+			for {
+				payload, ok := this.reorder[this.ackNr + 1]
+				if !ok || !this.deliver(payload) { break }
+				delete(this.reorder, this.ackNr)
+			}
+		}
+	} else if offset > 1 && offset <= maxReorder && len(this.reorder) < maxReorder {
+		this.reorder[p.seqNr] = p.payload
+	}
+	this.sendState()
+}
+
+// deliver appends the payload of the next packet to the read buffer, unless
+// it is full. The data is dropped if the connection has been closed.
+func (this *Conn) deliver(payload []byte) bool {
+	if this.closed {
+		this.ackNr++
+		return true
+	}
+	if len(this.readBuffer) + len(payload) > receiveBufferSize { return false }
+	this.readBuffer = append(this.readBuffer, payload...)
+	this.ackNr++
+	return true
+}
+
+func (this *Conn) eof() bool {
+	return this.finReceived && this.ackNr == this.finSeqNr
+}
+
+// tick retransmits the packets that have timed out, and releases the
+// connection once closed.
+func (this *Conn) tick(now time.Time) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.state == stateClosed { return }
+	if this.closed && ((len(this.outgoing) == 0 && this.eof()) || now.Sub(this.closedAt) > closeLinger) {
+		this.terminate(net.ErrClosed)
+		return
+	}
+
+	var oldest *outgoingPacket
+	for _, o := range this.outgoing {
+		if !o.needResend { oldest = o; break }
+	}
+	if oldest == nil {
+		this.flush()
+		return
+	}
+	if now.Sub(oldest.sentAt) < this.timeout { return }
+	this.timeouts++
+	if this.timeouts > maxTimeouts {
+		this.terminate(ErrConnectionTimeout)
+		return
+	}
+	this.timeout = min(this.timeout * 2, maxTimeout)
+	this.maxWindow = minWindow
+	for _, o := range this.outgoing {
+		o.needResend = true
+	}
+	this.flush()
+}
+
+func (this *Conn) Read(b []byte) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for {
+		if this.closed { return 0, net.ErrClosed }
+		if len(this.readBuffer) > 0 {
+			n := copy(b, this.readBuffer)
+			this.readBuffer = this.readBuffer[n:]
+			if len(this.readBuffer) == 0 { this.readBuffer = nil }
+			// Tell the peer that the window has opened again.
+			if this.state == stateConnected && this.advertisedWindow < receiveBufferSize / 2 && this.receiveWindow() >= receiveBufferSize / 2 { this.sendState() }
+			return n, nil
+		}
+		if this.eof() { return 0, io.EOF }
+		if this.err != nil { return 0, this.err }
+		err := this.wait(this.readDeadline)
+		if err != nil { return 0, err }
+	}
+}
+
+func (this *Conn) Write(b []byte) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	written := 0
+	for written < len(b) {
+		if this.closed || this.finSent { return written, net.ErrClosed }
+		if this.err != nil { return written, this.err }
+		n := min(len(b) - written, maxPayloadLength)
+		if this.state == stateConnected && !this.hasResends() && this.canSend(n) {
+			this.queue(stData, append([]byte(nil), b[written : written + n]...))
+			written += n
+			continue
+		}
+		err := this.wait(this.writeDeadline)
+		if err != nil { return written, err }
+	}
+	return written, nil
+}
+
+// CloseWrite sends a FIN after the data written so far, after which the
+// peer reads EOF. The connection can still be read.
+func (this *Conn) CloseWrite() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed || this.finSent { return net.ErrClosed }
+	if this.err != nil { return this.err }
+	if this.state != stateConnected { return net.ErrClosed }
+	this.finSent = true
+	this.queue(stFin, nil)
+	this.broadcast()
+	return nil
+}
+
+// Close sends a FIN after the data written so far. The connection lingers
+// until the peer has acknowledged everything.
+func (this *Conn) Close() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed { return net.ErrClosed }
+	this.closed = true
+	this.closedAt = time.Now()
+	this.readBuffer = nil
+	if this.state == stateConnected && !this.finSent {
+		this.finSent = true
+		this.queue(stFin, nil)
+	} else if this.state == stateSynSent {
+		this.terminate(net.ErrClosed)
+	}
+	this.broadcast()
+	return nil
+}
+
+func (this *Conn) LocalAddr() net.Addr {
+	return this.socket.Addr()
+}
+
+func (this *Conn) RemoteAddr() net.Addr {
+	return this.remote
+}
+
+func (this *Conn) SetDeadline(t time.Time) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.readDeadline = t
+	this.writeDeadline = t
+	this.broadcast()
+	return nil
+}
+
+func (this *Conn) SetReadDeadline(t time.Time) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.readDeadline = t
+	this.broadcast()
+	return nil
+}
+
+func (this *Conn) SetWriteDeadline(t time.Time) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.writeDeadline = t
+	this.broadcast()
+	return nil
+}
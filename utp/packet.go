@@ -0,0 +1,97 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+const (
+	stData = 0
+	stFin = 1
+	stState = 2
+	stReset = 3
+	stSyn = 4
+
+	version = 1
+	headerLength = 20
+
+	extensionNone = 0
+	extensionSelectiveAck = 1
+)
+
+var errInvalidPacket = errors.New("invalid uTP packet")
+
+type header struct {
+	typ int
+	connectionId uint16
+	timestamp uint32 // Microseconds
+	timestampDifference uint32 // Microseconds
+	windowSize uint32
+	seqNr uint16
+	ackNr uint16
+}
+
+type packet struct {
+	header
+	selectiveAck []byte
+	payload []byte
+}
+
+// isPacket tells whether a datagram looks like uTP, so that the socket can be
+// shared with protocols such as the DHT (bencoded dictionaries, starting with
+// 'd') and UDP trackers (starting with a 32-bit action).
+func isPacket(data []byte) bool {
+	return len(data) >= headerLength && data[0] & 0x0f == version && int(data[0] >> 4) <= stSyn
+}
+
+func parsePacket(data []byte) (*packet, error) {
+	if !isPacket(data) { return nil, errInvalidPacket }
+	output := new(packet)
+	output.typ = int(data[0] >> 4)
+	output.connectionId = binary.BigEndian.Uint16(data[2:])
+	output.timestamp = binary.BigEndian.Uint32(data[4:])
+	output.timestampDifference = binary.BigEndian.Uint32(data[8:])
+	output.windowSize = binary.BigEndian.Uint32(data[12:])
+	output.seqNr = binary.BigEndian.Uint16(data[16:])
+	output.ackNr = binary.BigEndian.Uint16(data[18:])
+
+	extension := int(data[1])
+	data = data[headerLength:]
+	for extension != extensionNone {
+		if len(data) < 2 { return nil, errInvalidPacket }
+		next, length := int(data[0]), int(data[1])
+		if len(data) < 2 + length { return nil, errInvalidPacket }
+		if extension == extensionSelectiveAck { output.selectiveAck = data[2 : 2 + length] }
+		data = data[2 + length:]
+		extension = next
+	}
+	output.payload = data
+	return output, nil
+}
+
+func (this *packet) encode() []byte {
+	output := make([]byte, headerLength, headerLength + 2 + len(this.selectiveAck) + len(this.payload))
+	output[0] = byte(this.typ << 4 | version)
+	binary.BigEndian.PutUint16(output[2:], this.connectionId)
+	binary.BigEndian.PutUint32(output[4:], this.timestamp)
+	binary.BigEndian.PutUint32(output[8:], this.timestampDifference)
+	binary.BigEndian.PutUint32(output[12:], this.windowSize)
+	binary.BigEndian.PutUint16(output[16:], this.seqNr)
+	binary.BigEndian.PutUint16(output[18:], this.ackNr)
+	if len(this.selectiveAck) > 0 {
+		output[1] = extensionSelectiveAck
+		output = append(output, extensionNone, byte(len(this.selectiveAck)))
+		output = append(output, this.selectiveAck...)
+	}
+	return append(output, this.payload...)
+}
+
+func timestampNow() uint32 {
+	return uint32(time.Now().UnixMicro())
+}
+
+// seqLess compares sequence numbers, which wrap around.
+func seqLess(a uint16, b uint16) bool {
+	return int16(a - b) < 0
+}
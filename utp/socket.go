@@ -0,0 +1,243 @@
+// Package utp implements the Micro Transport Protocol (BEP 29), a reliable
+// transport over UDP whose LEDBAT congestion control yields to other
+// traffic.
+package utp
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	acceptBacklog = 64
+	tickInterval = 50 * time.Millisecond
+	defaultDialTimeout = 10 * time.Second
+)
+
+type connKey struct {
+	addr string
+	id uint16 // Connection id of the received packets
+}
+
+// Socket multiplexes uTP connections over one UDP socket. It implements
+// net.Listener. The datagrams that are not uTP packets are passed to the
+// packet handler, so that the socket can be shared with other protocols.
+type Socket struct {
+	conn net.PacketConn
+	mutex sync.Mutex
+	conns map[connKey]*Conn
+	incoming chan *Conn
+	handler func(packet []byte, addr net.Addr)
+	closed bool
+	closing chan struct{}
+	loops sync.WaitGroup
+}
+
+// Listen opens a UDP socket on the given address.
+func Listen(address string) (*Socket, error) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil { return nil, err }
+	return NewSocket(conn), nil
+}
+
+func NewSocket(conn net.PacketConn) *Socket {
+	output := new(Socket)
+	output.conn = conn
+	output.conns = make(map[connKey]*Conn)
+	output.incoming = make(chan *Conn, acceptBacklog)
+	output.closing = make(chan struct{})
+	output.loops.Add(2)
+	go output.readLoop()
+	go output.tickLoop()
+	return output
+}
+
+// SetPacketHandler sets the function called with the datagrams that are not
+// uTP packets. It is called from the goroutine reading the socket.
+func (this *Socket) SetPacketHandler(handler func(packet []byte, addr net.Addr)) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.handler = handler
+}
+
+// WriteTo sends a datagram from the socket.
+func (this *Socket) WriteTo(packet []byte, addr net.Addr) (int, error) {
+	return this.conn.WriteTo(packet, addr)
+}
+
+func (this *Socket) Addr() net.Addr {
+	return this.conn.LocalAddr()
+}
+
+func (this *Socket) Accept() (net.Conn, error) {
+	select {
+		case conn := <-this.incoming: return conn, nil
+		case <-this.closing: return nil, net.ErrClosed
+	}
+}
+
+func (this *Socket) Dial(address string) (net.Conn, error) {
+	return this.DialTimeout(address, defaultDialTimeout)
+}
+
+func (this *Socket) DialTimeout(address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	output, err := this.DialContext(ctx, address)
+	if err == context.DeadlineExceeded { return nil, ErrConnectionTimeout }
+	return output, err
+}
+
+// DialContext connects to the address, and fails with the error of the
+// context when it is cancelled or its deadline is reached.
+func (this *Socket) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil { return nil, err }
+
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		return nil, net.ErrClosed
+	}
+	// We receive on id and send with id + 1, so the peer sends to us with
+	// id. A connection accepted from the same address is keyed by the id of
+	// its SYN plus one: the key id + 1 would collide with such a connection,
+	// which sends with id as well, so it must be free too.
+	var id uint16
+	for {
+		id = uint16(rand.Intn(1 << 16))
+		_, used := this.conns[connKey{ addr.String(), id }]
+		_, synUsed := this.conns[connKey{ addr.String(), id + 1 }]
+		if !used && !synUsed { break }
+	}
+	conn := newConn(this, addr, id, id + 1)
+	this.conns[connKey{ addr.String(), id }] = conn
+	this.mutex.Unlock()
+
+	deadline, _ := ctx.Deadline()
+	stop := context.AfterFunc(ctx, func() {
+		conn.mutex.Lock()
+		defer conn.mutex.Unlock()
+		if conn.state == stateSynSent { conn.terminate(ctx.Err()) }
+	})
+	defer stop()
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.seqNr = 1
+	conn.queue(stSyn, nil)
+	for conn.state == stateSynSent {
+		err := conn.wait(deadline)
+		if err != nil {
+			conn.terminate(context.DeadlineExceeded)
+			return nil, context.DeadlineExceeded
+		}
+	}
+	if conn.state == stateClosed { return nil, conn.err }
+	return conn, nil
+}
+
+func (this *Socket) remove(conn *Conn) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	key := connKey{ conn.remote.String(), conn.recvId }
+	if this.conns[key] == conn { delete(this.conns, key) }
+}
+
+func (this *Socket) readLoop() {
+	defer this.loops.Done()
+	buffer := make([]byte, 65536)
+	for {
+		n, addr, err := this.conn.ReadFrom(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) { return }
+			continue
+		}
+		data := append([]byte(nil), buffer[:n]...)
+		p, err := parsePacket(data)
+		if err != nil {
+			this.mutex.Lock()
+			handler := this.handler
+			this.mutex.Unlock()
+			if handler != nil { handler(data, addr) }
+			continue
+		}
+		this.dispatch(p, addr)
+	}
+}
+
+func (this *Socket) dispatch(p *packet, addr net.Addr) {
+	key := connKey{ addr.String(), p.connectionId }
+	if p.typ == stSyn { key.id++ }
+
+	this.mutex.Lock()
+	conn := this.conns[key]
+	if conn != nil {
+		this.mutex.Unlock()
+		conn.handle(p)
+		return
+	}
+	if p.typ != stSyn || this.closed {
+		this.mutex.Unlock()
+		return
+	}
+	conn = newConn(this, addr, key.id, p.connectionId)
+	this.conns[key] = conn
+	this.mutex.Unlock()
+
+	conn.accept(p, uint16(rand.Intn(1 << 16)))
+	select {
+		case this.incoming <- conn:
+		default: conn.reset()
+	}
+}
+
+func (this *Socket) tickLoop() {
+	defer this.loops.Done()
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+			case now := <-ticker.C:
+				for _, conn := range this.connections() {
+					conn.tick(now)
+				}
+			case <-this.closing:
+				return
+		}
+	}
+}
+
+func (this *Socket) connections() []*Conn {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	output := make([]*Conn, 0, len(this.conns))
+	for _, conn := range this.conns {
+		output = append(output, conn)
+	}
+	return output
+}
+
+// Close closes the UDP socket, which terminates all the connections.
+func (this *Socket) Close() error {
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		return net.ErrClosed
+	}
+	this.closed = true
+	close(this.closing)
+	this.mutex.Unlock()
+
+	for _, conn := range this.connections() {
+		conn.mutex.Lock()
+		conn.terminate(net.ErrClosed)
+		conn.mutex.Unlock()
+	}
+	err := this.conn.Close()
+	this.loops.Wait()
+	return err
+}
@@ -0,0 +1,146 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyConn drops one datagram out of every n that it sends.
+type lossyConn struct {
+	net.PacketConn
+	mutex sync.Mutex
+	n int
+	count int
+}
+
+func (this *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	this.mutex.Lock()
+	this.count++
+	drop := this.count % this.n == 0
+	this.mutex.Unlock()
+	if drop { return len(b), nil }
+	return this.PacketConn.WriteTo(b, addr)
+}
+
+func newTestSocket(t *testing.T, dropEvery int) *Socket {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	if dropEvery > 0 { return NewSocket(&lossyConn{ PacketConn: conn, n: dropEvery }) }
+	return NewSocket(conn)
+}
+
+func Test_Packet(t *testing.T) {
+	p := &packet{ header: header{ stState, 1234, 5, 6, 7, 8, 9 }, selectiveAck: []byte{ 1, 2, 3, 4 }, payload: []byte("data") }
+	output, err := parsePacket(p.encode())
+	if err != nil { t.Fatal(err) }
+	if output.header != p.header || !bytes.Equal(output.selectiveAck, p.selectiveAck) || string(output.payload) != "data" { t.Errorf("Unexpected packet: %+v", output) }
+
+	tests := []struct {
+		data []byte
+		expected bool
+	}{
+		{ p.encode(), true },
+		{ []byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"), false },
+		{ append([]byte{ 0, 0, 0, 1 }, make([]byte, 16)...), false },
+		{ []byte{ 0x41, 0 }, false },
+	}
+	for _, test := range tests {
+		if isPacket(test.data) != test.expected { t.Errorf("Expected %v for %q", test.expected, test.data) }
+	}
+}
+
+func Test_SeqLess(t *testing.T) {
+	if !seqLess(1, 2) || seqLess(2, 1) || !seqLess(65535, 0) || seqLess(0, 65535) { t.Error("Unexpected sequence number order") }
+}
+
+func testTransfer(t *testing.T, dropEvery int) {
+	server := newTestSocket(t, dropEvery)
+	defer server.Close()
+	client := newTestSocket(t, dropEvery)
+	defer client.Close()
+
+	data := make([]byte, 300000)
+	rand.Read(data)
+	errors := make(chan error, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil { errors <- err; return }
+		defer conn.Close()
+		// Echo everything back.
+		_, err = io.Copy(conn, conn)
+		errors <- err
+	}()
+
+	conn, err := client.DialTimeout(server.Addr().String(), 5 * time.Second)
+	if err != nil { t.Fatal(err) }
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	go func() {
+		conn.Write(data)
+		conn.(*Conn).CloseWrite()
+	}()
+	output, err := ioutil.ReadAll(conn)
+	if err != nil { t.Fatal(err) }
+	if !bytes.Equal(output, data) { t.Errorf("Expected %d bytes back, got %d", len(data), len(output)) }
+	err = <-errors
+	if err != nil { t.Error("Expected no error, got", err) }
+	conn.Close()
+}
+
+func Test_Transfer(t *testing.T) {
+	testTransfer(t, 0)
+}
+
+func Test_TransferWithLoss(t *testing.T) {
+	testTransfer(t, 10)
+}
+
+func Test_DialTimeout(t *testing.T) {
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	defer silent.Close()
+	socket := newTestSocket(t, 0)
+	defer socket.Close()
+	_, err = socket.DialTimeout(silent.LocalAddr().String(), 200 * time.Millisecond)
+	if err != ErrConnectionTimeout { t.Errorf("Expected error '%s', got error '%v'", ErrConnectionTimeout, err) }
+	if len(socket.connections()) != 0 { t.Error("Expected the connection to be removed") }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100 * time.Millisecond, cancel)
+	_, err = socket.DialContext(ctx, silent.LocalAddr().String())
+	if err != context.Canceled { t.Errorf("Expected error '%s', got error '%v'", context.Canceled, err) }
+	if len(socket.connections()) != 0 { t.Error("Expected the connection to be removed") }
+}
+
+func Test_SharedSocket(t *testing.T) {
+	socket := newTestSocket(t, 0)
+	defer socket.Close()
+	received := make(chan string, 1)
+	socket.SetPacketHandler(func(packet []byte, addr net.Addr) { received <- string(packet) })
+
+	other, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	defer other.Close()
+	other.WriteTo([]byte("d1:q4:pinge"), socket.Addr())
+	select {
+		case packet := <-received:
+			if packet != "d1:q4:pinge" { t.Errorf("Unexpected packet %q", packet) }
+		case <-time.After(5 * time.Second):
+			t.Error("Expected the packet to be passed to the handler")
+	}
+}
+
+func Test_DelayHistory(t *testing.T) {
+	var history delayHistory
+	now := time.Now()
+	if history.add(5000, now) != 0 { t.Error("Expected no queuing delay for the first sample") }
+	if history.add(4000, now) != 0 || history.add(9000, now) != 5000 { t.Error("Expected the delay above the lowest sample") }
+	if history.add(7000, now.Add(time.Minute)) != 3000 { t.Error("Expected the base delay of the previous minute") }
+	if history.add(8000, now.Add(2 * time.Minute)) != 1000 { t.Error("Expected the base delay to expire after two minutes") }
+}
@@ -0,0 +1,182 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"torrent/bencoding"
+)
+
+// Web seeds, as defined by BEP 19: HTTP servers hosting the files of the
+// torrent, from which pieces are downloaded with range requests. FTP URLs
+// are not supported: they are ignored, and listed in the warnings of Report.
+//
+// HTTP seeds, as defined by BEP 17: scripts that return a piece given the
+// info hash and the piece index.
+
+const (
+	webSeedInitialBackoff = 5 * time.Second
+	webSeedMaxBackoff = 10 * time.Minute
+)
+
+var ErrPieceHashMismatch = errors.New("piece hash mismatch")
+var ErrInvalidPieceLength = errors.New("invalid piece length")
+
+// webSeedFileUrl returns the URL of a file on a web seed. For multi-file
+// torrents, the URL is the base of the directory named after the torrent.
+func (this *Torrent) webSeedFileUrl(seedUrl string, file FileInfo) string {
+	if this.IsSingleFile() {
+		if strings.HasSuffix(seedUrl, "/") { return seedUrl + url.PathEscape(this.Name()) }
+		return seedUrl
+	}
+	if !strings.HasSuffix(seedUrl, "/") { seedUrl += "/" }
+	escaped := make([]string, len(file.Path))
+	for i, component := range file.Path {
+		escaped[i] = url.PathEscape(component)
+	}
+	return seedUrl + strings.Join(escaped, "/")
+}
+
+// fetchWebSeedPiece downloads a piece from a web seed, with one range request
+// per file that the piece overlaps.
+func (this *Torrent) fetchWebSeedPiece(ctx context.Context, seedUrl string, index int) ([]byte, error) {
+	output := make([]byte, this.PieceSize(index))
+	files := this.Files()
+	offset := int64(index) * int64(this.PieceLength())
+	err := eachFileRange(files, offset, len(output), func(fileIndex int, fileOffset int64, start int, end int) error {
+		options := this.webSeedCallOptions()
+		options.RangeStart = fileOffset
+		options.RangeLength = int64(end - start)
+		data, err := httpGet(ctx, this.webSeedFileUrl(seedUrl, files[fileIndex]), options)
+		if err != nil { return err }
+		copy(output[start:end], data)
+		return nil
+	})
+	if err != nil { return nil, err }
+	return output, nil
+}
+
+// HttpSeeds returns the URLs of the "httpseeds" key (BEP 17).
+func (this *Torrent) HttpSeeds() []string {
+	var output []string
+	seeds, _ := this.MetaInfo().GetList("httpseeds")
+	for _, e := range seeds {
+		if e.Type == bencoding.String && e.AsString != "" { output = append(output, e.AsString) }
+	}
+	return output
+}
+
+// fetchHttpSeedPiece downloads a piece from a BEP 17 HTTP seed. The whole
+// piece is requested, so the optional "ranges" parameter is not sent. A busy
+// seed responds with 503 and the number of seconds to wait as body.
+func (this *Torrent) fetchHttpSeedPiece(ctx context.Context, seedUrl string, index int) ([]byte, error) {
+	separator := "?"
+	if strings.Contains(seedUrl, "?") { separator = "&" }
+	callUrl := seedUrl + separator + "info_hash=" + url.QueryEscape(string(this.InfoHash())) + "&piece=" + strconv.Itoa(index)
+	options := this.webSeedCallOptions()
+	options.MaxBodyLength = int64(this.PieceSize(index))
+	output, err := httpGet(ctx, callUrl, options)
+	if err == ErrBodyTooLarge { return nil, ErrInvalidPieceLength }
+	var httpErr *HttpError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusServiceUnavailable {
+		seconds, parseErr := strconv.Atoi(strings.TrimSpace(string(httpErr.Body)))
+		if parseErr == nil && seconds > 0 { httpErr.RetryAfter = time.Duration(seconds) * time.Second }
+	}
+	if err != nil { return nil, err }
+	if len(output) != this.PieceSize(index) { return nil, ErrInvalidPieceLength }
+	return output, nil
+}
+
+func isHttpUrl(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// wait sleeps for the given duration, and returns false if the downloader
+// has been stopped or has finished in the meantime.
+func (this *Downloader) wait(duration time.Duration) bool {
+	select {
+		case <-this.stop: return false
+		case <-this.finished: return false
+		default:
+	}
+	if duration <= 0 { return true }
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+		case <-timer.C: return true
+		case <-this.stop: return false
+		case <-this.finished: return false
+	}
+}
+
+type fetchPieceFunc func(ctx context.Context, seedUrl string, index int) ([]byte, error)
+
+func (this *Downloader) startWebSeeds() {
+	start := func(seedUrl string, fetch fetchPieceFunc) {
+		if !isHttpUrl(seedUrl) { return }
+		this.mutex.Lock()
+		this.activeWebSeeds++
+		this.mutex.Unlock()
+		this.webSeeds.Add(1)
+		go this.runWebSeed(seedUrl, fetch)
+	}
+	for _, seedUrl := range this.torrent.WebSeeds() {
+		start(seedUrl, this.torrent.fetchWebSeedPiece)
+	}
+	for _, seedUrl := range this.torrent.HttpSeeds() {
+		start(seedUrl, this.torrent.fetchHttpSeedPiece)
+	}
+}
+
+// runWebSeed downloads pieces from a web seed or HTTP seed until the
+// download is complete. A seed has all the pieces, and is picked from like a
+// peer. After an error, the seed is not used for a delay that doubles with
+// each consecutive error, or for the delay the server asked for.
+func (this *Downloader) runWebSeed(seedUrl string, fetch fetchPieceFunc) {
+	defer this.webSeeds.Done()
+	for i := 0; i < this.torrent.PieceCount(); i++ {
+		this.picker.updateAvailability(i, 1)
+	}
+	defer func() {
+		for i := 0; i < this.torrent.PieceCount(); i++ {
+			this.picker.updateAvailability(i, -1)
+		}
+		this.mutex.Lock()
+		this.activeWebSeeds--
+		this.mutex.Unlock()
+	}()
+
+	backoff := this.webSeedBackoff
+	for !this.picker.isComplete() && this.wait(0) {
+		index, ok := this.picker.pick(func(int) bool { return true })
+		if !ok {
+			// The remaining pieces are being downloaded from peers.
+			if !this.wait(time.Second) { return }
+			continue
+		}
+
+		data, err := fetch(this.ctx, seedUrl, index)
+		if err == nil {
+			this.torrent.addDownloaded(len(data))
+			this.client.downloadLimiter.wait(len(data))
+			if this.completePiece(&pieceDownload{ index: index, data: data }, nil) {
+				backoff = this.webSeedBackoff
+				continue
+			}
+			// completePiece has released the piece.
+			err = ErrPieceHashMismatch
+		} else {
+			this.picker.release(index)
+		}
+
+		delay := backoff
+		var httpErr *HttpError
+		if errors.As(err, &httpErr) { delay = max(delay, httpErr.RetryAfter) }
+		backoff = min(backoff * 2, webSeedMaxBackoff)
+		if !this.wait(delay) { return }
+	}
+}